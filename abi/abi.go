@@ -5,6 +5,10 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -14,12 +18,22 @@ type Import struct {
 	Name string `json:"name,omitempty"` // 别名（如果有）
 }
 
+// ConstructorDirective marks the contract constructor, an exported function run once when the contract is deployed.
+// Constructors are opt-in: the directive goes on its own line in the doc comment of the function, so functions
+// of existing contracts never become constructors because of their name.
+//
+//	//govm:constructor
+//	func Init(supply uint64) { ... }
+const ConstructorDirective = "//govm:constructor"
+
 // ABI represents the Application Binary Interface of a contract
 type ABI struct {
 	PackageName string     `json:"package_name,omitempty"`
 	Imports     []Import   `json:"imports,omitempty"`
 	Functions   []Function `json:"functions,omitempty"`
 	Events      []Event    `json:"events,omitempty"`
+	Constructor string     `json:"constructor,omitempty"` // Name of the constructor in Functions, empty without one
+	Types       []Struct   `json:"types,omitempty"`       // Structs declared by the contract, to check arguments against
 }
 
 // Function represents a function in the contract
@@ -35,6 +49,13 @@ type Event struct {
 	Parameters []Parameter `json:"parameters,omitempty"`
 }
 
+// Struct represents a struct type declared by the contract.
+// Fields are named as in JSON, an embedded field has no name and brings in the fields of its type.
+type Struct struct {
+	Name   string      `json:"name,omitempty"`
+	Fields []Parameter `json:"fields,omitempty"`
+}
+
 // Parameter represents a function parameter or event field
 type Parameter struct {
 	Name string `json:"name,omitempty"`
@@ -44,7 +65,7 @@ type Parameter struct {
 // ExtractABI extracts the ABI information from contract code
 func ExtractABI(code []byte) (*ABI, error) {
 	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, "", code, parser.AllErrors)
+	file, err := parser.ParseFile(fset, "", code, parser.AllErrors|parser.ParseComments)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse contract: %w", err)
 	}
@@ -55,7 +76,43 @@ func ExtractABI(code []byte) (*ABI, error) {
 		Functions:   make([]Function, 0),
 		Events:      make([]Event, 0),
 	}
+	if err := abi.addFile(file); err != nil {
+		return nil, err
+	}
+	return abi, nil
+}
 
+// ExtractABIFromFiles extracts the ABI of a contract package made of several files, by file name.
+// All files must belong to the same package, the functions of each file follow those of the files sorted before it.
+func ExtractABIFromFiles(files map[string][]byte) (*ABI, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("contract has no files")
+	}
+	abi := &ABI{
+		Imports:   make([]Import, 0),
+		Functions: make([]Function, 0),
+		Events:    make([]Event, 0),
+	}
+	fset := token.NewFileSet()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		file, err := parser.ParseFile(fset, name, files[name], parser.AllErrors|parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse contract: %w", err)
+		}
+		if abi.PackageName == "" {
+			abi.PackageName = file.Name.Name
+		} else if file.Name.Name != abi.PackageName {
+			return nil, fmt.Errorf("file %s is in package %s, want %s", name, file.Name.Name, abi.PackageName)
+		}
+		if err := abi.addFile(file); err != nil {
+			return nil, fmt.Errorf("file %s: %w", name, err)
+		}
+	}
+	return abi, nil
+}
+
+// addFile adds the imports, exported functions and events of one contract file
+func (abi *ABI) addFile(file *ast.File) error {
 	// 提取导入信息
 	for _, imp := range file.Imports {
 		importInfo := Import{
@@ -64,12 +121,31 @@ func ExtractABI(code []byte) (*ABI, error) {
 		if imp.Name != nil {
 			importInfo.Name = imp.Name.Name
 		}
-		abi.Imports = append(abi.Imports, importInfo)
+		// Files of a package often share imports
+		if !slices.Contains(abi.Imports, importInfo) {
+			abi.Imports = append(abi.Imports, importInfo)
+		}
 	}
 
 	// Extract package-level functions and events
 	for _, decl := range file.Decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.TYPE {
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				if structType, ok := typeSpec.Type.(*ast.StructType); ok {
+					abi.Types = append(abi.Types, Struct{
+						Name:   typeSpec.Name.Name,
+						Fields: extractFields(structType),
+					})
+				}
+			}
+		}
 		if funcDecl, ok := decl.(*ast.FuncDecl); ok {
+			constructor := isConstructor(funcDecl)
+			if constructor && (funcDecl.Recv != nil || !funcDecl.Name.IsExported()) {
+				return fmt.Errorf("constructor %s must be an exported function", funcDecl.Name.Name)
+			}
+
 			// Skip methods (functions with receivers)
 			if funcDecl.Recv != nil {
 				continue
@@ -98,11 +174,33 @@ func ExtractABI(code []byte) (*ABI, error) {
 			events := extractEventsFromFunction(funcDecl)
 			abi.Events = append(abi.Events, events...)
 
+			if _, ok := abi.Function(function.Name); ok {
+				return fmt.Errorf("function %s is declared more than once", function.Name)
+			}
 			abi.Functions = append(abi.Functions, function)
+			if constructor {
+				if abi.Constructor != "" {
+					return fmt.Errorf("functions %s and %s are both marked as constructor", abi.Constructor, function.Name)
+				}
+				abi.Constructor = function.Name
+			}
 		}
 	}
 
-	return abi, nil
+	return nil
+}
+
+// isConstructor reports whether the doc comment of a function has ConstructorDirective
+func isConstructor(funcDecl *ast.FuncDecl) bool {
+	if funcDecl.Doc == nil {
+		return false
+	}
+	for _, comment := range funcDecl.Doc.List {
+		if strings.TrimSpace(comment.Text) == ConstructorDirective {
+			return true
+		}
+	}
+	return false
 }
 
 // extractEventsFromFunction extracts events from a function's body
@@ -210,6 +308,41 @@ func extractParameters(fieldList *ast.FieldList) []Parameter {
 	return params
 }
 
+// extractFields extracts the fields of a struct as they are encoded in JSON
+func extractFields(structType *ast.StructType) []Parameter {
+	fields := make([]Parameter, 0)
+	for _, field := range structType.Fields.List {
+		typeStr := getTypeString(field.Type)
+		var tag string
+		if field.Tag != nil {
+			if s, err := strconv.Unquote(field.Tag.Value); err == nil {
+				tag = reflect.StructTag(s).Get("json")
+			}
+		}
+		if tag == "-" {
+			continue
+		}
+		tagName, _, _ := strings.Cut(tag, ",")
+
+		if len(field.Names) == 0 {
+			// An embedded field without a name in its tag is flattened
+			fields = append(fields, Parameter{Name: tagName, Type: typeStr})
+			continue
+		}
+		for _, name := range field.Names {
+			if !name.IsExported() {
+				continue
+			}
+			fieldName := name.Name
+			if tagName != "" {
+				fieldName = tagName
+			}
+			fields = append(fields, Parameter{Name: fieldName, Type: typeStr})
+		}
+	}
+	return fields
+}
+
 // getTypeString converts an ast.Expr to its string representation
 func getTypeString(expr ast.Expr) string {
 	switch t := expr.(type) {
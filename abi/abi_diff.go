@@ -0,0 +1,271 @@
+package abi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChangeKind identifies a kind of difference between two ABIs
+type ChangeKind string
+
+const (
+	FunctionAdded         ChangeKind = "function_added"
+	FunctionRemoved       ChangeKind = "function_removed"
+	InputsChanged         ChangeKind = "inputs_changed"          // parameters added or removed
+	InputTypeChanged      ChangeKind = "input_type_changed"      // same position, different type
+	InputNameChanged      ChangeKind = "input_name_changed"      // same position, different name
+	OutputsChanged        ChangeKind = "outputs_changed"         // number or types of results changed
+	EventAdded            ChangeKind = "event_added"             // new event emitted
+	EventRemoved          ChangeKind = "event_removed"           // event no longer emitted
+	EventParameterAdded   ChangeKind = "event_parameter_added"   // event carries a new key
+	EventParameterRemoved ChangeKind = "event_parameter_removed" // event no longer carries a key
+	TypeAdded             ChangeKind = "type_added"              // new struct declared
+	TypeRemoved           ChangeKind = "type_removed"            // struct no longer declared
+	FieldAdded            ChangeKind = "field_added"             // struct has a new field
+	FieldRemoved          ChangeKind = "field_removed"           // struct no longer has a field
+	FieldTypeChanged      ChangeKind = "field_type_changed"      // same field, different type
+)
+
+// Change is one difference between two ABIs
+type Change struct {
+	Kind     ChangeKind `json:"kind"`
+	Breaking bool       `json:"breaking"`
+	Function string     `json:"function,omitempty"`
+	Event    string     `json:"event,omitempty"`
+	Type     string     `json:"type,omitempty"`
+	Detail   string     `json:"detail"`
+}
+
+// Diff is the result of comparing the ABI of a contract with the ABI of its successor
+type Diff struct {
+	Changes []Change `json:"changes"`
+}
+
+// Breaking reports whether any change can break existing callers
+func (d *Diff) Breaking() bool {
+	for _, c := range d.Changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a readable list of the changes
+func (d *Diff) String() string {
+	if len(d.Changes) == 0 {
+		return "no ABI changes\n"
+	}
+	var sb strings.Builder
+	for _, c := range d.Changes {
+		level := "compatible"
+		if c.Breaking {
+			level = "BREAKING"
+		}
+		sb.WriteString(fmt.Sprintf("[%s] %s: %s\n", level, c.Kind, c.Detail))
+	}
+	return sb.String()
+}
+
+// Compare compares the ABI of a contract with the ABI of its successor and classifies every difference
+// as breaking or compatible. Arguments are passed to contracts by parameter name, so renaming a parameter
+// is breaking. A leading core.Context parameter is filled in by the VM and is ignored.
+// Structs keep their name when their fields change, so their fields are compared too: struct arguments and
+// results are encoded by field name, so removing or retyping a field is breaking.
+func Compare(old, successor *ABI) *Diff {
+	diff := &Diff{}
+
+	newFuncs := make(map[string]Function)
+	for _, fn := range successor.Functions {
+		newFuncs[fn.Name] = fn
+	}
+	oldFuncs := make(map[string]bool)
+	for _, fn := range old.Functions {
+		oldFuncs[fn.Name] = true
+		newFn, ok := newFuncs[fn.Name]
+		if !ok {
+			diff.add(Change{Kind: FunctionRemoved, Breaking: true, Function: fn.Name,
+				Detail: fmt.Sprintf("function %s was removed", fn.Name)})
+			continue
+		}
+		diff.compareFunction(fn, newFn)
+	}
+	for _, fn := range successor.Functions {
+		if !oldFuncs[fn.Name] {
+			diff.add(Change{Kind: FunctionAdded, Function: fn.Name,
+				Detail: fmt.Sprintf("function %s was added", fn.Name)})
+		}
+	}
+
+	// The same event may be logged from several functions
+	oldEvents, oldOrder := mergeEvents(old.Events)
+	newEvents, newOrder := mergeEvents(successor.Events)
+	for _, name := range oldOrder {
+		newParams, ok := newEvents[name]
+		if !ok {
+			diff.add(Change{Kind: EventRemoved, Breaking: true, Event: name,
+				Detail: fmt.Sprintf("event %s was removed", name)})
+			continue
+		}
+		for _, param := range oldEvents[name] {
+			if !contains(newParams, param) {
+				diff.add(Change{Kind: EventParameterRemoved, Breaking: true, Event: name,
+					Detail: fmt.Sprintf("event %s no longer has parameter %s", name, param)})
+			}
+		}
+		for _, param := range newParams {
+			if !contains(oldEvents[name], param) {
+				diff.add(Change{Kind: EventParameterAdded, Event: name,
+					Detail: fmt.Sprintf("event %s has new parameter %s", name, param)})
+			}
+		}
+	}
+	for _, name := range newOrder {
+		if _, ok := oldEvents[name]; !ok {
+			diff.add(Change{Kind: EventAdded, Event: name,
+				Detail: fmt.Sprintf("event %s was added", name)})
+		}
+	}
+
+	diff.compareTypes(old.Types, successor.Types)
+	return diff
+}
+
+// compareTypes compares the fields of the structs in both ABIs.
+// A struct that was removed is not breaking by itself, the functions that took or returned it changed as well.
+func (d *Diff) compareTypes(old, successor []Struct) {
+	newTypes := make(map[string]Struct)
+	for _, st := range successor {
+		newTypes[st.Name] = st
+	}
+	oldTypes := make(map[string]bool)
+	for _, st := range old {
+		oldTypes[st.Name] = true
+		newSt, ok := newTypes[st.Name]
+		if !ok {
+			d.add(Change{Kind: TypeRemoved, Type: st.Name,
+				Detail: fmt.Sprintf("type %s was removed", st.Name)})
+			continue
+		}
+		d.compareFields(st, newSt)
+	}
+	for _, st := range successor {
+		if !oldTypes[st.Name] {
+			d.add(Change{Kind: TypeAdded, Type: st.Name,
+				Detail: fmt.Sprintf("type %s was added", st.Name)})
+		}
+	}
+}
+
+// compareFields compares the fields of a struct in both ABIs, by name.
+// Embedded fields have no name, they are matched by their type.
+func (d *Diff) compareFields(old, successor Struct) {
+	key := func(field Parameter) string {
+		if field.Name == "" {
+			return "embedded " + field.Type
+		}
+		return field.Name
+	}
+	newFields := make(map[string]Parameter)
+	for _, field := range successor.Fields {
+		newFields[key(field)] = field
+	}
+	oldFields := make(map[string]bool)
+	for _, field := range old.Fields {
+		oldFields[key(field)] = true
+		newField, ok := newFields[key(field)]
+		if !ok {
+			d.add(Change{Kind: FieldRemoved, Breaking: true, Type: old.Name,
+				Detail: fmt.Sprintf("type %s no longer has field %s", old.Name, key(field))})
+			continue
+		}
+		if newField.Type != field.Type {
+			d.add(Change{Kind: FieldTypeChanged, Breaking: true, Type: old.Name,
+				Detail: fmt.Sprintf("type %s field %s type changed from %s to %s", old.Name, key(field), field.Type, newField.Type)})
+		}
+	}
+	for _, field := range successor.Fields {
+		if !oldFields[key(field)] {
+			d.add(Change{Kind: FieldAdded, Type: old.Name,
+				Detail: fmt.Sprintf("type %s has new field %s", old.Name, key(field))})
+		}
+	}
+}
+
+func (d *Diff) add(c Change) {
+	d.Changes = append(d.Changes, c)
+}
+
+// compareFunction compares the signature of a function in both ABIs
+func (d *Diff) compareFunction(old, successor Function) {
+	oldIn, newIn := callerInputs(old.Inputs), callerInputs(successor.Inputs)
+	if len(oldIn) != len(newIn) {
+		d.add(Change{Kind: InputsChanged, Breaking: true, Function: old.Name,
+			Detail: fmt.Sprintf("function %s inputs changed from (%s) to (%s)", old.Name, formatParams(oldIn), formatParams(newIn))})
+	} else {
+		for i := range oldIn {
+			if oldIn[i].Type != newIn[i].Type {
+				d.add(Change{Kind: InputTypeChanged, Breaking: true, Function: old.Name,
+					Detail: fmt.Sprintf("function %s parameter %d type changed from %s to %s", old.Name, i, oldIn[i].Type, newIn[i].Type)})
+			}
+			if oldIn[i].Name != newIn[i].Name {
+				d.add(Change{Kind: InputNameChanged, Breaking: true, Function: old.Name,
+					Detail: fmt.Sprintf("function %s parameter %d renamed from %s to %s", old.Name, i, oldIn[i].Name, newIn[i].Name)})
+			}
+		}
+	}
+
+	// Results are returned by position, only their types matter
+	changed := len(old.Outputs) != len(successor.Outputs)
+	for i := 0; !changed && i < len(old.Outputs); i++ {
+		changed = old.Outputs[i].Type != successor.Outputs[i].Type
+	}
+	if changed {
+		d.add(Change{Kind: OutputsChanged, Breaking: true, Function: old.Name,
+			Detail: fmt.Sprintf("function %s outputs changed from (%s) to (%s)", old.Name, formatParams(old.Outputs), formatParams(successor.Outputs))})
+	}
+}
+
+// callerInputs returns the parameters supplied by callers, without a leading core.Context
+func callerInputs(params []Parameter) []Parameter {
+	if len(params) > 0 && params[0].Type == "core.Context" {
+		return params[1:]
+	}
+	return params
+}
+
+func formatParams(params []Parameter) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = strings.TrimSpace(p.Name + " " + p.Type)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mergeEvents groups event parameters by event name, keeping the order events first appear in
+func mergeEvents(events []Event) (map[string][]string, []string) {
+	merged := make(map[string][]string)
+	var order []string
+	for _, event := range events {
+		params, ok := merged[event.Name]
+		if !ok {
+			order = append(order, event.Name)
+		}
+		for _, p := range event.Parameters {
+			if !contains(params, p.Name) {
+				params = append(params, p.Name)
+			}
+		}
+		merged[event.Name] = params
+	}
+	return merged, order
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
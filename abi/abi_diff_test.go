@@ -0,0 +1,147 @@
+package abi
+
+import (
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	oldCode := []byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+func Transfer(ctx core.Context, to core.Address, amount uint64) bool {
+	core.Log("Transfer", "to", to, "amount", amount)
+	return true
+}
+
+func Balance(owner core.Address) uint64 {
+	return 0
+}
+
+func Burn(amount uint64) {
+	core.Log("Burn", "amount", amount)
+}
+`)
+
+	// Unchanged ABIs have no changes
+	oldABI, err := ExtractABI(oldCode)
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	diff := Compare(oldABI, oldABI)
+	if len(diff.Changes) != 0 || diff.Breaking() {
+		t.Fatalf("Compare() of identical ABIs = %v", diff.Changes)
+	}
+
+	// Only additions are compatible
+	compatible, err := ExtractABI([]byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+func Transfer(to core.Address, amount uint64) bool {
+	core.Log("Transfer", "to", to, "amount", amount, "memo", "")
+	return true
+}
+
+func Balance(owner core.Address) uint64 {
+	return 0
+}
+
+func Burn(amount uint64) {
+	core.Log("Burn", "amount", amount)
+}
+
+func Mint(amount uint64) {
+	core.Log("Mint", "amount", amount)
+}
+`))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	diff = Compare(oldABI, compatible)
+	if diff.Breaking() {
+		t.Fatalf("Compare() = %v, want only compatible changes", diff.Changes)
+	}
+	assertKinds(t, diff, FunctionAdded, EventParameterAdded, EventAdded)
+
+	breaking, err := ExtractABI([]byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+func Transfer(ctx core.Context, recipient core.Address, amount int64) bool {
+	return true
+}
+
+func Balance(owner core.Address) (uint64, error) {
+	return 0, nil
+}
+`))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	diff = Compare(oldABI, breaking)
+	if !diff.Breaking() {
+		t.Fatalf("Compare() = %v, want breaking changes", diff.Changes)
+	}
+	assertKinds(t, diff, InputNameChanged, InputTypeChanged, OutputsChanged, FunctionRemoved, EventRemoved, EventRemoved)
+}
+
+func TestCompareTypes(t *testing.T) {
+	oldABI, err := ExtractABI([]byte("package shop\n\n" +
+		"type Base struct {\n\tID uint64 `json:\"id\"`\n}\n\n" +
+		"type Order struct {\n\tBase\n\tAmount uint64 `json:\"amount\"`\n\tNote string `json:\"note\"`\n}\n\n" +
+		"type Draft struct {\n\tNote string\n}\n\n" +
+		"func Place(order Order) {}\n"))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+
+	// New structs and fields are compatible
+	compatible, err := ExtractABI([]byte("package shop\n\n" +
+		"type Base struct {\n\tID uint64 `json:\"id\"`\n}\n\n" +
+		"type Order struct {\n\tBase\n\tAmount uint64 `json:\"amount\"`\n\tNote string `json:\"note\"`\n\tMemo string `json:\"memo\"`\n}\n\n" +
+		"type Draft struct {\n\tNote string\n}\n\n" +
+		"type Receipt struct {\n\tID uint64\n}\n\n" +
+		"func Place(order Order) {}\n"))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	diff := Compare(oldABI, compatible)
+	if diff.Breaking() {
+		t.Fatalf("Compare() = %v, want only compatible changes", diff.Changes)
+	}
+	assertKinds(t, diff, FieldAdded, TypeAdded)
+
+	// The struct keeps its name, but a field was retyped and others removed
+	breaking, err := ExtractABI([]byte("package shop\n\n" +
+		"type Base struct {\n\tID uint64 `json:\"id\"`\n}\n\n" +
+		"type Order struct {\n\tAmount int64 `json:\"amount\"`\n\tNote string `json:\"-\"`\n}\n\n" +
+		"func Place(order Order) {}\n"))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	diff = Compare(oldABI, breaking)
+	if !diff.Breaking() {
+		t.Fatalf("Compare() = %v, want breaking changes", diff.Changes)
+	}
+	assertKinds(t, diff, FieldRemoved, FieldTypeChanged, FieldRemoved, TypeRemoved)
+}
+
+// assertKinds checks that a diff contains exactly the given kinds of changes
+func assertKinds(t *testing.T, diff *Diff, kinds ...ChangeKind) {
+	t.Helper()
+	if len(diff.Changes) != len(kinds) {
+		t.Fatalf("Compare() = %v, want %v", diff.Changes, kinds)
+	}
+	for _, kind := range kinds {
+		found := false
+		for _, c := range diff.Changes {
+			if c.Kind == kind {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Compare() is missing a %s change: %v", kind, diff.Changes)
+		}
+	}
+}
@@ -249,6 +249,38 @@ func (g *HandlerGenerator) generateHandler(fn Function) string {
 	return sb.String()
 }
 
+// GenerateNativeHandlers generates the handler functions and a NativeHandlers function returning them by name,
+// so the contract package can be linked into the host and run by the native runtime
+func (g *HandlerGenerator) GenerateNativeHandlers() string {
+	var sb strings.Builder
+	sb.WriteString(g.GenerateHandlers())
+
+	sb.WriteString("// NativeHandlers returns the handlers of the contract functions, used to run the contract in native mode\n")
+	sb.WriteString("func NativeHandlers() map[string]func(params []byte) (any, error) {\n")
+	sb.WriteString("\treturn map[string]func(params []byte) (any, error){\n")
+	for _, fn := range g.abi.Functions {
+		sb.WriteString(fmt.Sprintf("\t\t\"%s\": handle%s,\n", fn.Name, fn.Name))
+	}
+	sb.WriteString("\t}\n}\n")
+	return sb.String()
+}
+
+// GenerateNativeHandlerFile generates a complete handler file for native mode
+func GenerateNativeHandlerFile(abi *ABI) (string, error) {
+	code := NewHandlerGenerator(abi).GenerateNativeHandlers()
+	if !EnableFormatAfterGenerate {
+		return code, nil
+	}
+
+	// Format code
+	formattedCode, err := Format(code)
+	if err != nil {
+		return "", fmt.Errorf("failed to format code: %w", err)
+	}
+
+	return formattedCode, nil
+}
+
 // GenerateHandlerFile generates a complete handler file
 func GenerateHandlerFile(abi *ABI) (string, error) {
 	generator := NewHandlerGenerator(abi)
@@ -324,3 +324,32 @@ func TestFindImportForType(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateNativeHandlerFile(t *testing.T) {
+	abi := &ABI{
+		PackageName: "testcontract",
+		Functions: []Function{
+			{Name: "GetBalance", Outputs: []Parameter{{Name: "", Type: "uint64"}}},
+			{Name: "Reset"},
+		},
+	}
+
+	code, err := GenerateNativeHandlerFile(abi)
+	if err != nil {
+		t.Fatalf("Failed to generate native handler file: %v", err)
+	}
+
+	// 包含普通 handler 以及按函数名索引的 NativeHandlers
+	expected := `func NativeHandlers() map[string]func(params []byte) (any, error) {
+		return map[string]func(params []byte) (any, error){
+			"GetBalance": handleGetBalance,
+			"Reset":      handleReset,
+		}
+	}`
+	if !strings.Contains(code, "func handleGetBalance(params []byte) (any, error)") {
+		t.Errorf("Generated code has no handler:\n%s", code)
+	}
+	if !strings.Contains(strings.Join(strings.Fields(code), ""), strings.Join(strings.Fields(expected), "")) {
+		t.Errorf("Generated code has no NativeHandlers:\n%s", code)
+	}
+}
@@ -394,3 +394,113 @@ func TestFunction(ctx context.Context, t time.Time) error {
 		t.Errorf("Expected function name 'TestFunction', got '%s'", abi.Functions[0].Name)
 	}
 }
+
+func TestExtractABIConstructor(t *testing.T) {
+	abi, err := ExtractABI([]byte(`package token
+
+// Setup mints the supply
+//
+//govm:constructor
+func Setup(supply uint64) {}
+
+func Transfer(to string, amount uint64) {}
+`))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	if abi.Constructor != "Setup" {
+		t.Errorf("Expected constructor 'Setup', got '%s'", abi.Constructor)
+	}
+	// 构造函数仍然生成 handler, 部署时才能调用
+	if len(abi.Functions) != 2 {
+		t.Errorf("Expected 2 functions, got %d", len(abi.Functions))
+	}
+
+	abi, err = ExtractABI(counterContractCode)
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	if abi.Constructor != "" {
+		t.Errorf("Expected no constructor, got '%s'", abi.Constructor)
+	}
+
+	// 没有标记的 Init 只是普通函数
+	abi, err = ExtractABI([]byte("package token\n\n// Init sets up the token\nfunc Init() {}\n"))
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	if abi.Constructor != "" {
+		t.Errorf("Expected no constructor, got '%s'", abi.Constructor)
+	}
+
+	// 标记必须在导出函数上，且只能有一个
+	for _, code := range []string{
+		"package token\n\n//govm:constructor\nfunc setup() {}\n",
+		"package token\n\n//govm:constructor\nfunc A() {}\n\n//govm:constructor\nfunc B() {}\n",
+	} {
+		if _, err := ExtractABI([]byte(code)); err == nil {
+			t.Errorf("ExtractABI(%q) succeeded", code)
+		}
+	}
+}
+
+func TestExtractABIFromFiles(t *testing.T) {
+	files := map[string][]byte{
+		"types.go": []byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+type Account struct {
+	Owner   core.Address
+	Balance uint64
+}
+`),
+		"token.go": []byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+func Transfer(to core.Address, amount uint64) bool {
+	core.Log("Transfer", "to", to, "amount", amount)
+	return true
+}
+
+func Account(owner core.Address) Account {
+	return Account{Owner: owner}
+}
+`),
+	}
+
+	abi, err := ExtractABIFromFiles(files)
+	if err != nil {
+		t.Fatalf("Failed to extract ABI: %v", err)
+	}
+	if abi.PackageName != "token" {
+		t.Errorf("Expected package name 'token', got '%s'", abi.PackageName)
+	}
+	if len(abi.Imports) != 1 {
+		t.Errorf("Expected shared imports once, got %v", abi.Imports)
+	}
+	if len(abi.Functions) != 2 || abi.Functions[0].Name != "Transfer" || abi.Functions[1].Name != "Account" {
+		t.Errorf("Unexpected functions: %+v", abi.Functions)
+	}
+	if len(abi.Events) != 1 || abi.Events[0].Name != "Transfer" {
+		t.Errorf("Unexpected events: %+v", abi.Events)
+	}
+
+	// 所有文件必须属于同一个包
+	files["other.go"] = []byte("package other\n")
+	if _, err := ExtractABIFromFiles(files); err == nil {
+		t.Error("Expected error for files of different packages")
+	}
+	delete(files, "other.go")
+
+	// 函数不能重复定义
+	files["more.go"] = []byte("package token\n\nfunc Transfer() {}\n")
+	if _, err := ExtractABIFromFiles(files); err == nil {
+		t.Error("Expected error for duplicate functions")
+	}
+
+	if _, err := ExtractABIFromFiles(nil); err == nil {
+		t.Error("Expected error for no files")
+	}
+}
@@ -0,0 +1,568 @@
+package abi
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/govm-net/vm/types"
+)
+
+// ErrInvalidArgument is returned when an argument can't be converted to the type of its parameter
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// Packages of the types the host knows, see builtinType
+const (
+	corePackage  = "github.com/govm-net/vm/core"
+	typesPackage = "github.com/govm-net/vm/types"
+)
+
+// maxExactFloat is the largest integer a float64, and so a plain JSON number, holds exactly
+const maxExactFloat = 1 << 53
+
+// EncodeArgs converts the arguments of a function call to the JSON object its handler expects.
+//
+// args are either positional, one per input, or a single map[string]any of arguments by parameter name,
+// see namedArgs. A core.Context input takes no argument, every other input needs one.
+// Every argument is converted according to the type of its parameter:
+//   - core.Address, core.ObjectID and core.Hash from their value, a hex string or a byte slice
+//   - integers from any Go number, json.Number or decimal string, checked against the range of the type;
+//     float64 values, as decoded from JSON, must be exact
+//   - []byte from a byte slice, a 0x-prefixed hex string or a base64 string
+//   - slices, arrays and maps element by element
+//   - structs of the contract from a map or a struct, field by field; fields may be left out but not added
+//
+// Other types the ABI doesn't describe are passed through.
+// Errors wrap ErrInvalidArgument and name the parameter.
+func (a *ABI) EncodeArgs(function string, args []any) ([]byte, error) {
+	fn, ok := a.Function(function)
+	if !ok {
+		return nil, fmt.Errorf("function %s not found in contract", function)
+	}
+
+	// Inputs that take an argument
+	var inputs []Parameter
+	for i, input := range fn.Inputs {
+		if a.isContext(input.Type) {
+			// Callers used to pass nil for the context
+			if i == 0 && len(args) == len(fn.Inputs) && len(args) > 0 && args[0] == nil {
+				args = args[1:]
+			}
+			continue
+		}
+		inputs = append(inputs, input)
+	}
+
+	named, isNamed := a.namedArgs(inputs, args)
+	if isNamed {
+		for name := range named {
+			if !hasParameter(inputs, name) {
+				return nil, fmt.Errorf("%w: function %s has no parameter %s", ErrInvalidArgument, function, name)
+			}
+		}
+	} else if len(args) > len(inputs) {
+		return nil, fmt.Errorf("too many arguments for function %s: got %d, want %d", function, len(args), len(inputs))
+	}
+
+	params := make(map[string]any)
+	for i, input := range inputs {
+		var arg any
+		var ok bool
+		if isNamed {
+			arg, ok = named[input.Name]
+		} else if i < len(args) {
+			arg, ok = args[i], true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: missing parameter %s of function %s", ErrInvalidArgument, input.describe(i), function)
+		}
+		v, err := a.coerce(input.Type, arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parameter %s of function %s: %v", ErrInvalidArgument, input.describe(i), function, err)
+		}
+		params[input.Name] = v
+	}
+
+	argsBytes, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal function arguments: %w", err)
+	}
+	return argsBytes, nil
+}
+
+// Function returns the function with the given name
+func (a *ABI) Function(name string) (Function, bool) {
+	for _, fn := range a.Functions {
+		if fn.Name == name {
+			return fn, true
+		}
+	}
+	return Function{}, false
+}
+
+// namedArgs returns the arguments by name if args is a single map[string]any whose keys are all parameter names.
+// Otherwise the map is the argument of a function with a single input that takes an object, such as a map or
+// a struct, and is taken by name for any other function so that the names that don't match are reported.
+func (a *ABI) namedArgs(inputs []Parameter, args []any) (map[string]any, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	named, ok := args[0].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	if len(named) > 0 {
+		allNames := true
+		for name := range named {
+			allNames = allNames && hasParameter(inputs, name)
+		}
+		if allNames {
+			return named, true
+		}
+	}
+	if len(inputs) == 1 && a.takesObject(inputs[0].Type) {
+		return nil, false
+	}
+	return named, true
+}
+
+// takesObject reports whether a parameter of type typ is given as a JSON object
+func (a *ABI) takesObject(typ string) bool {
+	typ = strings.TrimLeft(typ, "*")
+	switch {
+	case strings.HasPrefix(typ, "map["):
+		return true
+	case strings.HasPrefix(typ, "["), isBasicType(typ):
+		return false
+	}
+	if _, ok := a.builtinType(typ); ok {
+		return false
+	}
+	// Structs of the contract, and named types the ABI doesn't describe
+	return true
+}
+
+func isBasicType(typ string) bool {
+	switch typ {
+	case "string", "bool", "int", "int8", "int16", "int32", "int64", "rune",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "byte", "float32", "float64":
+		return true
+	}
+	return false
+}
+
+// describe names the parameter at index i in errors, unnamed parameters by their position
+func (p Parameter) describe(i int) string {
+	if p.Name == "" {
+		return fmt.Sprintf("#%d (%s)", i+1, p.Type)
+	}
+	return fmt.Sprintf("%s (%s)", p.Name, p.Type)
+}
+
+func hasParameter(inputs []Parameter, name string) bool {
+	for _, input := range inputs {
+		if input.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// builtinType returns the name of a type of package core or types, such as Address for core.Address
+func (a *ABI) builtinType(typ string) (string, bool) {
+	pkg, name, ok := strings.Cut(typ, ".")
+	if !ok {
+		return "", false
+	}
+	for _, imp := range a.Imports {
+		alias := imp.Name
+		if alias == "" {
+			alias = imp.Path[strings.LastIndex(imp.Path, "/")+1:]
+		}
+		if alias == pkg {
+			return name, imp.Path == corePackage || imp.Path == typesPackage
+		}
+	}
+	// ABIs of prebuilt contracts may not list their imports
+	return name, pkg == "core" || pkg == "types"
+}
+
+func (a *ABI) isContext(typ string) bool {
+	name, ok := a.builtinType(typ)
+	return ok && name == "Context"
+}
+
+// coerce converts v to a value that encodes to the JSON of Go type typ
+func (a *ABI) coerce(typ string, v any) (any, error) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		v = rv.Elem().Interface()
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		return a.coerce(typ[1:], v)
+	case typ == "[]byte" || typ == "[]uint8":
+		return toBytes(v)
+	case strings.HasPrefix(typ, "[]"):
+		return a.coerceList(typ[2:], -1, v)
+	case strings.HasPrefix(typ, "["):
+		size, elem, _ := strings.Cut(typ[1:], "]")
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return v, nil
+		}
+		if _, ok := v.(string); ok && (elem == "byte" || elem == "uint8") {
+			b := make([]byte, n)
+			if err := toFixedBytes(v, b); err != nil {
+				return nil, err
+			}
+			v = b
+		}
+		return a.coerceList(elem, n, v)
+	case strings.HasPrefix(typ, "map["):
+		return a.coerceMap(mapElem(typ), v)
+	}
+
+	switch typ {
+	case "string":
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+			return rv.String(), nil
+		}
+		return nil, fmt.Errorf("expected a string, got %T", v)
+	case "bool":
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			return strconv.ParseBool(b)
+		}
+		return nil, fmt.Errorf("expected a bool, got %T", v)
+	case "int", "int64":
+		return toInteger(v, true, 64)
+	case "int8":
+		return toInteger(v, true, 8)
+	case "int16":
+		return toInteger(v, true, 16)
+	case "int32", "rune":
+		return toInteger(v, true, 32)
+	case "uint", "uint64", "uintptr":
+		return toInteger(v, false, 64)
+	case "uint8", "byte":
+		return toInteger(v, false, 8)
+	case "uint16":
+		return toInteger(v, false, 16)
+	case "uint32":
+		return toInteger(v, false, 32)
+	case "float32":
+		return toFloat(v, 32)
+	case "float64":
+		return toFloat(v, 64)
+	}
+
+	if name, ok := a.builtinType(typ); ok {
+		switch name {
+		case "Address":
+			// The array is filled before it is returned, Go doesn't order both in one return statement
+			var addr types.Address
+			err := toFixedBytes(v, addr[:])
+			return addr, err
+		case "ObjectID":
+			var id types.ObjectID
+			err := toFixedBytes(v, id[:])
+			return id, err
+		case "Hash":
+			var h types.Hash
+			err := toFixedBytes(v, h[:])
+			return h, err
+		}
+	}
+	if st, ok := a.structType(typ); ok {
+		return a.coerceStruct(st, v)
+	}
+	return v, nil
+}
+
+// structType returns the struct of the contract named typ
+func (a *ABI) structType(typ string) (Struct, bool) {
+	for _, st := range a.Types {
+		if st.Name == typ {
+			return st, true
+		}
+	}
+	return Struct{}, false
+}
+
+// structFields adds the fields of st by name to fields, with those of its embedded structs.
+// It reports false if a field comes from a type the ABI doesn't describe, whose fields are then unknown.
+func (a *ABI) structFields(st Struct, fields map[string]string, seen map[string]bool) bool {
+	if seen[st.Name] {
+		return true
+	}
+	seen[st.Name] = true
+	known := true
+	for _, field := range st.Fields {
+		if field.Name != "" {
+			// Fields of the outer struct hide those of embedded structs
+			if _, ok := fields[field.Name]; !ok {
+				fields[field.Name] = field.Type
+			}
+			continue
+		}
+		embedded, ok := a.structType(strings.TrimPrefix(field.Type, "*"))
+		if !ok {
+			known = false
+			continue
+		}
+		known = a.structFields(embedded, fields, seen) && known
+	}
+	return known
+}
+
+// coerceStruct converts a map, or a struct of the same fields, to the fields of st
+func (a *ABI) coerceStruct(st Struct, v any) (any, error) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		kind := reflect.ValueOf(v).Kind()
+		if kind != reflect.Struct && kind != reflect.Map {
+			return nil, fmt.Errorf("expected an object, got %T", v)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("expected an object, got %T", v)
+		}
+	}
+
+	fields := make(map[string]string)
+	known := a.structFields(st, fields, make(map[string]bool))
+	m := make(map[string]any, len(obj))
+	for key, value := range obj {
+		typ, ok := fieldType(fields, key)
+		if !ok {
+			if known {
+				return nil, fmt.Errorf("%s has no field %s", st.Name, key)
+			}
+			m[key] = value
+			continue
+		}
+		item, err := a.coerce(typ, value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		m[key] = item
+	}
+	return m, nil
+}
+
+// fieldType returns the type of a field, matched by name as encoding/json does: exactly, or else ignoring case
+func fieldType(fields map[string]string, name string) (string, bool) {
+	if typ, ok := fields[name]; ok {
+		return typ, true
+	}
+	for field, typ := range fields {
+		if strings.EqualFold(field, name) {
+			return typ, true
+		}
+	}
+	return "", false
+}
+
+// coerceList converts a slice or array to a list of elem, of length size unless it is negative
+func (a *ABI) coerceList(elem string, size int, v any) (any, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", v)
+	}
+	if size >= 0 && rv.Len() != size {
+		return nil, fmt.Errorf("expected %d elements, got %d", size, rv.Len())
+	}
+	list := make([]any, rv.Len())
+	for i := range list {
+		item, err := a.coerce(elem, rv.Index(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		list[i] = item
+	}
+	return list, nil
+}
+
+// coerceMap converts the values of a map with string keys to elem
+func (a *ABI) coerceMap(elem string, v any) (any, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("expected a map with string keys, got %T", v)
+	}
+	m := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		key := iter.Key().String()
+		item, err := a.coerce(elem, iter.Value().Interface())
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		m[key] = item
+	}
+	return m, nil
+}
+
+// mapElem returns the element type of a map type such as map[string][]int
+func mapElem(typ string) string {
+	depth := 0
+	for i, c := range typ {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return typ[i+1:]
+			}
+		}
+	}
+	return ""
+}
+
+// toInteger converts a number to an integer of the given signedness and size, returned as int64 or uint64
+func toInteger(v any, signed bool, bits int) (any, error) {
+	n := new(big.Int)
+	switch x := v.(type) {
+	case json.Number:
+		if _, ok := n.SetString(x.String(), 10); !ok {
+			return nil, fmt.Errorf("expected an integer, got %s", x)
+		}
+	case string:
+		s, base := x, 10
+		if strings.HasPrefix(s, "0x") {
+			s, base = s[2:], 16
+		}
+		if _, ok := n.SetString(s, base); !ok {
+			return nil, fmt.Errorf("expected an integer, got %q", x)
+		}
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n.SetInt64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			n.SetUint64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			if f != math.Trunc(f) {
+				return nil, fmt.Errorf("expected an integer, got %v", f)
+			}
+			if math.Abs(f) > maxExactFloat {
+				return nil, fmt.Errorf("%v is not exact as a float, pass it as an integer or a string", f)
+			}
+			n.SetInt64(int64(f))
+		default:
+			return nil, fmt.Errorf("expected an integer, got %T", v)
+		}
+	}
+
+	var lo, hi *big.Int
+	if signed {
+		hi = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(bits-1)), big.NewInt(1))
+		lo = new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), uint(bits-1)))
+	} else {
+		hi = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(bits)), big.NewInt(1))
+		lo = new(big.Int)
+	}
+	if n.Cmp(lo) < 0 || n.Cmp(hi) > 0 {
+		return nil, fmt.Errorf("%s out of range [%s, %s]", n, lo, hi)
+	}
+	if signed {
+		return n.Int64(), nil
+	}
+	return n.Uint64(), nil
+}
+
+// toFloat converts a number to a float of the given size
+func toFloat(v any, bits int) (any, error) {
+	switch x := v.(type) {
+	case json.Number:
+		return strconv.ParseFloat(x.String(), bits)
+	case string:
+		return strconv.ParseFloat(x, bits)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return nil, fmt.Errorf("expected a number, got %T", v)
+}
+
+// toBytes converts a byte slice, a 0x-prefixed hex string or a base64 string to bytes
+func toBytes(v any) ([]byte, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		if strings.HasPrefix(x, "0x") {
+			b, err := hex.DecodeString(x[2:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex string: %w", err)
+			}
+			return b, nil
+		}
+		b, err := base64.StdEncoding.DecodeString(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 string: %w", err)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("expected bytes, got %T", v)
+}
+
+// toFixedBytes fills out from a hex string, a byte slice or array of the same length, or a list of numbers
+// such as a fixed-size byte array decoded from JSON
+func toFixedBytes(v any, out []byte) error {
+	if s, ok := v.(string); ok {
+		b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+		if err != nil {
+			return fmt.Errorf("invalid hex string %q", s)
+		}
+		if len(b) != len(out) {
+			return fmt.Errorf("got %d bytes, want %d", len(b), len(out))
+		}
+		copy(out, b)
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return fmt.Errorf("expected a hex string or %d bytes, got %T", len(out), v)
+	}
+	if rv.Len() != len(out) {
+		return fmt.Errorf("got %d bytes, want %d", rv.Len(), len(out))
+	}
+	for i := range out {
+		b, err := toInteger(rv.Index(i).Interface(), false, 8)
+		if err != nil {
+			return fmt.Errorf("byte %d: %w", i, err)
+		}
+		out[i] = byte(b.(uint64))
+	}
+	return nil
+}
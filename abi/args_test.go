@@ -0,0 +1,112 @@
+package abi
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/govm-net/vm/types"
+)
+
+func TestEncodeArgs(t *testing.T) {
+	abi, err := ExtractABI([]byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+type Info struct {
+	Name string
+}
+
+type Base struct {
+	Owner core.Address ` + "`json:\"owner\"`" + `
+}
+
+type Order struct {
+	Base
+	ID     uint32 ` + "`json:\"id\"`" + `
+	Amount uint64
+	secret string
+	Note   string ` + "`json:\"-\"`" + `
+}
+
+func Transfer(ctx core.Context, to core.Address, amount uint64) {}
+
+func Batch(ids []core.ObjectID, counts map[string]int8) {}
+
+func Describe(info Info, data []byte, ratio float64, ok bool) {}
+
+func Tags(tags map[string]string) {}
+
+func Place(ctx core.Context, order *Order) {}
+`))
+	if err != nil {
+		t.Fatalf("ExtractABI() error = %v", err)
+	}
+	to := types.Address{0xab, 0x01}
+
+	tests := []struct {
+		name     string
+		function string
+		args     []any
+		want     string
+		wantErr  string
+	}{
+		{"address from hex", "Transfer", []any{"0x" + to.String(), "18446744073709551615"}, `{"amount":18446744073709551615,"to":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`, ""},
+		{"address value", "Transfer", []any{to, uint64(5)}, `{"amount":5,"to":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`, ""},
+		{"nil context", "Transfer", []any{nil, to.String(), 5}, `{"amount":5,"to":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`, ""},
+		{"json number", "Transfer", []any{to, json.Number("9007199254740993")}, `{"amount":9007199254740993,"to":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`, ""},
+		{"named", "Transfer", []any{map[string]any{"amount": 7.0, "to": to}}, `{"amount":7,"to":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`, ""},
+		{"lists and maps", "Batch", []any{[]string{strings.Repeat("01", 32)}, map[string]any{"a": -3.0}}, `{"counts":{"a":-3},"ids":[[1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1]]}`, ""},
+		{"struct and bytes", "Describe", []any{map[string]any{"Name": "x"}, "0x0102", 0.5, true}, `{"data":"AQI=","info":{"Name":"x"},"ok":true,"ratio":0.5}`, ""},
+		{"single map parameter", "Tags", []any{map[string]any{"k": "v"}}, `{"tags":{"k":"v"}}`, ""},
+		{"struct fields", "Place", []any{map[string]any{"id": 1.0, "amount": "2", "owner": to.String()}}, `{"order":{"amount":2,"id":1,"owner":[171,1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}}`, ""},
+		{"named struct", "Place", []any{map[string]any{"order": map[string]any{"Amount": 3}}}, `{"order":{"Amount":3}}`, ""},
+
+		{"short address", "Transfer", []any{"0x01", 1}, "", "invalid argument: parameter to (core.Address) of function Transfer: got 1 bytes, want 20"},
+		{"negative uint", "Transfer", []any{to, -1}, "", "invalid argument: parameter amount (uint64) of function Transfer: -1 out of range"},
+		{"inexact float", "Transfer", []any{to, float64(1 << 60)}, "", "is not exact as a float"},
+		{"fraction", "Transfer", []any{to, 1.5}, "", "expected an integer"},
+		{"int8 overflow", "Batch", []any{nil, map[string]any{"a": 200}}, "", `key "a": 200 out of range [-128, 127]`},
+		{"bad list element", "Batch", []any{[]any{"zz"}}, "", "element 0: invalid hex string"},
+		{"missing arguments", "Transfer", []any{to}, "", "missing parameter amount (uint64) of function Transfer"},
+		{"missing named argument", "Transfer", []any{map[string]any{"amount": 7.0}}, "", "missing parameter to (core.Address) of function Transfer"},
+		{"unknown field", "Place", []any{map[string]any{"id": 1, "price": 2}}, "", "invalid argument: parameter order (*Order) of function Place: Order has no field price"},
+		{"unexported field", "Place", []any{map[string]any{"secret": "x"}}, "", "Order has no field secret"},
+		{"wrong field type", "Place", []any{map[string]any{"id": -1}}, "", "field id: -1 out of range"},
+		{"not an object", "Describe", []any{"x", nil, 0, true}, "", "invalid argument: parameter info (Info) of function Describe: expected an object"},
+		{"too many", "Transfer", []any{to, 1, 2}, "", "too many arguments for function Transfer: got 3, want 2"},
+		{"unknown name", "Transfer", []any{map[string]any{"from": to}}, "", "function Transfer has no parameter from"},
+		{"wrong type", "Describe", []any{nil, nil, "x", true}, "", "invalid argument: parameter ratio (float64)"},
+		{"unknown function", "Mint", nil, "", "function Mint not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := abi.EncodeArgs(tt.function, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("EncodeArgs() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EncodeArgs() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("EncodeArgs() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	_, err = abi.EncodeArgs("Transfer", []any{"0x01"})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("EncodeArgs() error = %v, want ErrInvalidArgument", err)
+	}
+
+	// Parameters of prebuilt contracts may have no name, they are reported by position
+	unnamed := &ABI{Functions: []Function{{Name: "Set", Inputs: []Parameter{{Type: "uint64"}}}}}
+	_, err = unnamed.EncodeArgs("Set", []any{-1})
+	if err == nil || !strings.Contains(err.Error(), "parameter #1 (uint64) of function Set") {
+		t.Fatalf("EncodeArgs() error = %v, want the position of the parameter", err)
+	}
+}
@@ -0,0 +1,149 @@
+package abi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/govm-net/vm/types"
+)
+
+// DecodeResult converts the JSON result of a function call to Go values of the types of its outputs.
+//
+// A function with one output returns a value of its type, e.g. a uint64 or a core.Address, and a function
+// without outputs returns nil. The results of a function with several outputs, a JSON array, are returned as a
+// map[string]any by output name, unnamed outputs are named result0, result1... as in the generated handlers.
+// Structs and other types the ABI doesn't describe are decoded as generic JSON values with exact numbers.
+func (a *ABI) DecodeResult(function string, data []byte) (any, error) {
+	fn, ok := a.Function(function)
+	if !ok {
+		return nil, fmt.Errorf("function %s not found in contract", function)
+	}
+	if len(fn.Outputs) == 0 || len(bytes.TrimSpace(data)) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	if len(fn.Outputs) == 1 {
+		v, err := a.decodeValue(fn.Outputs[0].Type, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode result of %s: %w", function, err)
+		}
+		return v, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode results of %s: %w", function, err)
+	}
+	if len(items) != len(fn.Outputs) {
+		return nil, fmt.Errorf("failed to decode results of %s: got %d values, want %d", function, len(items), len(fn.Outputs))
+	}
+	results := make(map[string]any, len(items))
+	for i, output := range fn.Outputs {
+		name := output.Name
+		if name == "" {
+			name = fmt.Sprintf("result%d", i)
+		}
+		v, err := a.decodeValue(output.Type, items[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode result %s of %s: %w", name, function, err)
+		}
+		results[name] = v
+	}
+	return results, nil
+}
+
+// decodeValue decodes JSON data as a value of Go type typ
+func (a *ABI) decodeValue(typ string, data []byte) (any, error) {
+	t, ok := a.goType(typ)
+	if !ok {
+		var v any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// goTypes are the types of the parameters the host can represent, by name
+var goTypes = map[string]reflect.Type{
+	"bool":    reflect.TypeFor[bool](),
+	"string":  reflect.TypeFor[string](),
+	"int":     reflect.TypeFor[int](),
+	"int8":    reflect.TypeFor[int8](),
+	"int16":   reflect.TypeFor[int16](),
+	"int32":   reflect.TypeFor[int32](),
+	"rune":    reflect.TypeFor[rune](),
+	"int64":   reflect.TypeFor[int64](),
+	"uint":    reflect.TypeFor[uint](),
+	"uint8":   reflect.TypeFor[uint8](),
+	"byte":    reflect.TypeFor[byte](),
+	"uint16":  reflect.TypeFor[uint16](),
+	"uint32":  reflect.TypeFor[uint32](),
+	"uint64":  reflect.TypeFor[uint64](),
+	"uintptr": reflect.TypeFor[uintptr](),
+	"float32": reflect.TypeFor[float32](),
+	"float64": reflect.TypeFor[float64](),
+}
+
+// goType returns the Go type of an ABI type, false for types the ABI doesn't describe such as structs
+func (a *ABI) goType(typ string) (reflect.Type, bool) {
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		t, ok := a.goType(typ[1:])
+		if !ok {
+			return nil, false
+		}
+		return reflect.PointerTo(t), true
+	case strings.HasPrefix(typ, "[]"):
+		t, ok := a.goType(typ[2:])
+		if !ok {
+			return nil, false
+		}
+		return reflect.SliceOf(t), true
+	case strings.HasPrefix(typ, "["):
+		size, elem, _ := strings.Cut(typ[1:], "]")
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, false
+		}
+		t, ok := a.goType(elem)
+		if !ok {
+			return nil, false
+		}
+		return reflect.ArrayOf(n, t), true
+	case strings.HasPrefix(typ, "map["):
+		elem := mapElem(typ)
+		if typ[len("map["):len(typ)-len(elem)-1] != "string" {
+			return nil, false
+		}
+		t, ok := a.goType(elem)
+		if !ok {
+			return nil, false
+		}
+		return reflect.MapOf(reflect.TypeFor[string](), t), true
+	}
+	if t, ok := goTypes[typ]; ok {
+		return t, true
+	}
+	if name, ok := a.builtinType(typ); ok {
+		switch name {
+		case "Address":
+			return reflect.TypeFor[types.Address](), true
+		case "ObjectID":
+			return reflect.TypeFor[types.ObjectID](), true
+		case "Hash":
+			return reflect.TypeFor[types.Hash](), true
+		}
+	}
+	return nil, false
+}
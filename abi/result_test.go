@@ -0,0 +1,86 @@
+package abi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/govm-net/vm/types"
+)
+
+func TestDecodeResult(t *testing.T) {
+	abi, err := ExtractABI([]byte(`package token
+
+import "github.com/govm-net/vm/core"
+
+type Info struct {
+	Name string
+}
+
+func Mint() core.ObjectID { return core.ObjectID{} }
+
+func Supply() uint64 { return 0 }
+
+func Holders() (holders []core.Address, total uint64) { return nil, 0 }
+
+func Pair() (string, *int8) { return "", nil }
+
+func Describe() Info { return Info{} }
+
+func Reset() {}
+`))
+	if err != nil {
+		t.Fatalf("ExtractABI() error = %v", err)
+	}
+
+	id := types.ObjectID{0x01, 0x02}
+	idJSON, _ := json.Marshal(id)
+	holder := types.Address{0xab}
+	holdersJSON, _ := json.Marshal([]any{[]types.Address{holder}, uint64(1 << 60)})
+	var small int8 = -3
+
+	tests := []struct {
+		name     string
+		function string
+		data     string
+		want     any
+	}{
+		{"object id", "Mint", string(idJSON), id},
+		{"exact uint64", "Supply", "18446744073709551615", uint64(18446744073709551615)},
+		{"named outputs", "Holders", string(holdersJSON), map[string]any{"holders": []types.Address{holder}, "total": uint64(1 << 60)}},
+		{"unnamed outputs", "Pair", `["a",-3]`, map[string]any{"result0": "a", "result1": &small}},
+		{"struct", "Describe", `{"Name":"x","Amount":12345678901234567890}`, map[string]any{"Name": "x", "Amount": json.Number("12345678901234567890")}},
+		{"no outputs", "Reset", "", nil},
+		{"null", "Supply", "null", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := abi.DecodeResult(tt.function, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("DecodeResult() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("DecodeResult() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	for name, data := range map[string]string{
+		"wrong type":   `"x"`,
+		"wrong count":  `[["ab"]]`,
+		"not a list":   `1`,
+		"out of range": `-1`,
+		"unknown":      `1`,
+	} {
+		function := "Supply"
+		switch name {
+		case "wrong count", "not a list":
+			function = "Holders"
+		case "unknown":
+			function = "Burn"
+		}
+		if _, err := abi.DecodeResult(function, []byte(data)); err == nil {
+			t.Fatalf("DecodeResult() of %s succeeded", name)
+		}
+	}
+}
@@ -21,6 +21,17 @@ type ContractConfig struct {
 	// MaxCodeSize is the maximum size of contract code in bytes
 	MaxCodeSize uint64
 
+	// MaxMemoryPages is the maximum linear memory of a contract instance in 64KiB pages, 0 for no limit
+	MaxMemoryPages uint32
+
+	// MaxTableSize is the maximum number of table entries of a contract instance, 0 for no limit.
+	// With a limit, the tables of a contract must declare a maximum size within it.
+	MaxTableSize uint32
+
+	// MaxStackDepth is the maximum depth of nested function calls inside a contract instance, 0 for no limit.
+	// It is off by default like gas metering: a limit instruments every call site of every contract.
+	MaxStackDepth uint32
+
 	// AllowedImports contains the packages that can be imported by contracts
 	AllowedImports []string
 }
@@ -29,9 +40,11 @@ type IContractConfigGenerator func() ContractConfig
 
 var DefaultContractConfig IContractConfigGenerator = func() ContractConfig {
 	return ContractConfig{
-		MaxGas:       1000000,
-		MaxCallDepth: 8,
-		MaxCodeSize:  1024 * 1024, // 1MB
+		MaxGas:         1000000,
+		MaxCallDepth:   8,
+		MaxCodeSize:    1024 * 1024, // 1MB
+		MaxMemoryPages: 256,         // 16MB
+		MaxTableSize:   4096,
 		AllowedImports: []string{
 			"github.com/govm-net/vm/core",
 			// Additional allowed imports would be listed here
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/govm-net/vm/abi"
+)
+
+// runABIDiff compares the ABI of a contract with its successor and prints the changes.
+// It returns whether any change is breaking, so callers can gate redeployments on it.
+func runABIDiff(oldFile, newFile string, jsonOutput bool) (bool, error) {
+	// 检查必需参数
+	if oldFile == "" || newFile == "" {
+		return false, fmt.Errorf("old and new ABI files are required")
+	}
+
+	oldABI, err := loadABI(oldFile)
+	if err != nil {
+		return false, err
+	}
+	newABI, err := loadABI(newFile)
+	if err != nil {
+		return false, err
+	}
+
+	diff := abi.Compare(oldABI, newABI)
+	if jsonOutput {
+		out, err := json.MarshalIndent(struct {
+			Breaking bool `json:"breaking"`
+			*abi.Diff
+		}{diff.Breaking(), diff}, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal diff: %w", err)
+		}
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(diff.String())
+	}
+	return diff.Breaking(), nil
+}
+
+// loadABI reads an ABI from contract source (.go) or from an ABI JSON file as written at deployment
+func loadABI(file string) (*abi.ABI, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	if filepath.Ext(file) == ".go" {
+		return abi.ExtractABI(data)
+	}
+	var info abi.ABI
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse ABI %s: %w", file, err)
+	}
+	return &info, nil
+}
@@ -1,27 +1,35 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 
+	"github.com/govm-net/vm/compiler"
 	"github.com/govm-net/vm/context"
 	_ "github.com/govm-net/vm/context/db"
 	_ "github.com/govm-net/vm/context/memory"
+	"github.com/govm-net/vm/core"
 	"github.com/govm-net/vm/vm"
 )
 
-func runDeploy(sourceFile, repoDir, wasmDir string) error {
+func runDeploy(sourceFile, wasmFile, abiFile, initArgs, repoDir, wasmDir string) error {
 	// 检查必需参数
-	if sourceFile == "" {
-		return fmt.Errorf("source file is required")
+	if sourceFile == "" && wasmFile == "" {
+		return fmt.Errorf("source file or wasm file is required")
+	}
+	if wasmFile != "" && abiFile == "" {
+		return fmt.Errorf("abi file is required to deploy a wasm file")
 	}
 
-	// 读取源代码文件
-	code, err := os.ReadFile(sourceFile)
-	if err != nil {
-		return fmt.Errorf("failed to read source file: %w", err)
+	// 解析构造函数参数
+	var args []any
+	if initArgs != "" {
+		if err := json.Unmarshal([]byte(initArgs), &args); err != nil {
+			return fmt.Errorf("failed to parse constructor arguments: %w", err)
+		}
 	}
 
 	// 获取当前工作目录
@@ -64,7 +72,7 @@ func runDeploy(sourceFile, repoDir, wasmDir string) error {
 	defer engine.Close()
 
 	// 部署合约
-	address, err := engine.DeployContract(code)
+	address, err := deploy(engine, sourceFile, wasmFile, abiFile, args)
 	if err != nil {
 		return fmt.Errorf("failed to deploy contract: %w", err)
 	}
@@ -75,3 +83,25 @@ func runDeploy(sourceFile, repoDir, wasmDir string) error {
 
 	return nil
 }
+
+// deploy deploys the prebuilt WASM module if one is given, and the source file, directory or tar archive otherwise
+func deploy(engine *vm.Engine, sourceFile, wasmFile, abiFile string, args []any) (core.Address, error) {
+	if wasmFile == "" {
+		// 读取源代码，可以是单个文件、目录或 tar 包
+		files, err := compiler.LoadContractFiles(sourceFile)
+		if err != nil {
+			return core.Address{}, fmt.Errorf("failed to read source file: %w", err)
+		}
+		return engine.DeployContractFiles(files, args...)
+	}
+
+	wasmCode, err := os.ReadFile(wasmFile)
+	if err != nil {
+		return core.Address{}, fmt.Errorf("failed to read wasm file: %w", err)
+	}
+	abiJSON, err := os.ReadFile(abiFile)
+	if err != nil {
+		return core.Address{}, fmt.Errorf("failed to read abi file: %w", err)
+	}
+	return engine.DeployWasm(wasmCode, abiJSON, args...)
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
 	"github.com/govm-net/vm/vm"
 )
 
-func runExecute(contractAddr, funcName, argsJSON, sender, wasmDir string) error {
+func runExecute(contractAddr, funcName, argsJSON, sender string, value uint64, wasmDir string, trace bool) error {
 	// 检查必需参数
 	if contractAddr == "" {
 		return fmt.Errorf("contract address is required")
@@ -33,6 +35,7 @@ func runExecute(contractAddr, funcName, argsJSON, sender, wasmDir string) error
 		WASIContractsDir: wasmDir,
 		CodeManagerDir:   "code",
 		ContextType:      "db",
+		Debug:            trace,
 	}
 
 	// 创建VM引擎
@@ -44,7 +47,7 @@ func runExecute(contractAddr, funcName, argsJSON, sender, wasmDir string) error
 
 	ctx := engine.GetContext()
 	ctx.SetBlockInfo(1, 1, core.HashFromString("0x1234567890"))
-	ctx.SetTransactionInfo(core.HashFromString("0x1234567890ab"), core.AddressFromString(sender), core.AddressFromString(contractAddr), 1000)
+	ctx.SetTransactionInfo(core.HashFromString("0x1234567890ab"), core.AddressFromString(sender), core.AddressFromString(contractAddr), value)
 
 	// 解析参数
 	var params []byte
@@ -53,21 +56,59 @@ func runExecute(contractAddr, funcName, argsJSON, sender, wasmDir string) error
 	}
 
 	// 执行合约函数
-	result, err := engine.Execute(address, funcName, params)
+	receipt, err := engine.ExecuteTx(address, funcName, params)
 	if err != nil {
 		return fmt.Errorf("failed to execute contract: %w", err)
 	}
 
-	// 打印执行结果
-	if result != nil {
-		resultJSON, err := json.MarshalIndent(result, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal result: %w", err)
-		}
-		fmt.Printf("Execution result:\n%s\n", string(resultJSON))
-	} else {
-		fmt.Printf("Function executed successfully with no return value\n")
+	// 打印合约输出, 失败的调用也有
+	if trace {
+		printTrace(receipt.Trace)
+	}
+	if receipt.Status != types.ReceiptStatusSuccess {
+		return fmt.Errorf("failed to execute contract: %s", receipt.RevertReason)
 	}
 
+	// 按ABI的输出类型解码并打印执行结果
+	result, err := engine.DecodeResult(address, funcName, receipt.RawData)
+	if err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	printResult(result)
+
 	return nil
 }
+
+// printResult prints a decoded result with its type, functions with several outputs get a line per output
+func printResult(result any) {
+	switch r := result.(type) {
+	case nil:
+		fmt.Printf("Function executed successfully with no return value\n")
+	case map[string]any:
+		fmt.Println("Execution result:")
+		names := make([]string, 0, len(r))
+		for name := range r {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s (%T): %v\n", name, r[name], r[name])
+		}
+	default:
+		fmt.Printf("Execution result (%T): %v\n", r, r)
+	}
+}
+
+// printTrace prints the output contracts wrote during an execution
+func printTrace(trace []types.TraceEntry) {
+	if len(trace) == 0 {
+		fmt.Println("Execution trace: empty")
+		return
+	}
+	fmt.Println("Execution trace:")
+	for _, entry := range trace {
+		for _, line := range strings.Split(strings.TrimRight(entry.Output, "\n"), "\n") {
+			fmt.Printf("  [%s] %s\n", entry.Contract, line)
+		}
+	}
+}
@@ -10,41 +10,63 @@ func main() {
 	// 定义子命令
 	deployCommand := flag.NewFlagSet("deploy", flag.ExitOnError)
 	executeCommand := flag.NewFlagSet("execute", flag.ExitOnError)
+	abiDiffCommand := flag.NewFlagSet("abi-diff", flag.ExitOnError)
 
 	// deploy 命令的参数
-	sourceFile := deployCommand.String("f", "", "Source file of the contract")
+	sourceFile := deployCommand.String("f", "", "Source file of the contract, or a directory or tar archive of a multi-file contract")
 	repoDir := deployCommand.String("r", "code", "Repository directory")
 	wasmDir := deployCommand.String("w", "wasm", "WASM directory")
+	wasmFile := deployCommand.String("wasm", "", "Prebuilt WASM module of the contract, deployed instead of source")
+	abiFile := deployCommand.String("abi", "", "ABI JSON of the prebuilt WASM module")
+	initArgs := deployCommand.String("a", "", "Constructor arguments as a JSON array")
 
 	// execute 命令的参数
 	contractAddr := executeCommand.String("c", "", "Contract address")
 	funcName := executeCommand.String("f", "", "Function name to execute")
 	argsJSON := executeCommand.String("a", "", "Function arguments in JSON format")
 	sender := executeCommand.String("s", "", "Transaction sender address")
+	value := executeCommand.Uint64("v", 0, "Value paid by the sender to the contract")
 	wasmDir2 := executeCommand.String("w", "wasm", "WASM directory")
+	trace := executeCommand.Bool("trace", false, "Run in debug mode and print the contract output")
+
+	// abi-diff 命令的参数
+	oldABI := abiDiffCommand.String("old", "", "ABI of the deployed contract (.go source or .abi JSON)")
+	newABI := abiDiffCommand.String("new", "", "ABI of the successor contract (.go source or .abi JSON)")
+	jsonOutput := abiDiffCommand.Bool("json", false, "Print the diff as JSON")
 
 	// 检查参数
 	if len(os.Args) < 2 {
-		fmt.Println("expected 'deploy' or 'execute' subcommands")
+		fmt.Println("expected 'deploy', 'execute' or 'abi-diff' subcommands")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "deploy":
 		deployCommand.Parse(os.Args[2:])
-		if err := runDeploy(*sourceFile, *repoDir, *wasmDir); err != nil {
+		if err := runDeploy(*sourceFile, *wasmFile, *abiFile, *initArgs, *repoDir, *wasmDir); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 	case "execute":
 		executeCommand.Parse(os.Args[2:])
-		if err := runExecute(*contractAddr, *funcName, *argsJSON, *sender, *wasmDir2); err != nil {
+		if err := runExecute(*contractAddr, *funcName, *argsJSON, *sender, *value, *wasmDir2, *trace); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+	case "abi-diff":
+		abiDiffCommand.Parse(os.Args[2:])
+		breaking, err := runABIDiff(*oldABI, *newABI, *jsonOutput)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// Breaking changes exit with a distinct status so scripts can gate on it
+		if breaking {
+			os.Exit(2)
+		}
 	default:
 		fmt.Printf("unknown command: %s\n", os.Args[1])
-		fmt.Println("expected 'deploy' or 'execute' subcommands")
+		fmt.Println("expected 'deploy', 'execute' or 'abi-diff' subcommands")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,125 @@
+package compiler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LoadContractFiles reads the source files of a contract package, by file name.
+// path is a single .go file, a directory, or a .tar, .tar.gz or .tgz archive; the .go files of a directory
+// or archive form the package, test files are left out. Files in subdirectories are not part of the package.
+func LoadContractFiles(path string) (map[string][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contract: %w", err)
+	}
+	var files map[string][]byte
+	switch {
+	case info.IsDir():
+		files, err = loadDir(path)
+	case strings.HasSuffix(path, ".tar"):
+		files, err = loadTar(path, false)
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		files, err = loadTar(path, true)
+	default:
+		var code []byte
+		code, err = os.ReadFile(path)
+		files = map[string][]byte{filepath.Base(path): code}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contract: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no contract files found in %s", path)
+	}
+	return files, nil
+}
+
+// isSourceFile reports whether a file name is a source file of a contract package
+func isSourceFile(name string) bool {
+	return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+}
+
+// checkFileName checks the name of a contract file, names are plain file names without directories
+func checkFileName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid contract file name: %q", name)
+	}
+	if !strings.HasSuffix(name, ".go") {
+		return fmt.Errorf("contract file %s is not a Go source file", name)
+	}
+	if strings.HasSuffix(name, "_test.go") {
+		return fmt.Errorf("contract file %s is a test file", name)
+	}
+	return nil
+}
+
+func loadDir(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isSourceFile(entry.Name()) {
+			continue
+		}
+		code, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = code
+	}
+	return files, nil
+}
+
+func loadTar(file string, compressed bool) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Archives are often created from a directory, so its files may be under a single top-level directory
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag != tar.TypeReg || !isSourceFile(name) || strings.Count(name, "/") > 1 {
+			continue
+		}
+		name = path.Base(name)
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("duplicate file %s in archive", name)
+		}
+		code, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = code
+	}
+}
@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/govm-net/vm/api"
+)
+
+var packageFiles = map[string][]byte{
+	"types.go": []byte("package token\n\ntype Account struct {\n\tBalance uint64\n}\n"),
+	"token.go": []byte("package token\n\nfunc Balance() uint64 {\n\treturn Account{}.Balance\n}\n"),
+}
+
+func TestLoadContractFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, code := range packageFiles {
+		if err := os.WriteFile(filepath.Join(dir, name), code, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Test files and other files are not part of the package
+	os.WriteFile(filepath.Join(dir, "token_test.go"), []byte("package token\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("token\n"), 0644)
+
+	checkFiles := func(name string, files map[string][]byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: failed to load contract files: %v", name, err)
+		}
+		if len(files) != len(packageFiles) {
+			t.Fatalf("%s: expected %d files, got %d", name, len(packageFiles), len(files))
+		}
+		for file, code := range packageFiles {
+			if string(files[file]) != string(code) {
+				t.Errorf("%s: unexpected content of %s: %q", name, file, files[file])
+			}
+		}
+	}
+
+	files, err := LoadContractFiles(dir)
+	checkFiles("directory", files, err)
+
+	// Archive with the files under a top-level directory
+	archive := filepath.Join(t.TempDir(), "token.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, code := range packageFiles {
+		tw.WriteHeader(&tar.Header{Name: "token/" + name, Mode: 0644, Size: int64(len(code)), Typeflag: tar.TypeReg})
+		tw.Write(code)
+	}
+	tw.Close()
+	gz.Close()
+	f.Close()
+	files, err = LoadContractFiles(archive)
+	checkFiles("archive", files, err)
+
+	files, err = LoadContractFiles(filepath.Join(dir, "token.go"))
+	if err != nil || len(files) != 1 || string(files["token.go"]) != string(packageFiles["token.go"]) {
+		t.Errorf("Unexpected single file contract: %v, %v", files, err)
+	}
+
+	if _, err := LoadContractFiles(t.TempDir()); err == nil {
+		t.Error("Directory without Go files should fail to load")
+	}
+}
+
+func TestValidateSourceFiles(t *testing.T) {
+	maker := NewMaker(api.ContractConfig{
+		MaxCodeSize:    1024,
+		AllowedImports: []string{"github.com/govm-net/vm/core"},
+	})
+
+	if err := maker.ValidateSourceFiles(packageFiles); err != nil {
+		t.Errorf("Valid contract package should pass validation, but got error: %v", err)
+	}
+
+	tests := map[string][]byte{
+		"other.go":      []byte("package other\n"),
+		"worker.go":     []byte("package token\n\nfunc run() {\n\tgo func() {}()\n}\n"),
+		"imports.go":    []byte("package token\n\nimport \"os\"\n\nvar _ = os.Args\n"),
+		"../escape.go":  []byte("package token\n"),
+		"token_test.go": []byte("package token\n"),
+		"large.go":      []byte("package token\n\nvar data = `" + strings.Repeat("x", 1000) + "`\n"),
+	}
+	for name, code := range tests {
+		files := map[string][]byte{name: code}
+		for file, code := range packageFiles {
+			files[file] = code
+		}
+		err := maker.ValidateSourceFiles(files)
+		if err == nil {
+			t.Errorf("Contract package with %s should fail validation", name)
+		}
+	}
+
+	if err := maker.ValidateSourceFiles(map[string][]byte{"types.go": packageFiles["types.go"]}); err == nil {
+		t.Error("Contract package without exported functions should fail validation")
+	}
+}
@@ -8,9 +8,11 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/govm-net/vm/abi"
@@ -100,46 +102,17 @@ func NewMaker(config api.ContractConfig) *Maker {
 // ValidateContract checks if the smart contract code adheres to the
 // restrictions and rules defined for the VM.
 func (m *Maker) ValidateContract(code []byte) error {
-	// Parse the contract source code
-	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, "", code, parser.AllErrors)
-	if err != nil {
-		return fmt.Errorf("failed to parse contract: %w", err)
-	}
-
-	// Validate imports
-	if err := m.validateImports(file); err != nil {
-		return err
-	}
-
-	// Validate no restricted keywords are used
-	if err := m.validateNoRestrictedKeywords(file); err != nil {
-		return err
-	}
+	return m.ValidateContractFiles(map[string][]byte{"contract.go": code})
+}
 
-	// Validate no malicious commands in comments
-	if err := m.validateNoMaliciousCommands(file); err != nil {
+// ValidateContractFiles checks a contract package made of several files, by file name.
+// Every file is checked like the code of ValidateContract, and the package is built as a whole.
+func (m *Maker) ValidateContractFiles(files map[string][]byte) error {
+	packageName, err := m.validateFiles(files)
+	if err != nil {
 		return err
 	}
 
-	// Validate contract size
-	if len(code) > int(m.config.MaxCodeSize) {
-		return fmt.Errorf("contract size exceeds maximum allowed size of %d bytes", m.config.MaxCodeSize)
-	}
-
-	// Check if there's at least one exported function
-	hasExportedFunctions := false
-	for _, decl := range file.Decls {
-		if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Name.IsExported() {
-			hasExportedFunctions = true
-			break
-		}
-	}
-
-	if !hasExportedFunctions {
-		return errors.New("contract must have at least one exported (public) function")
-	}
-
 	// Create temporary directory for compilation verification
 	tmpDir, err := os.MkdirTemp("", "vm-contract-*")
 	if err != nil {
@@ -151,13 +124,14 @@ func (m *Maker) ValidateContract(code []byte) error {
 	srcDir := tmpDir
 
 	// Write contract code
-	contractFile := filepath.Join(srcDir, "contract.go")
-	if err := os.WriteFile(contractFile, code, 0644); err != nil {
-		return fmt.Errorf("failed to write contract code: %w", err)
+	for name, code := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, name), code, 0644); err != nil {
+			return fmt.Errorf("failed to write contract code: %w", err)
+		}
 	}
 
 	// Create go.mod file
-	goModContent := api.DefaultGoModGenerator(file.Name.Name, nil, nil)
+	goModContent := api.DefaultGoModGenerator(packageName, nil, nil)
 
 	if err := os.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte(goModContent), 0644); err != nil {
 		return fmt.Errorf("failed to write go.mod: %w", err)
@@ -183,6 +157,100 @@ func (m *Maker) ValidateContract(code []byte) error {
 	return nil
 }
 
+// ValidateSource checks the contract source against the restrictions of ValidateContract without building it,
+// for contracts that are built by other means such as the native runtime.
+func (m *Maker) ValidateSource(code []byte) error {
+	return m.ValidateSourceFiles(map[string][]byte{"contract.go": code})
+}
+
+// ValidateSourceFiles checks the files of a contract package like ValidateSource, without building it.
+func (m *Maker) ValidateSourceFiles(files map[string][]byte) error {
+	_, err := m.validateFiles(files)
+	return err
+}
+
+// validateFiles runs the static checks of the files of a contract package and returns its package name.
+// Each file is checked on its own, the size limit and the exported functions apply to the whole package.
+func (m *Maker) validateFiles(files map[string][]byte) (string, error) {
+	if len(files) == 0 {
+		return "", errors.New("contract has no files")
+	}
+
+	packageName := ""
+	size := 0
+	hasExportedFunctions := false
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		file, err := m.validateSource(files[name])
+		if err == nil {
+			err = checkFileName(name)
+		}
+		if err != nil {
+			// Errors of single file contracts read as before
+			if len(files) > 1 {
+				return "", fmt.Errorf("file %s: %w", name, err)
+			}
+			return "", err
+		}
+		if packageName == "" {
+			packageName = file.Name.Name
+		} else if file.Name.Name != packageName {
+			return "", fmt.Errorf("file %s is in package %s, want %s", name, file.Name.Name, packageName)
+		}
+		size += len(files[name])
+
+		for _, decl := range file.Decls {
+			if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Name.IsExported() {
+				hasExportedFunctions = true
+				break
+			}
+		}
+	}
+
+	// Validate contract size
+	if size > int(m.config.MaxCodeSize) {
+		return "", fmt.Errorf("contract size exceeds maximum allowed size of %d bytes", m.config.MaxCodeSize)
+	}
+
+	// Check if there's at least one exported function
+	if !hasExportedFunctions {
+		return "", errors.New("contract must have at least one exported (public) function")
+	}
+
+	return packageName, nil
+}
+
+// validateSource runs the static checks of one contract file and returns its parsed file
+func (m *Maker) validateSource(code []byte) (*ast.File, error) {
+	// Validate contract size
+	if len(code) > int(m.config.MaxCodeSize) {
+		return nil, fmt.Errorf("contract size exceeds maximum allowed size of %d bytes", m.config.MaxCodeSize)
+	}
+
+	// Parse the contract source code
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", code, parser.AllErrors)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse contract: %w", err)
+	}
+
+	// Validate imports
+	if err := m.validateImports(file); err != nil {
+		return nil, err
+	}
+
+	// Validate no restricted keywords are used
+	if err := m.validateNoRestrictedKeywords(file); err != nil {
+		return nil, err
+	}
+
+	// Validate no malicious commands in comments
+	if err := m.validateNoMaliciousCommands(file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
 // validateImports checks that the contract only imports allowed packages.
 func (m *Maker) validateImports(file *ast.File) error {
 	for _, imp := range file.Imports {
@@ -267,8 +335,14 @@ func (m *Maker) validateNoMaliciousCommands(file *ast.File) error {
 
 // CompileContract compiles the given contract source code.
 func (m *Maker) CompileContract(code []byte) ([]byte, error) {
+	return m.CompileContractFiles(map[string][]byte{"contract.go": code})
+}
+
+// CompileContractFiles compiles a contract package made of several files, by file name.
+// The ABI is extracted across all files, and the package is compiled with the generated handlers.
+func (m *Maker) CompileContractFiles(files map[string][]byte) ([]byte, error) {
 	// 1. Extract code ABI
-	abiInfo, err := abi.ExtractABI(code)
+	abiInfo, err := abi.ExtractABIFromFiles(files)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract ABI: %w", err)
 	}
@@ -291,11 +365,16 @@ func (m *Maker) CompileContract(code []byte) ([]byte, error) {
 	}
 
 	// 3. Place code in temporary folder and change package name to main
-	contractCode := string(code)
-	contractCode = strings.Replace(contractCode, "package "+abiInfo.PackageName, "package main", 1)
-	contractFile := filepath.Join(tmpDir, "source.go")
-	if err := os.WriteFile(contractFile, []byte(contractCode), 0644); err != nil {
-		return nil, fmt.Errorf("failed to write contract code: %w", err)
+	// Files are prefixed so they don't collide with the generated handlers.go and contract.go
+	for name, code := range files {
+		if err := checkFileName(name); err != nil {
+			return nil, err
+		}
+		contractCode := strings.Replace(string(code), "package "+abiInfo.PackageName, "package main", 1)
+		contractFile := filepath.Join(tmpDir, "source_"+name)
+		if err := os.WriteFile(contractFile, []byte(contractCode), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write contract code: %w", err)
+		}
 	}
 
 	// 4. Generate handler functions
@@ -305,15 +384,6 @@ func (m *Maker) CompileContract(code []byte) ([]byte, error) {
 	// Modify generated code to use main package
 	handlerCode = strings.Replace(handlerCode, "package "+abiInfo.PackageName, "package main", 1)
 
-	// Modify contract code to use main package
-	contractCode = string(code)
-	contractCode = strings.Replace(contractCode, "package "+abiInfo.PackageName, "package main", 1)
-
-	// Write modified contract code
-	if err := os.WriteFile(contractFile, []byte(contractCode), 0644); err != nil {
-		return nil, fmt.Errorf("failed to write contract code: %w", err)
-	}
-
 	handlerFile := filepath.Join(tmpDir, "handlers.go")
 	if err := os.WriteFile(handlerFile, []byte(handlerCode), 0644); err != nil {
 		return nil, fmt.Errorf("failed to write handler code: %w", err)
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"runtime"
@@ -29,6 +30,8 @@ const (
 	FuncGetObjectField     = int32(types.FuncGetObjectField)
 	FuncSetObjectField     = int32(types.FuncSetObjectField)
 	FuncGetObjectContract  = int32(types.FuncGetObjectContract)
+	FuncGetValue           = int32(types.FuncGetValue)
+	FuncSelfDestruct       = int32(types.FuncSelfDestruct)
 )
 
 // Define the size of the global receive data buffer
@@ -123,7 +126,7 @@ func callHost(funcID int32, data []byte) (resultPtr int32, resultSize int32, err
 	// Functions that need to return complex data through buffer
 	case FuncGetSender, FuncGetContractAddress, FuncCall,
 		FuncGetObject, FuncGetObjectWithOwner, FuncCreateObject,
-		FuncGetObjectOwner, FuncGetObjectField:
+		FuncGetObjectOwner, FuncGetObjectField, FuncGetValue:
 
 		// Use host function to get buffer data (returns data size)
 		resultSize = call_host_get_buffer(funcID, argPtr, argLen, hostBufferPtr)
@@ -219,6 +222,16 @@ func (c *Context) Sender() Address {
 	return addr
 }
 
+// Value returns the value the sender attached to the call
+func (c *Context) Value() uint64 {
+	mock.ConsumeGas(10)
+	ptr, size, errCode := callHost(FuncGetValue, nil)
+	if errCode != 0 || size != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(readMemory(ptr, size))
+}
+
 // BlockHeight returns the current block height
 func (c *Context) BlockHeight() uint64 {
 	mock.ConsumeGas(10)
@@ -294,6 +307,11 @@ func (c *Context) Transfer(from Address, to Address, amount uint64) error {
 
 // Call calls a function on another contract
 func (c *Context) Call(contract Address, function string, args ...any) ([]byte, error) {
+	return c.CallWithValue(contract, function, 0, args...)
+}
+
+// CallWithValue calls a function on another contract, paying value from the current contract to the callee
+func (c *Context) CallWithValue(contract Address, function string, value uint64, args ...any) ([]byte, error) {
 	mock.ConsumeGas(10000)
 	// Construct call parameters
 	callData := types.CallParams{
@@ -302,6 +320,7 @@ func (c *Context) Call(contract Address, function string, args ...any) ([]byte,
 		Args:     args,
 		Caller:   c.ContractAddress(), // Current contract as caller
 		GasLimit: mock.GetGas() - 10000,
+		Value:    value,
 	}
 
 	// Serialize call parameters
@@ -445,6 +464,26 @@ func (c *Context) Log(event string, keyValues ...any) {
 	_, _, _ = callHost(FuncLog, bytes)
 }
 
+// SelfDestruct destroys the contract when the execution succeeds, sending its balance to beneficiary
+func (c *Context) SelfDestruct(beneficiary Address) error {
+	mock.ConsumeGas(5000)
+	request := types.SelfDestructParams{
+		Contract:    c.ContractAddress(),
+		Beneficiary: beneficiary,
+	}
+
+	buff, err := any2bytes(request)
+	if err != nil {
+		return fmt.Errorf("failed to serialize self-destruct request: %w", err)
+	}
+
+	_, _, result := callHost(FuncSelfDestruct, buff)
+	if result != 0 {
+		return fmt.Errorf("self-destruct failed with code: %d", result)
+	}
+	return nil
+}
+
 // Object interface implementation
 
 // ID returns the unique identifier of the object
@@ -643,7 +682,7 @@ func handle_contract_call(inputPtr, inputLen int32) (code int32) {
 	// fmt.Println("handle_contract_call", inputPtr, inputLen)
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("handle_contract_call panic")
+			core.Debug("handle_contract_call panic:", r)
 			code = ErrorCodeExecutionPanic
 		}
 	}()
@@ -658,6 +697,7 @@ func handle_contract_call(inputPtr, inputLen int32) (code int32) {
 	if input.GasLimit > 0 {
 		mock.ResetGas(input.GasLimit)
 	}
+	core.SetDebug(input.Debug)
 
 	// fmt.Println("handle_contract_call functionName", functionName, string(input.Args))
 
@@ -674,12 +714,13 @@ func handle_contract_call(inputPtr, inputLen int32) (code int32) {
 	if !exists {
 		// Function not found
 		errMsg := fmt.Sprintf("Function not found: %s", functionName)
-		fmt.Println(errMsg)
+		core.Debug(errMsg)
 
 		// Return error result
 		result := types.ExecutionResult{
 			Success: false,
 			Error:   errMsg,
+			GasUsed: mock.GetUsedGas(),
 		}
 
 		// Serialize result
@@ -705,12 +746,13 @@ func handle_contract_call(inputPtr, inputLen int32) (code int32) {
 	if err != nil {
 		// Execution error
 		errMsg := fmt.Sprintf("Execution error: %v", err)
-		fmt.Println(errMsg)
+		core.Debug(errMsg)
 
 		// Return error result
 		result := types.ExecutionResult{
 			Success: false,
 			Error:   errMsg,
+			GasUsed: mock.GetUsedGas(),
 		}
 
 		// Serialize result
@@ -732,6 +774,7 @@ func handle_contract_call(inputPtr, inputLen int32) (code int32) {
 	result := types.ExecutionResult{
 		Success: true,
 		Data:    data,
+		GasUsed: mock.GetUsedGas(),
 	}
 	// fmt.Println("contract result", result)
 
@@ -2,6 +2,7 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/govm-net/vm/context"
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
 	"github.com/govm-net/vm/types"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -43,6 +45,22 @@ func (DBTransaction) TableName() string {
 	return "transactions"
 }
 
+// DBReceipt represents the execution receipt of a transaction
+type DBReceipt struct {
+	gorm.Model
+	TxHash      string `gorm:"column:tx_hash;not null;index;size:66"`
+	BlockHeight uint64 `gorm:"column:block_height;not null;index"`
+	Contract    string `gorm:"column:contract_address;not null;index;size:42"`
+	Status      uint8  `gorm:"column:status;not null"`
+	GasUsed     int64  `gorm:"column:gas_used;not null"`
+	Receipt     []byte `gorm:"column:receipt;type:blob;not null"` // JSON encoded types.Receipt
+}
+
+// TableName specifies the table name for DBReceipt
+func (DBReceipt) TableName() string {
+	return "receipts"
+}
+
 // DBObject represents the object in database
 type DBObject struct {
 	gorm.Model
@@ -105,6 +123,21 @@ type Context struct {
 	currentTx    *DBTransaction
 	currentBlock *DBBlock
 	nonce        uint64
+
+	// journal holds undo operations for every state change, used by snapshots
+	journal []func() error
+
+	// The writes made after the outermost snapshot are made in one database transaction,
+	// committed with that snapshot so that a crash never leaves a partial execution on disk
+	base       *gorm.DB // the database outside the transaction, nil when none is open
+	txSnapshot int      // the snapshot that began the transaction
+	dryRun     bool     // runs inside the transaction of DryRun, which is never committed
+
+	// stateTree keeps the Merkle tree of the state between blocks, every state change is marked in it
+	stateTree state.Tracker
+
+	// callHandler executes cross-contract calls
+	callHandler types.CallHandler
 }
 
 func init() {
@@ -142,6 +175,7 @@ func (c *Context) initDB() {
 	err := c.db.AutoMigrate(
 		&DBBlock{},
 		&DBTransaction{},
+		&DBReceipt{},
 		&DBObject{},
 		&DBObjectField{},
 		&DBBalance{},
@@ -168,6 +202,7 @@ func (c *Context) SetBlockInfo(height uint64, time int64, hash core.Hash) error
 func (c *Context) SetTransactionInfo(hash core.Hash, from types.Address, to types.Address, value uint64) error {
 	tx := &DBTransaction{
 		Hash:        hash.String(),
+		BlockHeight: c.BlockHeight(),
 		FromAddress: from.String(),
 		ToAddress:   to.String(),
 		Value:       value,
@@ -251,6 +286,14 @@ func (c *Context) Sender() core.Address {
 	return c.sender
 }
 
+// Value implements types.BlockchainContext
+func (c *Context) Value() uint64 {
+	if c.currentTx != nil {
+		return c.currentTx.Value
+	}
+	return 0
+}
+
 // GetGas implements types.BlockchainContext
 func (c *Context) GetGas() int64 {
 	return c.gasLimit
@@ -271,7 +314,9 @@ func (c *Context) Balance(addr core.Address) uint64 {
 
 // Transfer implements types.BlockchainContext
 func (c *Context) Transfer(contract core.Address, from, to core.Address, amount uint64) error {
-	return c.db.Transaction(func(tx *gorm.DB) error {
+	undoFrom := c.balanceUndo(from)
+	undoTo := c.balanceUndo(to)
+	err := c.db.Transaction(func(tx *gorm.DB) error {
 		// Get sender balance
 		var fromBalance DBBalance
 		result := tx.Where("address = ?", from.String()).First(&fromBalance)
@@ -317,10 +362,22 @@ func (c *Context) Transfer(contract core.Address, from, to core.Address, amount
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	c.stateTree.TouchBalance(from)
+	c.stateTree.TouchBalance(to)
+	c.journal = append(c.journal, undoFrom, undoTo)
+	return nil
 }
 
 // CreateObject implements types.BlockchainContext
 func (c *Context) CreateObject(contract core.Address) (types.VMObject, error) {
+	nonce := c.nonce
+	c.journal = append(c.journal, func() error {
+		c.nonce = nonce
+		return nil
+	})
 	c.nonce++
 	str := fmt.Sprintf("%x:%x:%d", c.currentTx.Hash, c.sender.String(), c.nonce)
 	hash := core.GetHash([]byte(str))
@@ -342,9 +399,26 @@ func (c *Context) CreateObjectWithID(contract core.Address, id core.ObjectID) (t
 		ObjectID: id.String(),
 	}
 
+	// A deleted object keeps its row, drop it so the ID can be used again, e.g. by a redeployed contract
+	var deleted DBObject
+	if c.db.Unscoped().Where("object_id = ? AND deleted_at IS NOT NULL", id.String()).First(&deleted).Error == nil {
+		if err := c.db.Unscoped().Delete(&deleted).Error; err != nil {
+			return nil, fmt.Errorf("failed to create object: %v", err)
+		}
+		c.journal = append(c.journal, func() error {
+			c.stateTree.TouchObject(core.AddressFromString(deleted.Contract), id)
+			return c.db.Unscoped().Create(&deleted).Error
+		})
+	}
+
 	if err := c.db.Create(dbObj).Error; err != nil {
 		return nil, fmt.Errorf("failed to create object: %v", err)
 	}
+	c.stateTree.TouchObject(contract, id)
+	c.journal = append(c.journal, func() error {
+		c.stateTree.TouchObject(contract, id)
+		return c.db.Unscoped().Delete(&DBObject{}, dbObj.ID).Error
+	})
 	fmt.Println("create object", dbObj)
 	return obj, nil
 }
@@ -389,22 +463,95 @@ func (c *Context) GetObjectWithOwner(contract core.Address, owner core.Address)
 	}, nil
 }
 
-// DeleteObject implements types.BlockchainContext
+// DeleteObject implements types.BlockchainContext, the fields of the object are deleted with it
 func (c *Context) DeleteObject(contract core.Address, id core.ObjectID) error {
-	result := c.db.Where("object_id = ? AND contract_address = ?", id.String(), contract.String()).Delete(&DBObject{})
+	var dbObj DBObject
+	result := c.db.Where("object_id = ? AND contract_address = ?", id.String(), contract.String()).First(&dbObj)
+	if result.Error == gorm.ErrRecordNotFound {
+		return fmt.Errorf("object not found")
+	}
 	if result.Error != nil {
-		return fmt.Errorf("failed to delete object: %v", result.Error)
+		return fmt.Errorf("failed to get object: %v", result.Error)
 	}
-	if result.RowsAffected == 0 {
-		return fmt.Errorf("object not found")
+	if err := c.deleteFields(dbObj.ObjectID); err != nil {
+		return err
+	}
+	if err := c.db.Delete(&dbObj).Error; err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	c.stateTree.TouchObject(contract, id)
+	c.journal = append(c.journal, func() error {
+		c.stateTree.TouchObject(contract, id)
+		return c.db.Unscoped().Model(&DBObject{}).Where("id = ?", dbObj.ID).Update("deleted_at", nil).Error
+	})
+	return nil
+}
+
+// DeleteContractObjects implements types.BlockchainContext, the fields of the objects are deleted with them
+func (c *Context) DeleteContractObjects(contract core.Address) ([]core.ObjectID, error) {
+	var dbObjs []DBObject
+	if err := c.db.Where("contract_address = ?", contract.String()).Order("object_id").Find(&dbObjs).Error; err != nil {
+		return nil, fmt.Errorf("failed to get objects: %v", err)
+	}
+	if len(dbObjs) == 0 {
+		return nil, nil
+	}
+	ids := make([]core.ObjectID, len(dbObjs))
+	objectIDs := make([]string, len(dbObjs))
+	rowIDs := make([]uint, len(dbObjs))
+	for i, obj := range dbObjs {
+		ids[i] = core.ObjectID(core.HashFromString(obj.ObjectID))
+		objectIDs[i] = obj.ObjectID
+		rowIDs[i] = obj.ID
 	}
+	if err := c.deleteFields(objectIDs...); err != nil {
+		return nil, err
+	}
+	if err := c.db.Delete(&DBObject{}, rowIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete objects: %v", err)
+	}
+	touch := func() {
+		for _, id := range ids {
+			c.stateTree.TouchObject(contract, id)
+		}
+	}
+	touch()
+	c.journal = append(c.journal, func() error {
+		touch()
+		return c.db.Unscoped().Model(&DBObject{}).Where("id IN ?", rowIDs).Update("deleted_at", nil).Error
+	})
+	return ids, nil
+}
+
+// deleteFields deletes every field of the given objects, so that an object created again with the same ID starts empty
+func (c *Context) deleteFields(objectIDs ...string) error {
+	var fieldIDs []uint
+	if err := c.db.Model(&DBObjectField{}).Where("object_id IN ?", objectIDs).Pluck("id", &fieldIDs).Error; err != nil {
+		return fmt.Errorf("failed to get object fields: %v", err)
+	}
+	if len(fieldIDs) == 0 {
+		return nil
+	}
+	if err := c.db.Delete(&DBObjectField{}, fieldIDs).Error; err != nil {
+		return fmt.Errorf("failed to delete object fields: %v", err)
+	}
+	c.journal = append(c.journal, func() error {
+		return c.db.Unscoped().Model(&DBObjectField{}).Where("id IN ?", fieldIDs).Update("deleted_at", nil).Error
+	})
 	return nil
 }
 
 // Call implements types.BlockchainContext
 func (c *Context) Call(caller core.Address, contract core.Address, function string, args ...any) ([]byte, error) {
-	// TODO: Implement contract call logic
-	return nil, fmt.Errorf("not implemented")
+	if c.callHandler == nil {
+		return nil, fmt.Errorf("call handler not set")
+	}
+	return c.callHandler(c, caller, contract, function, args...)
+}
+
+// SetCallHandler implements types.BlockchainContext
+func (c *Context) SetCallHandler(handler types.CallHandler) {
+	c.callHandler = handler
 }
 
 // Log implements types.BlockchainContext
@@ -436,6 +583,9 @@ func (c *Context) Log(contract core.Address, eventName string, keyValues ...any)
 		slog.Error("Failed to save event", "error", err)
 		return
 	}
+	c.journal = append(c.journal, func() error {
+		return c.db.Unscoped().Delete(&DBEvent{}, event.ID).Error
+	})
 
 	// 同时输出到日志
 	params := []any{
@@ -448,6 +598,234 @@ func (c *Context) Log(contract core.Address, eventName string, keyValues ...any)
 	slog.Info("Contract event", params...)
 }
 
+// SaveReceipt implements types.ReceiptStore
+func (c *Context) SaveReceipt(receipt *types.Receipt) error {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %v", err)
+	}
+	record := &DBReceipt{
+		TxHash:      receipt.TxHash.String(),
+		BlockHeight: receipt.BlockHeight,
+		Contract:    receipt.Contract.String(),
+		Status:      uint8(receipt.Status),
+		GasUsed:     receipt.GasUsed,
+		Receipt:     data,
+	}
+	if err := c.db.Create(record).Error; err != nil {
+		return fmt.Errorf("failed to save receipt: %v", err)
+	}
+	return nil
+}
+
+// GetReceipt implements types.ReceiptStore, returning the latest receipt of the transaction
+func (c *Context) GetReceipt(txHash core.Hash) (*types.Receipt, error) {
+	var record DBReceipt
+	if err := c.db.Where("tx_hash = ?", txHash.String()).Order("id desc").First(&record).Error; err != nil {
+		return nil, fmt.Errorf("failed to get receipt: %v", err)
+	}
+	var receipt types.Receipt
+	if err := json.Unmarshal(record.Receipt, &receipt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal receipt: %v", err)
+	}
+	return &receipt, nil
+}
+
+// StateRoot returns the Merkle root over all balances, objects and fields
+func (c *Context) StateRoot() (core.Hash, error) {
+	tree, err := c.stateTree.Tree(stateSource{c})
+	if err != nil {
+		return core.Hash{}, err
+	}
+	return tree.Root(), nil
+}
+
+// Prove returns the inclusion proof of an object field, or of the object itself if field is empty
+func (c *Context) Prove(contract core.Address, id core.ObjectID, field string) (*state.Proof, error) {
+	tree, err := c.stateTree.Tree(stateSource{c})
+	if err != nil {
+		return nil, err
+	}
+	return tree.Prove(state.FieldKey(contract, id, field))
+}
+
+// ProveBalance returns the inclusion proof of an account balance
+func (c *Context) ProveBalance(addr core.Address) (*state.Proof, error) {
+	tree, err := c.stateTree.Tree(stateSource{c})
+	if err != nil {
+		return nil, err
+	}
+	return tree.Prove(state.BalanceLeaf(addr, 0).Key)
+}
+
+// StateLeaves implements types.BlockchainContext
+func (c *Context) StateLeaves() ([]types.StateLeaf, error) {
+	var leaves []types.StateLeaf
+
+	var balances []DBBalance
+	if err := c.db.Where("balance > 0").Find(&balances).Error; err != nil {
+		return nil, fmt.Errorf("failed to get balances: %v", err)
+	}
+	for _, b := range balances {
+		leaves = append(leaves, state.BalanceLeaf(core.AddressFromString(b.Address), b.Amount))
+	}
+
+	var objects []DBObject
+	if err := c.db.Find(&objects).Error; err != nil {
+		return nil, fmt.Errorf("failed to get objects: %v", err)
+	}
+	var fields []DBObjectField
+	if err := c.db.Find(&fields).Error; err != nil {
+		return nil, fmt.Errorf("failed to get object fields: %v", err)
+	}
+	objectFields := make(map[string][]DBObjectField)
+	for _, f := range fields {
+		objectFields[f.ObjectID] = append(objectFields[f.ObjectID], f)
+	}
+
+	// Fields of deleted objects are not part of the state
+	for _, obj := range objects {
+		contract := core.AddressFromString(obj.Contract)
+		id := core.ObjectID(core.HashFromString(obj.ObjectID))
+		leaves = append(leaves, state.ObjectLeaf(contract, id, core.AddressFromString(obj.Owner)))
+		for _, f := range objectFields[obj.ObjectID] {
+			leaves = append(leaves, state.FieldLeaf(contract, id, f.Key, f.Value))
+		}
+	}
+	return leaves, nil
+}
+
+// stateSource implements state.Source, reading the leaves changed since the last commit
+type stateSource struct {
+	c *Context
+}
+
+func (s stateSource) StateLeaves() ([]types.StateLeaf, error) {
+	return s.c.StateLeaves()
+}
+
+func (s stateSource) BalanceLeaves(addr core.Address) ([]types.StateLeaf, error) {
+	var balances []DBBalance
+	if err := s.c.db.Where("address = ? AND balance > 0", addr.String()).Find(&balances).Error; err != nil {
+		return nil, fmt.Errorf("failed to get balance: %v", err)
+	}
+	var leaves []types.StateLeaf
+	for _, b := range balances {
+		leaves = append(leaves, state.BalanceLeaf(addr, b.Amount))
+	}
+	return leaves, nil
+}
+
+func (s stateSource) ObjectLeaves(contract core.Address, id core.ObjectID) ([]types.StateLeaf, error) {
+	var objects []DBObject
+	if err := s.c.db.Where("object_id = ? AND contract_address = ?", id.String(), contract.String()).Find(&objects).Error; err != nil {
+		return nil, fmt.Errorf("failed to get object: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	var fields []DBObjectField
+	if err := s.c.db.Where("object_id = ?", id.String()).Find(&fields).Error; err != nil {
+		return nil, fmt.Errorf("failed to get object fields: %v", err)
+	}
+	leaves := []types.StateLeaf{state.ObjectLeaf(contract, id, core.AddressFromString(objects[0].Owner))}
+	for _, f := range fields {
+		leaves = append(leaves, state.FieldLeaf(contract, id, f.Key, f.Value))
+	}
+	return leaves, nil
+}
+
+// Snapshot implements types.BlockchainContext, the outermost snapshot begins a database transaction
+func (c *Context) Snapshot() int {
+	id := len(c.journal)
+	if c.base == nil && !c.dryRun {
+		tx := c.db.Begin()
+		if tx.Error != nil {
+			// Without a transaction the journal still undoes the changes, only the atomicity on disk is lost
+			slog.Error("failed to begin transaction", "error", tx.Error)
+			return id
+		}
+		c.base, c.db, c.txSnapshot = c.db, tx, id
+	}
+	return id
+}
+
+// RevertToSnapshot implements types.BlockchainContext
+func (c *Context) RevertToSnapshot(id int) error {
+	if id < 0 || id > len(c.journal) {
+		return fmt.Errorf("invalid snapshot id: %d", id)
+	}
+	for i := len(c.journal) - 1; i >= id; i-- {
+		if err := c.journal[i](); err != nil {
+			return fmt.Errorf("failed to revert state: %v", err)
+		}
+		c.journal[i] = nil
+		c.journal = c.journal[:i]
+	}
+	// The undo operations are written in the transaction too, so it is committed as well
+	return c.endTransaction(id)
+}
+
+// CommitSnapshot implements types.BlockchainContext
+func (c *Context) CommitSnapshot(id int) error {
+	if id < 0 || id > len(c.journal) {
+		return fmt.Errorf("invalid snapshot id: %d", id)
+	}
+	clear(c.journal[id:])
+	c.journal = c.journal[:id]
+	return c.endTransaction(id)
+}
+
+// endTransaction commits the open transaction once the snapshot that began it, or an earlier one, is closed
+func (c *Context) endTransaction(id int) error {
+	if c.base == nil || id > c.txSnapshot {
+		return nil
+	}
+	tx := c.db
+	c.db, c.base = c.base, nil
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to commit state: %v", err)
+	}
+	return nil
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// DryRun implements types.DryRunner, fn runs inside a database transaction that is always rolled back
+func (c *Context) DryRun(fn func(ctx types.BlockchainContext) error) error {
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		dry := *c
+		dry.db = tx
+		dry.journal = nil
+		dry.base = nil
+		dry.dryRun = true
+		dry.stateTree = state.Tracker{}
+		if err := fn(&dry); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		return nil
+	}
+	return err
+}
+
+// balanceUndo returns an undo operation restoring the current balance of addr
+func (c *Context) balanceUndo(addr core.Address) func() error {
+	var balance DBBalance
+	result := c.db.Where("address = ?", addr.String()).First(&balance)
+	exists := result.Error == nil
+	return func() error {
+		c.stateTree.TouchBalance(addr)
+		if !exists {
+			return c.db.Where("address = ?", addr.String()).Delete(&DBBalance{}).Error
+		}
+		return c.db.Save(&balance).Error
+	}
+}
+
 // Object implements the VMObject interface
 type Object struct {
 	ctx      *Context
@@ -476,11 +854,19 @@ func (o *Object) SetOwner(contract, sender, addr core.Address) error {
 		return fmt.Errorf("not owner")
 	}
 
-	result := o.ctx.db.Model(&DBObject{}).Where("id = ? AND contract = ?", o.id.String(), o.contract.String()).
-		Update("owner", addr.String())
+	result := o.ctx.db.Model(&DBObject{}).Where("object_id = ? AND contract_address = ?", o.id.String(), o.contract.String()).
+		Update("owner_address", addr.String())
 	if result.Error != nil {
 		return fmt.Errorf("failed to update owner: %v", result.Error)
 	}
+	owner := o.owner
+	o.ctx.stateTree.TouchObject(o.contract, o.id)
+	o.ctx.journal = append(o.ctx.journal, func() error {
+		o.ctx.stateTree.TouchObject(o.contract, o.id)
+		o.owner = owner
+		return o.ctx.db.Model(&DBObject{}).Where("object_id = ? AND contract_address = ?", o.id.String(), o.contract.String()).
+			Update("owner_address", owner.String()).Error
+	})
 
 	o.owner = addr
 	return nil
@@ -512,16 +898,36 @@ func (o *Object) Set(contract, sender core.Address, field string, value []byte)
 	}
 
 	// Update or create field
-	result := o.ctx.db.Where("object_id = ? AND field_key = ?", o.id.String(), field).
-		Assign(DBObjectField{Value: value}).
-		FirstOrCreate(&DBObjectField{
+	var dbField DBObjectField
+	result := o.ctx.db.Where("object_id = ? AND field_key = ?", o.id.String(), field).First(&dbField)
+	if result.Error == gorm.ErrRecordNotFound {
+		dbField = DBObjectField{
 			ObjectID: o.id.String(),
 			Key:      field,
 			Value:    value,
+		}
+		if err := o.ctx.db.Create(&dbField).Error; err != nil {
+			return fmt.Errorf("failed to create field: %v", err)
+		}
+		o.ctx.stateTree.TouchObject(o.contract, o.id)
+		o.ctx.journal = append(o.ctx.journal, func() error {
+			o.ctx.stateTree.TouchObject(o.contract, o.id)
+			return o.ctx.db.Unscoped().Delete(&DBObjectField{}, dbField.ID).Error
 		})
-
+		return nil
+	}
 	if result.Error != nil {
-		return fmt.Errorf("failed to update field: %v", result.Error)
+		return fmt.Errorf("failed to get field: %v", result.Error)
+	}
+
+	old := dbField.Value
+	if err := o.ctx.db.Model(&dbField).Update("field_value", value).Error; err != nil {
+		return fmt.Errorf("failed to update field: %v", err)
 	}
+	o.ctx.stateTree.TouchObject(o.contract, o.id)
+	o.ctx.journal = append(o.ctx.journal, func() error {
+		o.ctx.stateTree.TouchObject(o.contract, o.id)
+		return o.ctx.db.Model(&DBObjectField{}).Where("id = ?", dbField.ID).Update("field_value", old).Error
+	})
 	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
+	"github.com/govm-net/vm/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -191,3 +193,272 @@ func TestEventLogging(t *testing.T) {
 	assert.Equal(t, "key2", data[2])
 	assert.Equal(t, float64(123), data[3]) // JSON 将数字解码为 float64
 }
+
+func TestSnapshotRevert(t *testing.T) {
+	ctx := setupTestDB(t)
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0))
+	require.NoError(t, ctx.db.Create(&DBBalance{Address: sender.String(), Amount: 1000}).Error)
+
+	// 快照之前已存在的状态
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("before")))
+
+	snapshot := ctx.Snapshot()
+
+	// 快照之后修改余额、字段、所有者、对象和事件
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 400))
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("after")))
+	require.NoError(t, obj.Set(contract, sender, "extra", []byte("new")))
+	require.NoError(t, obj.SetOwner(contract, sender, sender))
+	created, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, ctx.DeleteObject(contract, obj.ID()))
+	ctx.Log(contract, "reverted")
+
+	// 回滚并验证状态恢复
+	require.NoError(t, ctx.RevertToSnapshot(snapshot))
+
+	assert.Equal(t, uint64(1000), ctx.Balance(sender))
+	assert.Equal(t, uint64(0), ctx.Balance(contract))
+	assert.Equal(t, contract, obj.Owner())
+	// 最外层快照结束后事务已提交
+	assert.Nil(t, ctx.base)
+
+	restored, err := ctx.GetObject(contract, obj.ID())
+	require.NoError(t, err)
+	assert.Equal(t, contract, restored.Owner())
+	value, err := restored.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), value)
+	value, err = restored.Get(contract, "extra")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	_, err = ctx.GetObject(contract, created.ID())
+	assert.Error(t, err)
+
+	var count int64
+	require.NoError(t, ctx.db.Model(&DBEvent{}).Where("event_name = ?", "reverted").Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+
+	// 无效的快照ID
+	assert.Error(t, ctx.RevertToSnapshot(-1))
+	assert.Error(t, ctx.RevertToSnapshot(ctx.Snapshot()+1))
+}
+
+func TestCommitSnapshot(t *testing.T) {
+	ctx := setupTestDB(t)
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0))
+
+	// 最外层快照开启事务，嵌套快照不会提交它
+	snapshot := ctx.Snapshot()
+	require.NotNil(t, ctx.base)
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	nested := ctx.Snapshot()
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("kept")))
+	require.NoError(t, ctx.CommitSnapshot(nested))
+	assert.NotNil(t, ctx.base)
+
+	// 提交最外层快照后日志清空，事务提交
+	require.NoError(t, ctx.CommitSnapshot(snapshot))
+	assert.Empty(t, ctx.journal)
+	assert.Nil(t, ctx.base)
+
+	// 重新打开数据库后状态仍在
+	reopened := NewContext(map[string]any{"db_path": "./test.db"}).(*Context)
+	stored, err := reopened.GetObject(contract, obj.ID())
+	require.NoError(t, err)
+	value, err := stored.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("kept"), value)
+
+	assert.Error(t, ctx.CommitSnapshot(-1))
+	assert.Error(t, ctx.CommitSnapshot(ctx.Snapshot()+1))
+}
+
+func TestStateRoot(t *testing.T) {
+	ctx := setupTestDB(t)
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, core.Address{0x02}, core.Address{0x01}, 0))
+	require.NoError(t, ctx.db.Create(&DBBalance{Address: core.Address{0x02}.String(), Amount: 1000}).Error)
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	check := func(step string) {
+		root, err := ctx.StateRoot()
+		require.NoError(t, err)
+		leaves, err := ctx.StateLeaves()
+		require.NoError(t, err)
+		assert.Equal(t, state.Root(leaves), root, step)
+		proof, err := ctx.ProveBalance(sender)
+		require.NoError(t, err)
+		assert.True(t, state.VerifyProof(root, state.BalanceLeaf(sender, ctx.Balance(sender)), proof), step)
+	}
+	check("initial state")
+
+	// 每次计算根之后只更新变化的叶子
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 100))
+	check("transfer")
+	obj, err := ctx.CreateObjectWithID(contract, core.ObjectID{0x20})
+	require.NoError(t, err)
+	check("create object")
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("1")))
+	check("set field")
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("2")))
+	check("change field")
+	require.NoError(t, obj.SetOwner(contract, contract, sender))
+	check("set owner")
+
+	// 在计算根之后回滚的修改也会更新树
+	snapshot := ctx.Snapshot()
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 100))
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("3")))
+	_, err = ctx.CreateObjectWithID(contract, core.ObjectID{0x21})
+	require.NoError(t, err)
+	require.NoError(t, ctx.DeleteObject(contract, obj.ID()))
+	check("before revert")
+	require.NoError(t, ctx.RevertToSnapshot(snapshot))
+	check("revert")
+
+	// 试运行的修改不影响树
+	require.NoError(t, ctx.DryRun(func(dry types.BlockchainContext) error {
+		return dry.Transfer(contract, sender, contract, 100)
+	}))
+	check("dry run")
+
+	_, err = ctx.DeleteContractObjects(contract)
+	require.NoError(t, err)
+	check("delete contract objects")
+	_, err = ctx.CreateObjectWithID(core.Address{0x03}, core.ObjectID{0x20})
+	require.NoError(t, err)
+	check("create deleted object again")
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := setupTestDB(t)
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0))
+	require.NoError(t, ctx.db.Create(&DBBalance{Address: sender.String(), Amount: 1000}).Error)
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("before")))
+	before, err := ctx.StateLeaves()
+	require.NoError(t, err)
+	snapshot := ctx.Snapshot()
+
+	// 试运行中的修改对其自身可见
+	err = ctx.DryRun(func(dry types.BlockchainContext) error {
+		require.NoError(t, dry.Transfer(contract, sender, contract, 400))
+		dryObj, err := dry.GetObject(contract, obj.ID())
+		require.NoError(t, err)
+		require.NoError(t, dryObj.Set(contract, sender, "name", []byte("after")))
+		_, err = dry.CreateObject(contract)
+		require.NoError(t, err)
+		dry.Log(contract, "dry")
+		assert.Equal(t, uint64(600), dry.Balance(sender))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// 试运行结束后不留下任何行
+	after, err := ctx.StateLeaves()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	var count int64
+	require.NoError(t, ctx.db.Unscoped().Model(&DBObject{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+	require.NoError(t, ctx.db.Model(&DBEvent{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+	assert.Equal(t, snapshot, ctx.Snapshot())
+
+	// 错误原样返回
+	assert.ErrorIs(t, ctx.DryRun(func(types.BlockchainContext) error { return os.ErrNotExist }), os.ErrNotExist)
+}
+
+func TestDeleteContractObjects(t *testing.T) {
+	ctx := setupTestDB(t)
+
+	contract := core.Address{0x01}
+	other := core.Address{0x02}
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, other, contract, 0))
+	var id core.ObjectID
+	copy(id[:], contract[:])
+	obj, err := ctx.CreateObjectWithID(contract, id)
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, contract, "name", []byte("old")))
+	_, err = ctx.CreateObject(contract)
+	require.NoError(t, err)
+	kept, err := ctx.CreateObject(other)
+	require.NoError(t, err)
+
+	// 删除合约的所有对象，回滚后恢复
+	snapshot := ctx.Snapshot()
+	ids, err := ctx.DeleteContractObjects(contract)
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+	assert.Contains(t, ids, id)
+	_, err = ctx.GetObject(contract, id)
+	assert.Error(t, err)
+	_, err = ctx.GetObject(other, kept.ID())
+	assert.NoError(t, err)
+
+	require.NoError(t, ctx.RevertToSnapshot(snapshot))
+	restored, err := ctx.GetObject(contract, id)
+	require.NoError(t, err)
+	value, err := restored.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), value)
+
+	// 已删除对象的ID可以重新使用，旧字段不再可见
+	_, err = ctx.DeleteContractObjects(contract)
+	require.NoError(t, err)
+	recreated, err := ctx.CreateObjectWithID(contract, id)
+	require.NoError(t, err)
+	value, err = recreated.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestReceiptStore(t *testing.T) {
+	ctx := setupTestDB(t)
+
+	tx := core.HashFromString("0x5678")
+	contract := core.AddressFromString("0xcontract")
+	receipt := &types.Receipt{
+		TxHash:         tx,
+		BlockHeight:    100,
+		Contract:       contract,
+		Function:       "Transfer",
+		Status:         types.ReceiptStatusSuccess,
+		Data:           "ok",
+		GasUsed:        1234,
+		Logs:           []types.EventLog{{Contract: contract, Event: "Transfer", KeyValues: []any{"amount", float64(10)}}},
+		CreatedObjects: []core.ObjectID{{0x01}},
+		RawData:        json.RawMessage(`"ok"`),
+	}
+	require.NoError(t, ctx.SaveReceipt(receipt))
+
+	// 验证收据记录
+	var record DBReceipt
+	require.NoError(t, ctx.db.Where("tx_hash = ?", tx.String()).First(&record).Error)
+	assert.Equal(t, contract.String(), record.Contract)
+	assert.Equal(t, uint8(types.ReceiptStatusSuccess), record.Status)
+	assert.Equal(t, int64(1234), record.GasUsed)
+
+	saved, err := ctx.GetReceipt(tx)
+	require.NoError(t, err)
+	assert.Equal(t, receipt, saved)
+
+	// 不存在的收据
+	_, err = ctx.GetReceipt(core.HashFromString("0x9999"))
+	assert.Error(t, err)
+}
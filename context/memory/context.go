@@ -1,14 +1,18 @@
 package memory
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"sync"
 
 	"github.com/govm-net/vm/context"
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
 	"github.com/govm-net/vm/types"
 )
 
@@ -29,19 +33,30 @@ type defaultBlockchainContext struct {
 	// Current execution context
 	contractAddr types.Address
 	sender       types.Address
+	value        uint64
 	txHash       core.Hash
 	nonce        uint64
 	gasLimit     int64
 	mu           sync.Mutex
+
+	// journal holds undo operations for every state change, used by snapshots
+	journal []func()
+
+	// stateTree keeps the Merkle tree of the state between blocks, every state change is marked in it
+	stateTree state.Tracker
+
+	// callHandler executes cross-contract calls
+	callHandler types.CallHandler
 }
 
 func init() {
 	context.Register(context.MemoryContextType, NewBlockchainContext)
 }
 
-// NewDefaultBlockchainContext creates a new simple blockchain context
+// NewDefaultBlockchainContext creates a new simple blockchain context.
+// Accounts start with the balances of params["balances"] if it is a map[core.Address]uint64.
 func NewBlockchainContext(params map[string]any) types.BlockchainContext {
-	return &defaultBlockchainContext{
+	ctx := &defaultBlockchainContext{
 		blockHeight:    0,
 		blockTime:      0,
 		balances:       make(map[core.Address]uint64),
@@ -50,6 +65,12 @@ func NewBlockchainContext(params map[string]any) types.BlockchainContext {
 		objectContract: make(map[core.ObjectID]core.Address),
 		gasLimit:       10000000,
 	}
+	if balances, ok := params["balances"].(map[core.Address]uint64); ok {
+		for addr, balance := range balances {
+			ctx.balances[addr] = balance
+		}
+	}
+	return ctx
 }
 
 func (ctx *defaultBlockchainContext) SetBlockInfo(height uint64, time int64, hash core.Hash) error {
@@ -63,7 +84,7 @@ func (ctx *defaultBlockchainContext) SetTransactionInfo(hash core.Hash, from typ
 	ctx.txHash = hash
 	ctx.sender = from
 	ctx.contractAddr = to
-	// ctx.value = value
+	ctx.value = value
 	return nil
 }
 
@@ -95,7 +116,7 @@ func (ctx *defaultBlockchainContext) ContractAddress() types.Address {
 
 // TransactionHash gets the current transaction hash
 func (ctx *defaultBlockchainContext) TransactionHash() core.Hash {
-	return core.Hash{} // Simplified implementation
+	return ctx.txHash
 }
 
 // Sender gets the transaction sender
@@ -103,6 +124,11 @@ func (ctx *defaultBlockchainContext) Sender() types.Address {
 	return ctx.sender
 }
 
+// Value gets the value attached to the transaction
+func (ctx *defaultBlockchainContext) Value() uint64 {
+	return ctx.value
+}
+
 // Balance gets the account balance
 func (ctx *defaultBlockchainContext) Balance(addr types.Address) uint64 {
 	ctx.mu.Lock()
@@ -129,6 +155,8 @@ func (ctx *defaultBlockchainContext) Transfer(contract types.Address, from, to t
 	}
 
 	// Execute transfer
+	ctx.recordBalance(from)
+	ctx.recordBalance(to)
 	ctx.balances[from] -= amount
 	ctx.balances[to] += amount
 	return nil
@@ -142,9 +170,11 @@ func (ctx *defaultBlockchainContext) CreateObject(contract types.Address) (types
 	id := ctx.generateObjectID(contract, ctx.sender)
 
 	// Create object storage
+	ctx.recordObject(id)
 	ctx.objects[id] = make(map[string][]byte)
 	ctx.objectOwner[id] = contract
 	ctx.objectContract[id] = contract
+	ctx.touchObject(id)
 
 	// Return object wrapper
 	return &vmObject{
@@ -160,9 +190,11 @@ func (ctx *defaultBlockchainContext) CreateObjectWithID(contract types.Address,
 	ctx.mu.Lock()
 	defer ctx.mu.Unlock()
 	// Create object storage
+	ctx.recordObject(id)
 	ctx.objects[id] = make(map[string][]byte)
 	ctx.objectOwner[id] = contract
 	ctx.objectContract[id] = contract
+	ctx.touchObject(id)
 
 	// Return object wrapper
 	return &vmObject{
@@ -175,6 +207,8 @@ func (ctx *defaultBlockchainContext) CreateObjectWithID(contract types.Address,
 
 // generateObjectID generates a new object ID
 func (ctx *defaultBlockchainContext) generateObjectID(contract types.Address, sender types.Address) core.ObjectID {
+	nonce := ctx.nonce
+	ctx.journal = append(ctx.journal, func() { ctx.nonce = nonce })
 	ctx.nonce++
 	hash := sha256.Sum256([]byte(fmt.Sprintf("%s-%s-%s-%d", contract, sender, ctx.txHash, ctx.nonce)))
 	var id core.ObjectID
@@ -220,15 +254,46 @@ func (ctx *defaultBlockchainContext) GetObjectWithOwner(contract, owner types.Ad
 func (ctx *defaultBlockchainContext) DeleteObject(contract types.Address, id core.ObjectID) error {
 	ctx.mu.Lock()
 	defer ctx.mu.Unlock()
+	ctx.recordObject(id)
 	delete(ctx.objects, id)
 	delete(ctx.objectOwner, id)
 	delete(ctx.objectContract, id)
 	return nil
 }
 
+// DeleteContractObjects deletes every object of contract, in the order of their IDs
+func (ctx *defaultBlockchainContext) DeleteContractObjects(contract types.Address) ([]core.ObjectID, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	var ids []core.ObjectID
+	for id, objContract := range ctx.objectContract {
+		if objContract == contract {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(a, b core.ObjectID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	for _, id := range ids {
+		ctx.recordObject(id)
+		delete(ctx.objects, id)
+		delete(ctx.objectOwner, id)
+		delete(ctx.objectContract, id)
+	}
+	return ids, nil
+}
+
 // Call cross-contract call
 func (ctx *defaultBlockchainContext) Call(caller types.Address, contract types.Address, function string, args ...any) ([]byte, error) {
-	return nil, errors.New("not implemented")
+	if ctx.callHandler == nil {
+		return nil, errors.New("call handler not set")
+	}
+	return ctx.callHandler(ctx, caller, contract, function, args...)
+}
+
+// SetCallHandler sets the handler that executes cross-contract calls
+func (ctx *defaultBlockchainContext) SetCallHandler(handler types.CallHandler) {
+	ctx.callHandler = handler
 }
 
 // Log records events
@@ -241,10 +306,200 @@ func (ctx *defaultBlockchainContext) Log(contract types.Address, eventName strin
 	slog.Info("Contract log", params...)
 }
 
+// StateRoot returns the Merkle root over all balances, objects and fields
+func (ctx *defaultBlockchainContext) StateRoot() (core.Hash, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	tree, err := ctx.stateTree.Tree(stateSource{ctx})
+	if err != nil {
+		return core.Hash{}, err
+	}
+	return tree.Root(), nil
+}
+
+// Prove returns the inclusion proof of an object field, or of the object itself if field is empty
+func (ctx *defaultBlockchainContext) Prove(contract core.Address, id core.ObjectID, field string) (*state.Proof, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	tree, err := ctx.stateTree.Tree(stateSource{ctx})
+	if err != nil {
+		return nil, err
+	}
+	return tree.Prove(state.FieldKey(contract, id, field))
+}
+
+// ProveBalance returns the inclusion proof of an account balance
+func (ctx *defaultBlockchainContext) ProveBalance(addr core.Address) (*state.Proof, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	tree, err := ctx.stateTree.Tree(stateSource{ctx})
+	if err != nil {
+		return nil, err
+	}
+	return tree.Prove(state.BalanceLeaf(addr, 0).Key)
+}
+
+// StateLeaves returns every non-zero balance, object and field in the context
+func (ctx *defaultBlockchainContext) StateLeaves() ([]types.StateLeaf, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return stateSource{ctx}.StateLeaves()
+}
+
+// stateSource implements state.Source, the caller holds the lock of the context
+type stateSource struct {
+	ctx *defaultBlockchainContext
+}
+
+func (s stateSource) StateLeaves() ([]types.StateLeaf, error) {
+	var leaves []types.StateLeaf
+	for addr := range s.ctx.balances {
+		balance, _ := s.BalanceLeaves(addr)
+		leaves = append(leaves, balance...)
+	}
+	for id, contract := range s.ctx.objectContract {
+		object, _ := s.ObjectLeaves(contract, id)
+		leaves = append(leaves, object...)
+	}
+	return leaves, nil
+}
+
+func (s stateSource) BalanceLeaves(addr core.Address) ([]types.StateLeaf, error) {
+	amount := s.ctx.balances[addr]
+	if amount == 0 {
+		return nil, nil
+	}
+	return []types.StateLeaf{state.BalanceLeaf(addr, amount)}, nil
+}
+
+func (s stateSource) ObjectLeaves(contract core.Address, id core.ObjectID) ([]types.StateLeaf, error) {
+	if objContract, ok := s.ctx.objectContract[id]; !ok || objContract != contract {
+		return nil, nil
+	}
+	leaves := []types.StateLeaf{state.ObjectLeaf(contract, id, s.ctx.objectOwner[id])}
+	for field, value := range s.ctx.objects[id] {
+		leaves = append(leaves, state.FieldLeaf(contract, id, field, value))
+	}
+	return leaves, nil
+}
+
+// Snapshot returns an identifier for the current state that can be passed to RevertToSnapshot
+func (ctx *defaultBlockchainContext) Snapshot() int {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return len(ctx.journal)
+}
+
+// RevertToSnapshot undoes all state changes made after the given snapshot
+func (ctx *defaultBlockchainContext) RevertToSnapshot(id int) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if id < 0 || id > len(ctx.journal) {
+		return fmt.Errorf("invalid snapshot id: %d", id)
+	}
+	for i := len(ctx.journal) - 1; i >= id; i-- {
+		ctx.journal[i]()
+	}
+	ctx.journal = ctx.journal[:id]
+	return nil
+}
+
+// CommitSnapshot keeps the state changes made after the given snapshot and drops their undo operations
+func (ctx *defaultBlockchainContext) CommitSnapshot(id int) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if id < 0 || id > len(ctx.journal) {
+		return fmt.Errorf("invalid snapshot id: %d", id)
+	}
+	clear(ctx.journal[id:])
+	ctx.journal = ctx.journal[:id]
+	return nil
+}
+
+// DryRun implements types.DryRunner, fn runs on a copy of the state
+func (ctx *defaultBlockchainContext) DryRun(fn func(ctx types.BlockchainContext) error) error {
+	ctx.mu.Lock()
+	dry := &defaultBlockchainContext{
+		blockHeight:    ctx.blockHeight,
+		blockTime:      ctx.blockTime,
+		balances:       maps.Clone(ctx.balances),
+		objects:        make(map[core.ObjectID]map[string][]byte, len(ctx.objects)),
+		objectOwner:    maps.Clone(ctx.objectOwner),
+		objectContract: maps.Clone(ctx.objectContract),
+		contractAddr:   ctx.contractAddr,
+		sender:         ctx.sender,
+		value:          ctx.value,
+		txHash:         ctx.txHash,
+		nonce:          ctx.nonce,
+		gasLimit:       ctx.gasLimit,
+		callHandler:    ctx.callHandler,
+	}
+	// Fields are set in place
+	for id, fields := range ctx.objects {
+		dry.objects[id] = maps.Clone(fields)
+	}
+	ctx.mu.Unlock()
+	return fn(dry)
+}
+
+// recordBalance adds an undo operation restoring the current balance of addr
+func (ctx *defaultBlockchainContext) recordBalance(addr types.Address) {
+	balance, exists := ctx.balances[addr]
+	ctx.stateTree.TouchBalance(addr)
+	ctx.journal = append(ctx.journal, func() {
+		ctx.stateTree.TouchBalance(addr)
+		if exists {
+			ctx.balances[addr] = balance
+		} else {
+			delete(ctx.balances, addr)
+		}
+	})
+}
+
+// recordObject adds an undo operation restoring the current state of object id
+func (ctx *defaultBlockchainContext) recordObject(id core.ObjectID) {
+	fields, exists := ctx.objects[id]
+	owner := ctx.objectOwner[id]
+	contract := ctx.objectContract[id]
+	ctx.touchObject(id)
+	ctx.journal = append(ctx.journal, func() {
+		ctx.touchObject(id)
+		if !exists {
+			delete(ctx.objects, id)
+			delete(ctx.objectOwner, id)
+			delete(ctx.objectContract, id)
+			return
+		}
+		ctx.objects[id] = fields
+		ctx.objectOwner[id] = owner
+		ctx.objectContract[id] = contract
+		ctx.touchObject(id)
+	})
+}
+
+// touchObject marks object id as changed in the state tree, under the contract it currently belongs to
+func (ctx *defaultBlockchainContext) touchObject(id core.ObjectID) {
+	if contract, ok := ctx.objectContract[id]; ok {
+		ctx.stateTree.TouchObject(contract, id)
+	}
+}
+
 func (ctx *defaultBlockchainContext) setObjectField(id core.ObjectID, field string, value []byte) {
 	obj, exists := ctx.objects[id]
 	if !exists {
 		obj = make(map[string][]byte)
+		ctx.recordObject(id)
+	} else {
+		old, ok := obj[field]
+		ctx.touchObject(id)
+		ctx.journal = append(ctx.journal, func() {
+			ctx.touchObject(id)
+			if ok {
+				obj[field] = old
+			} else {
+				delete(obj, field)
+			}
+		})
 	}
 	obj[field] = value
 	ctx.objects[id] = obj
@@ -291,6 +546,13 @@ func (o *vmObject) SetOwner(contract, sender types.Address, addr types.Address)
 	if sender != o.objOwner && contract != o.objOwner {
 		return fmt.Errorf("not owner")
 	}
+	owner, objOwner := o.ctx.objectOwner[o.id], o.objOwner
+	o.ctx.touchObject(o.id)
+	o.ctx.journal = append(o.ctx.journal, func() {
+		o.ctx.touchObject(o.id)
+		o.ctx.objectOwner[o.id] = owner
+		o.objOwner = objOwner
+	})
 	o.objOwner = addr
 	o.ctx.objectOwner[o.id] = addr
 	return nil
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
 	"github.com/govm-net/vm/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -158,3 +159,211 @@ func TestObjectOwnership(t *testing.T) {
 	err = obj.SetOwner(contract, unauthorized, sender)
 	assert.Error(t, err)
 }
+
+func TestSnapshotRevert(t *testing.T) {
+	ctx := setupTestContext()
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0)
+	ctx.balances[sender] = 1000
+
+	// Prepare state that exists before the snapshot
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("before")))
+
+	snapshot := ctx.Snapshot()
+
+	// Modify balances, fields, owners and objects after the snapshot
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 400))
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("after")))
+	require.NoError(t, obj.Set(contract, sender, "extra", []byte("new")))
+	require.NoError(t, obj.SetOwner(contract, sender, sender))
+	created, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, ctx.DeleteObject(contract, obj.ID()))
+
+	// Revert and verify the original state is restored
+	require.NoError(t, ctx.RevertToSnapshot(snapshot))
+
+	assert.Equal(t, uint64(1000), ctx.Balance(sender))
+	assert.Equal(t, uint64(0), ctx.Balance(contract))
+	// The object that was changed reports its original owner too
+	assert.Equal(t, contract, obj.Owner())
+
+	restored, err := ctx.GetObject(contract, obj.ID())
+	require.NoError(t, err)
+	assert.Equal(t, contract, restored.Owner())
+	value, err := restored.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), value)
+	_, err = restored.Get(contract, "extra")
+	assert.Error(t, err)
+
+	_, err = ctx.GetObject(contract, created.ID())
+	assert.Error(t, err)
+
+	// Object IDs generated after a revert are the same as before it
+	again, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID(), again.ID())
+
+	// Invalid snapshot ids are rejected
+	assert.Error(t, ctx.RevertToSnapshot(-1))
+	assert.Error(t, ctx.RevertToSnapshot(ctx.Snapshot()+1))
+}
+
+func TestCommitSnapshot(t *testing.T) {
+	ctx := setupTestContext()
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0)
+
+	snapshot := ctx.Snapshot()
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	nested := ctx.Snapshot()
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("kept")))
+
+	// Committing a nested snapshot keeps the changes, the outer snapshot can still revert them
+	require.NoError(t, ctx.CommitSnapshot(nested))
+	assert.Equal(t, nested, ctx.Snapshot())
+
+	// Committing the outermost snapshot drops the journal
+	require.NoError(t, ctx.CommitSnapshot(snapshot))
+	assert.Empty(t, ctx.journal)
+	value, err := obj.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("kept"), value)
+
+	assert.Error(t, ctx.CommitSnapshot(-1))
+	assert.Error(t, ctx.CommitSnapshot(ctx.Snapshot()+1))
+}
+
+func TestStateRoot(t *testing.T) {
+	ctx := setupTestContext()
+	ctx.balances[core.Address{0x02}] = 1000
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x03}, core.Address{0x02}, core.Address{0x01}, 0))
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	check := func(step string) {
+		root, err := ctx.StateRoot()
+		require.NoError(t, err)
+		leaves, err := ctx.StateLeaves()
+		require.NoError(t, err)
+		assert.Equal(t, state.Root(leaves), root, step)
+		proof, err := ctx.ProveBalance(sender)
+		require.NoError(t, err)
+		assert.True(t, state.VerifyProof(root, state.BalanceLeaf(sender, ctx.Balance(sender)), proof), step)
+	}
+	check("initial state")
+
+	// 每次计算根之后只更新变化的叶子
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 100))
+	check("transfer")
+	obj, err := ctx.CreateObjectWithID(contract, core.ObjectID{0x20})
+	require.NoError(t, err)
+	check("create object")
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("1")))
+	check("set field")
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("2")))
+	check("change field")
+	require.NoError(t, obj.SetOwner(contract, contract, sender))
+	check("set owner")
+
+	// 在计算根之后回滚的修改也会更新树
+	snapshot := ctx.Snapshot()
+	require.NoError(t, ctx.Transfer(contract, sender, contract, 100))
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("3")))
+	_, err = ctx.CreateObjectWithID(contract, core.ObjectID{0x21})
+	require.NoError(t, err)
+	require.NoError(t, ctx.DeleteObject(contract, obj.ID()))
+	check("before revert")
+	require.NoError(t, ctx.RevertToSnapshot(snapshot))
+	check("revert")
+
+	// 试运行的修改不影响树
+	require.NoError(t, ctx.DryRun(func(dry types.BlockchainContext) error {
+		return dry.Transfer(contract, sender, contract, 100)
+	}))
+	check("dry run")
+
+	_, err = ctx.DeleteContractObjects(contract)
+	require.NoError(t, err)
+	check("delete contract objects")
+	_, err = ctx.CreateObjectWithID(core.Address{0x03}, core.ObjectID{0x20})
+	require.NoError(t, err)
+	check("create deleted object again")
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := setupTestContext()
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	ctx.SetTransactionInfo(core.Hash{0x03}, sender, contract, 0)
+	ctx.balances[sender] = 1000
+	obj, err := ctx.CreateObject(contract)
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, sender, "name", []byte("before")))
+	before, err := ctx.StateLeaves()
+	require.NoError(t, err)
+
+	// Changes made in the dry run are seen by it only
+	err = ctx.DryRun(func(dry types.BlockchainContext) error {
+		require.NoError(t, dry.Transfer(contract, sender, contract, 400))
+		dryObj, err := dry.GetObject(contract, obj.ID())
+		require.NoError(t, err)
+		require.NoError(t, dryObj.Set(contract, sender, "name", []byte("after")))
+		_, err = dry.CreateObject(contract)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(600), dry.Balance(sender))
+		return nil
+	})
+	require.NoError(t, err)
+
+	after, err := ctx.StateLeaves()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, before, after)
+	assert.Equal(t, uint64(1000), ctx.Balance(sender))
+	value, err := obj.Get(contract, "name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), value)
+}
+
+func TestCallHandler(t *testing.T) {
+	ctx := setupTestContext()
+
+	caller := core.Address{0x01}
+	contract := core.Address{0x02}
+
+	// Calls fail until an engine installs a handler
+	_, err := ctx.Call(caller, contract, "Get")
+	assert.Error(t, err)
+
+	ctx.SetCallHandler(func(c types.BlockchainContext, from, to types.Address, function string, args ...any) ([]byte, error) {
+		assert.Equal(t, ctx, c)
+		assert.Equal(t, caller, from)
+		assert.Equal(t, contract, to)
+		assert.Equal(t, "Get", function)
+		assert.Equal(t, []any{"key"}, args)
+		return []byte(`"value"`), nil
+	})
+	result, err := ctx.Call(caller, contract, "Get", "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`"value"`), result)
+}
+
+func TestInitialBalancesAndValue(t *testing.T) {
+	addr := core.AddressFromString("0x1111")
+	ctx := NewBlockchainContext(map[string]any{
+		"balances": map[core.Address]uint64{addr: 1000},
+	})
+	assert.Equal(t, uint64(1000), ctx.Balance(addr))
+
+	require.NoError(t, ctx.SetTransactionInfo(core.Hash{}, addr, core.ZeroAddress, 300))
+	assert.Equal(t, uint64(300), ctx.Value())
+}
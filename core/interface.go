@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/govm-net/vm/types"
@@ -85,6 +86,21 @@ func Error(msg string) error {
 
 var ctx types.Context
 
+// debug enables Debug output, it is set by the VM for each call
+var debug bool
+
+// SetDebug enables or disables Debug output
+func SetDebug(enabled bool) {
+	debug = enabled
+}
+
+// Debug prints diagnostics to the execution trace when the VM runs in debug mode, and does nothing otherwise
+func Debug(args ...any) {
+	if debug {
+		fmt.Println(args...)
+	}
+}
+
 func SetContext(c types.Context) {
 	if ctx != nil {
 		panic("context already set")
@@ -108,6 +124,12 @@ func Sender() Address {
 	return ctx.Sender()
 }
 
+// Value returns the value the sender paid to the contract with the current call.
+// It is transferred to the contract before the call runs, and refunded if the call fails.
+func Value() uint64 {
+	return ctx.Value()
+}
+
 func Balance(addr Address) uint64 {
 	return ctx.Balance(addr)
 }
@@ -143,6 +165,18 @@ func Call(contract Address, function string, args ...any) ([]byte, error) {
 	return ctx.Call(contract, function, args...)
 }
 
+// CallWithValue calls a function on another contract, paying value from this contract to the callee
+func CallWithValue(contract Address, function string, value uint64, args ...any) ([]byte, error) {
+	return ctx.CallWithValue(contract, function, value, args...)
+}
+
+// SelfDestruct destroys the current contract when the execution succeeds.
+// Its objects are deleted, its balance is sent to beneficiary, and its code is removed.
+// The address can't be called afterwards, and can't be deployed to again unless the engine allows it.
+func SelfDestruct(beneficiary Address) error {
+	return ctx.SelfDestruct(beneficiary)
+}
+
 // Logging and events
 func Log(eventName string, keyValues ...interface{}) {
 	ctx.Log(eventName, keyValues...)
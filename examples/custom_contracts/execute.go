@@ -44,7 +44,7 @@ func runExecute(contractAddr, funcName, argsJSON, sender, wasmDir string) error
 
 	ctx := engine.GetContext()
 	ctx.SetBlockInfo(1, 1, core.HashFromString("0x1234567890"))
-	ctx.SetTransactionInfo(core.HashFromString("0x1234567890ab"), core.AddressFromString(sender), core.AddressFromString(contractAddr), 1000)
+	ctx.SetTransactionInfo(core.HashFromString("0x1234567890ab"), core.AddressFromString(sender), core.AddressFromString(contractAddr), 0)
 
 	// 解析参数
 	var params []byte
@@ -122,6 +122,17 @@ func AddMockEnterExit(packageName string, code []byte) ([]byte, error) {
 
 // AddGasConsumption adds gas consumption tracking to the code
 func AddGasConsumption(packageName string, code []byte) ([]byte, error) {
+	return addGasConsumption(packageName, "vm_cover_atomic_", code)
+}
+
+// AddFileGasConsumption adds gas consumption tracking to one file of a contract package.
+// Each file of the package must use a different file number, so their counters don't collide.
+func AddFileGasConsumption(packageName string, file int, code []byte) ([]byte, error) {
+	return addGasConsumption(packageName, fmt.Sprintf("vm_cover_atomic_%d_", file), code)
+}
+
+// addGasConsumption adds gas consumption tracking to the code, using varName for the counters of go tool cover
+func addGasConsumption(packageName, varName string, code []byte) ([]byte, error) {
 	// Create temporary directory for cover files
 	tmpDir, err := os.MkdirTemp("", "cover-*")
 	if err != nil {
@@ -137,7 +148,7 @@ func AddGasConsumption(packageName string, code []byte) ([]byte, error) {
 
 	// Generate coverage code using go tool cover
 	coverFile := filepath.Join(tmpDir, "source_cover.go")
-	cmd := exec.Command("go", "tool", "cover", "-mode=atomic", "-var=vm_cover_atomic_", "-o", coverFile, srcFile)
+	cmd := exec.Command("go", "tool", "cover", "-mode=atomic", "-var="+varName, "-o", coverFile, srcFile)
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("failed to generate cover code: %w", err)
 	}
@@ -157,8 +168,8 @@ func AddGasConsumption(packageName string, code []byte) ([]byte, error) {
 
 	// Replace coverage statements with gas consumption using regex
 	codeStr := string(coverCode)
-	re := regexp.MustCompile(`_cover_atomic_\.AddUint32\(&vm_cover_atomic_\.Count\[(\d+)\],\s*1\)`)
-	codeStr = re.ReplaceAllString(codeStr, fmt.Sprintf("%s.%s(int64(vm_cover_atomic_.NumStmt[$1]))", GasPackageName, GasConsumeGasFunc))
+	re := regexp.MustCompile(`_cover_atomic_\.AddUint32\(&` + regexp.QuoteMeta(varName) + `\.Count\[(\d+)\],\s*1\)`)
+	codeStr = re.ReplaceAllString(codeStr, fmt.Sprintf("%s.%s(int64(%s.NumStmt[$1]))", GasPackageName, GasConsumeGasFunc, varName))
 
 	codeStr = strings.ReplaceAll(codeStr, "import _cover_atomic_ \"sync/atomic\"", importStmt)
 	codeStr = strings.ReplaceAll(codeStr, "var _ = _cover_atomic_.LoadUint32", "")
@@ -0,0 +1,355 @@
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// Context is the core context of native contracts, every call is served from the call being executed.
+// Values cross the boundary as JSON like they do between WASM contracts and the host.
+type Context struct{}
+
+var _ types.Context = &Context{}
+
+// Object is a state object seen by a native contract
+type Object struct {
+	id core.ObjectID
+}
+
+var _ types.Object = &Object{}
+
+// objectID returns the object a request refers to, the zero id is the default object of the contract
+func objectID(contract core.Address, id core.ObjectID) core.ObjectID {
+	if id == (core.ObjectID{}) {
+		copy(id[:], contract[:])
+	}
+	return id
+}
+
+// roundTrip returns v as the host would see it after decoding it from JSON
+func roundTrip(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Context) Sender() core.Address {
+	f := top()
+	f.gas.consume(10)
+	return f.ctx.Sender()
+}
+
+func (c *Context) Value() uint64 {
+	f := top()
+	f.gas.consume(10)
+	return f.ctx.Value()
+}
+
+func (c *Context) BlockHeight() uint64 {
+	f := top()
+	f.gas.consume(10)
+	return f.ctx.BlockHeight()
+}
+
+func (c *Context) BlockTime() int64 {
+	f := top()
+	f.gas.consume(10)
+	return f.ctx.BlockTime()
+}
+
+func (c *Context) ContractAddress() core.Address {
+	f := top()
+	f.gas.consume(10)
+	return f.contract
+}
+
+func (c *Context) Balance(addr core.Address) uint64 {
+	f := top()
+	f.gas.consume(50)
+	return f.ctx.Balance(addr)
+}
+
+func (c *Context) Transfer(from, to core.Address, amount uint64) error {
+	f := top()
+	f.gas.consume(500)
+	if err := checkWrite(f); err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
+	if err := f.ctx.Transfer(f.contract, from, to, amount); err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
+	return nil
+}
+
+// Call calls a function on another contract, the callee is charged to this call
+func (c *Context) Call(contract core.Address, function string, args ...any) ([]byte, error) {
+	return c.CallWithValue(contract, function, 0, args...)
+}
+
+// CallWithValue calls a function on another contract, paying value from this contract to the callee
+func (c *Context) CallWithValue(contract core.Address, function string, value uint64, args ...any) ([]byte, error) {
+	f := top()
+	f.gas.consume(10000)
+	callArgs := make([]any, len(args))
+	for i, arg := range args {
+		v, err := roundTrip(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize call data: %w", err)
+		}
+		callArgs[i] = v
+	}
+
+	gasLimit := f.gas.remaining
+	f.ctx.SetGasLimit(gasLimit)
+	var result []byte
+	var err error
+	if value == 0 {
+		result, err = f.ctx.Call(f.contract, contract, function, callArgs...)
+	} else if caller, ok := f.ctx.(types.ValueCaller); ok {
+		result, err = caller.CallWithValue(f.contract, contract, function, value, callArgs...)
+	} else {
+		err = errors.New("context does not support calls with value")
+	}
+	f.gas.consume(gasLimit - f.ctx.GetGas())
+	if err != nil {
+		return nil, fmt.Errorf("contract call failed: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Context) CreateObject() core.Object {
+	f := top()
+	f.gas.consume(500)
+	if err := checkWrite(f); err != nil {
+		panic(fmt.Sprintf("failed to create object: %v", err))
+	}
+	obj, err := f.ctx.CreateObject(f.contract)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create object: %v", err))
+	}
+	return &Object{id: obj.ID()}
+}
+
+func (c *Context) GetObject(id core.ObjectID) (core.Object, error) {
+	f := top()
+	f.gas.consume(50)
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	if obj.Contract() != f.contract {
+		return nil, fmt.Errorf("failed to get object: object belongs to another contract")
+	}
+	return &Object{id: id}, nil
+}
+
+func (c *Context) GetObjectWithOwner(owner core.Address) (core.Object, error) {
+	f := top()
+	f.gas.consume(50)
+	obj, err := f.ctx.GetObjectWithOwner(f.contract, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	return &Object{id: obj.ID()}, nil
+}
+
+func (c *Context) DeleteObject(id core.ObjectID) {
+	f := top()
+	f.gas.consume(500)
+	if err := checkWrite(f); err != nil {
+		panic(fmt.Sprintf("failed to delete object: %v", err))
+	}
+	if err := f.ctx.DeleteObject(f.contract, objectID(f.contract, id)); err != nil {
+		panic(fmt.Sprintf("failed to delete object: %v", err))
+	}
+	f.gas.refund(800)
+}
+
+func (c *Context) Log(eventName string, keyValues ...any) {
+	f := top()
+	f.gas.consume(100)
+	data, err := json.Marshal(types.LogParams{Contract: f.contract, Event: eventName, KeyValues: keyValues})
+	if err != nil {
+		panic(fmt.Sprintf("failed to serialize log request: %v", err))
+	}
+	f.gas.consume(int64(len(data)))
+	if checkWrite(f) != nil {
+		return
+	}
+	var params types.LogParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		panic(fmt.Sprintf("failed to serialize log request: %v", err))
+	}
+	f.ctx.Log(f.contract, eventName, params.KeyValues...)
+}
+
+// SelfDestruct destroys the contract when the execution succeeds, sending its balance to beneficiary
+func (c *Context) SelfDestruct(beneficiary core.Address) error {
+	f := top()
+	f.gas.consume(5000)
+	if err := checkWrite(f); err != nil {
+		return fmt.Errorf("self-destruct failed: %w", err)
+	}
+	destructor, ok := f.ctx.(types.SelfDestructor)
+	if !ok {
+		return errors.New("self-destruct failed: context does not support self-destruct")
+	}
+	if err := destructor.SelfDestruct(f.contract, beneficiary); err != nil {
+		return fmt.Errorf("self-destruct failed: %w", err)
+	}
+	return nil
+}
+
+func (o *Object) ID() core.ObjectID {
+	top().gas.consume(10)
+	return o.id
+}
+
+func (o *Object) Owner() core.Address {
+	f := top()
+	f.gas.consume(100)
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, o.id))
+	if err != nil {
+		return core.ZeroAddress
+	}
+	return obj.Owner()
+}
+
+func (o *Object) Contract() core.Address {
+	f := top()
+	f.gas.consume(100)
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, o.id))
+	if err != nil {
+		return core.ZeroAddress
+	}
+	return obj.Contract()
+}
+
+func (o *Object) SetOwner(owner core.Address) {
+	f := top()
+	f.gas.consume(500)
+	if err := checkWrite(f); err != nil {
+		panic(fmt.Sprintf("set owner failed: %v", err))
+	}
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, o.id))
+	if err != nil {
+		panic(fmt.Sprintf("set owner failed: %v", err))
+	}
+	if obj.Owner() != f.contract {
+		panic("set owner failed: object is not owned by the contract")
+	}
+	if err := obj.SetOwner(f.contract, f.ctx.Sender(), owner); err != nil {
+		panic(fmt.Sprintf("set owner failed: %v", err))
+	}
+}
+
+func (o *Object) Get(field string, value any) error {
+	f := top()
+	f.gas.consume(100)
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, o.id))
+	if err != nil {
+		return fmt.Errorf("get field failed: %w", err)
+	}
+	data, err := obj.Get(f.contract, field)
+	if err != nil {
+		return fmt.Errorf("get field failed: %w", err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("field not found")
+	}
+	f.gas.consume(int64(len(data)))
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("failed to unmarshal to target type, field: %s, value: %s, err: %w", field, data, err)
+	}
+	return nil
+}
+
+func (o *Object) Set(field string, value any) error {
+	f := top()
+	f.gas.consume(1000)
+	request, err := json.Marshal(types.SetObjectFieldParams{Contract: f.contract, ID: o.id, Field: field, Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to serialize data: %w", err)
+	}
+	f.gas.consume(int64(len(request)) * 100)
+	if err := checkWrite(f); err != nil {
+		return fmt.Errorf("set field failed: %w", err)
+	}
+
+	// The host stores the value re-encoded from its decoded JSON
+	v, err := roundTrip(value)
+	if err != nil {
+		return fmt.Errorf("failed to serialize data: %w", err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to serialize data: %w", err)
+	}
+	obj, err := f.ctx.GetObject(f.contract, objectID(f.contract, o.id))
+	if err != nil {
+		return fmt.Errorf("set field failed: %w", err)
+	}
+	if obj.Owner() != f.contract {
+		return fmt.Errorf("set field failed: object is not owned by the contract")
+	}
+	if err := obj.Set(f.contract, f.ctx.Sender(), field, data); err != nil {
+		return fmt.Errorf("set field failed: %w", err)
+	}
+	return nil
+}
+
+// checkWrite rejects state changes when the context forbids them, see types.WriteChecker
+func checkWrite(f *frame) error {
+	if checker, ok := f.ctx.(types.WriteChecker); ok {
+		return checker.CheckWrite()
+	}
+	return nil
+}
+
+// gasMeter charges the same fixed costs as the contract wrapper of the WASM path
+type gasMeter struct {
+	remaining int64
+	used      int64
+}
+
+// defaultGas is the gas of calls without a limit, as in the mock package used by WASM contracts
+const defaultGas = 10000
+
+func newGasMeter(limit int64) *gasMeter {
+	if limit <= 0 {
+		limit = defaultGas
+	}
+	return &gasMeter{remaining: limit}
+}
+
+func (g *gasMeter) consume(amount int64) {
+	if amount <= 0 {
+		return
+	}
+	if g.remaining < amount {
+		panic(fmt.Sprintf("out of gas: gas=%d, need=%d", g.remaining, amount))
+	}
+	g.remaining -= amount
+	g.used += amount
+}
+
+func (g *gasMeter) refund(amount int64) {
+	if g.used < amount {
+		panic(fmt.Sprintf("invalid refund: used=%d, refund=%d", g.used, amount))
+	}
+	g.remaining += amount
+	g.used -= amount
+}
@@ -0,0 +1,292 @@
+// Package native runs contracts linked into the host process instead of compiled to WebAssembly.
+//
+// A contract package is plain Go against the core package, so it can be compiled into the node or a test
+// together with the handlers generated by abi.GenerateNativeHandlerFile. The runtime dispatches calls to
+// those handlers and serves the core API from the BlockchainContext of the execution, with the same checks,
+// JSON encoding and gas costs as the host functions of the WASM path. This makes it possible to set
+// breakpoints in contracts, get Go stack traces and skip the tinygo build while iterating on a contract.
+//
+// The core package holds a single context for the whole process, so one call tree is executed at a time:
+// the outermost call holds the core context until it returns, and concurrent calls wait for it.
+// The calls of a tree are told apart by their context.Context, nested calls must pass the one of
+// the outermost call and other call trees their own.
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"runtime/debug"
+	"sync"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// Handler executes a contract function with JSON encoded named parameters, as generated by abi.HandlerGenerator.
+// It is an alias so the handler map of generated code needs no conversion.
+type Handler = func(params []byte) (any, error)
+
+// ErrContractNotFound is returned when executing a contract that was not deployed to the runtime
+var ErrContractNotFound = errors.New("native contract not found")
+
+// Runtime executes native contracts
+type Runtime struct {
+	mu        sync.RWMutex
+	contracts map[core.Address]map[string]Handler
+	codes     map[core.Address][]byte // source of contracts deployed from code
+
+	// Calls being executed, the last one is the current call.
+	// Only the call tree holding the core context changes it.
+	stack []*frame
+	tree  context.Context // context of the call tree being executed, guarded by mu
+
+	// Let contracts print core.Debug output
+	debug bool
+}
+
+// frame is one contract call executed by the runtime
+type frame struct {
+	ctx      types.BlockchainContext
+	contract core.Address
+	gas      *gasMeter
+}
+
+var setContextOnce sync.Once
+
+// NewRuntime creates a native runtime, and installs its context as the core context of the process
+func NewRuntime() *Runtime {
+	r := &Runtime{
+		contracts: make(map[core.Address]map[string]Handler),
+		codes:     make(map[core.Address][]byte),
+	}
+	setContextOnce.Do(func() {
+		core.SetContext(&Context{})
+	})
+	return r
+}
+
+// current is the runtime executing native calls, core calls are served from its top frame
+var current struct {
+	sync.Mutex
+	runtime *Runtime
+}
+
+// WithDebug enables or disables core.Debug output of contracts
+func (r *Runtime) WithDebug(enabled bool) *Runtime {
+	r.debug = enabled
+	return r
+}
+
+// Deploy registers the handlers of a contract and creates its default object, like deploying WASM code
+func (r *Runtime) Deploy(ctx types.BlockchainContext, contractAddr core.Address, handlers map[string]Handler) error {
+	if len(handlers) == 0 {
+		return errors.New("contract must have at least one handler")
+	}
+	var id core.ObjectID
+	copy(id[:], contractAddr[:])
+	if _, err := ctx.GetObject(contractAddr, id); err != nil {
+		if _, err := ctx.CreateObjectWithID(contractAddr, id); err != nil {
+			return fmt.Errorf("failed to create contract object: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.contracts[contractAddr] = handlers
+	return nil
+}
+
+// Has reports whether a contract is deployed to the runtime
+func (r *Runtime) Has(contractAddr core.Address) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.contracts[contractAddr]
+	return ok
+}
+
+// Delete removes a contract from the runtime
+func (r *Runtime) Delete(contractAddr core.Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.contracts, contractAddr)
+	delete(r.codes, contractAddr)
+}
+
+// registry holds the handlers of contract packages linked into the process, by package name
+var registry struct {
+	sync.RWMutex
+	packages map[string]map[string]Handler
+}
+
+// Register makes the handlers of a contract package available to DeployContractWithAddress,
+// so contracts deployed from the source of that package run natively.
+// It is usually called with the generated NativeHandlers of the package.
+func Register(packageName string, handlers map[string]Handler) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.packages == nil {
+		registry.packages = make(map[string]map[string]Handler)
+	}
+	registry.packages[packageName] = handlers
+}
+
+// lookup returns the registered handlers of the package of contract source code
+func lookup(code []byte) (map[string]Handler, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "contract.go", code, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse contract code: %w", err)
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	handlers, ok := registry.packages[file.Name.Name]
+	if !ok {
+		return nil, fmt.Errorf("contract package %s is not registered", file.Name.Name)
+	}
+	return handlers, nil
+}
+
+// DeployContractWithAddress deploys the contract of Go source code, its package must be registered with Register
+func (r *Runtime) DeployContractWithAddress(ctx types.BlockchainContext, code []byte, sender types.Address, contractAddr types.Address) (types.Address, error) {
+	handlers, err := lookup(code)
+	if err != nil {
+		return types.Address{}, err
+	}
+	if err := r.Deploy(ctx, contractAddr, handlers); err != nil {
+		return types.Address{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codes[contractAddr] = code
+	return contractAddr, nil
+}
+
+// UpgradeContract replaces the handlers of a deployed contract with those of the package of code
+func (r *Runtime) UpgradeContract(contractAddr types.Address, code []byte) error {
+	if !r.Has(contractAddr) {
+		return fmt.Errorf("%w: %x", ErrContractNotFound, contractAddr)
+	}
+	handlers, err := lookup(code)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.contracts[contractAddr] = handlers
+	r.codes[contractAddr] = code
+	return nil
+}
+
+// Code returns the source a contract was deployed or upgraded with.
+// Contracts deployed with Deploy have no source.
+func (r *Runtime) Code(contractAddr types.Address) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	code, ok := r.codes[contractAddr]
+	if !ok {
+		return nil, fmt.Errorf("%w: %x has no source", ErrContractNotFound, contractAddr)
+	}
+	return code, nil
+}
+
+// DeleteContract removes a contract from the runtime, its state objects are kept like in the WASM path
+func (r *Runtime) DeleteContract(ctx types.BlockchainContext, contractAddr types.Address) {
+	r.Delete(contractAddr)
+}
+
+// Close does nothing, native contracts hold no resources
+func (r *Runtime) Close() error {
+	return nil
+}
+
+// Execute executes a contract function and returns its result like the WASM path does:
+// errors and panics of the contract are reported as an unsuccessful result, and the data is JSON round-tripped.
+// A panic is also written to the execution trace with its Go stack trace.
+// runCtx identifies the call tree, nested calls pass the one of the outermost call, see the package documentation.
+func (r *Runtime) Execute(runCtx context.Context, ctx types.BlockchainContext, contractAddr core.Address, function string, params []byte) (*types.ExecutionResult, error) {
+	r.mu.RLock()
+	handlers, ok := r.contracts[contractAddr]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %x", ErrContractNotFound, contractAddr)
+	}
+	if runCtx != nil {
+		if err := runCtx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Nested calls run on the goroutine of the outermost call, which claims the core context for the whole tree
+	r.mu.RLock()
+	nested := runCtx != nil && runCtx == r.tree
+	r.mu.RUnlock()
+	if !nested {
+		current.Lock()
+		current.runtime = r
+		r.mu.Lock()
+		r.tree = runCtx
+		r.mu.Unlock()
+		defer func() {
+			r.mu.Lock()
+			r.tree = nil
+			r.mu.Unlock()
+			current.runtime = nil
+			current.Unlock()
+		}()
+	}
+	f := &frame{ctx: ctx, contract: contractAddr, gas: newGasMeter(ctx.GetGas())}
+	r.stack = append(r.stack, f)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+	core.SetDebug(r.debug)
+
+	result := &types.ExecutionResult{}
+	handler, ok := handlers[function]
+	if !ok {
+		result.Error = fmt.Sprintf("Function not found: %s", function)
+	} else {
+		data, err := r.invoke(f, handler, params)
+		if err != nil {
+			result.Error = fmt.Sprintf("Execution error: %v", err)
+		} else {
+			result.Success = true
+			result.Data = data
+		}
+	}
+	result.GasUsed = f.gas.used
+
+	// Same encoding as results returned from WASM
+	out, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize result: %w", err)
+	}
+	var runResult types.ExecutionResult
+	if err := json.Unmarshal(out, &runResult); err != nil {
+		return nil, fmt.Errorf("failed to deserialize: %w", err)
+	}
+	return &runResult, nil
+}
+
+// invoke calls a handler, turning a panic into an error
+func (r *Runtime) invoke(f *frame, handler Handler, params []byte) (data any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if recorder, ok := f.ctx.(types.OutputRecorder); ok {
+				recorder.RecordOutput(f.contract, []byte(fmt.Sprintf("panic: %v\n\n%s", p, debug.Stack())))
+			}
+			data, err = nil, fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(params)
+}
+
+// top returns the call being executed
+func top() *frame {
+	r := current.runtime
+	if r == nil || len(r.stack) == 0 {
+		panic("no native contract is executing")
+	}
+	return r.stack[len(r.stack)-1]
+}
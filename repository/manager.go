@@ -2,12 +2,16 @@ package repository
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/govm-net/vm/core"
@@ -27,13 +31,51 @@ type ContractCode struct {
 	Dependencies []string     // Dependencies on other contract addresses
 	UpdateTime   time.Time    // Last update time
 	Hash         [32]byte     // Code hash
+	Version      int          // Code version, starting at 1
+
+	// Files of contracts made of several files, by file name; nil for single file contracts, see RegisterFiles
+	Files         map[string][]byte // Original files
+	InjectedFiles map[string][]byte // Files after gas information injection
+}
+
+// InjectedSources returns the files of the contract after gas information injection, by file name.
+// Single file contracts have one file, contract.go.
+func (c *ContractCode) InjectedSources() map[string][]byte {
+	if c.InjectedFiles != nil {
+		return c.InjectedFiles
+	}
+	return map[string][]byte{"contract.go": c.InjectedCode}
+}
+
+// HashFiles returns the code hash of a contract made of several files
+func HashFiles(files map[string][]byte) [32]byte {
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		// Lengths keep the boundaries between names and files unambiguous
+		binary.Write(h, binary.BigEndian, uint64(len(name)))
+		h.Write([]byte(name))
+		binary.Write(h, binary.BigEndian, uint64(len(files[name])))
+		h.Write(files[name])
+	}
+	var hash [32]byte
+	h.Sum(hash[:0])
+	return hash
 }
 
 // ContractMetadata represents contract metadata
 type ContractMetadata struct {
-	Hash         string    `json:"hash"`         // Code hash
-	UpdateTime   time.Time `json:"update_time"`  // Update time
-	Dependencies []string  `json:"dependencies"` // Dependency list
+	Hash         string        `json:"hash"`               // Code hash
+	UpdateTime   time.Time     `json:"update_time"`        // Update time
+	Dependencies []string      `json:"dependencies"`       // Dependency list
+	Version      int           `json:"version,omitempty"`  // Active code version
+	Versions     []VersionInfo `json:"versions,omitempty"` // History of activated versions
+}
+
+// VersionInfo describes one version of a contract's code
+type VersionInfo struct {
+	Version    int       `json:"version"`
+	Hash       string    `json:"hash"`
+	UpdateTime time.Time `json:"update_time"`
 }
 
 // NewManager creates a new code manager
@@ -89,10 +131,70 @@ func (m *Manager) RegisterCode(address core.Address, code []byte) error {
 		InjectedCode: injectedCode,
 		UpdateTime:   time.Now(),
 		Hash:         hash,
+		Version:      1,
+	}
+
+	// Save code files
+	if err := m.saveVersionFiles(contractCode); err != nil {
+		os.RemoveAll(contractDir)
+		return fmt.Errorf("failed to save contract files: %w", err)
+	}
+	if err := m.saveContractFiles(contractCode, nil); err != nil {
+		// Delete created directory
+		os.RemoveAll(contractDir)
+		return fmt.Errorf("failed to save contract files: %w", err)
+	}
+
+	return nil
+}
+
+// RegisterFiles registers the code of a contract made of several files, by file name.
+// Each file gets its own gas information, and all files are kept with every version.
+// A contract with a single file is registered like RegisterCode.
+func (m *Manager) RegisterFiles(address core.Address, files map[string][]byte) error {
+	if len(files) == 0 {
+		return fmt.Errorf("contract has no files: %s", address)
+	}
+	if len(files) == 1 {
+		for _, code := range files {
+			return m.RegisterCode(address, code)
+		}
+	}
+
+	// Check if contract already exists
+	contractDir := m.getContractDir(address)
+	if _, err := os.Stat(contractDir); err == nil {
+		return fmt.Errorf("contract already exists: %s", address)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check contract directory: %w", err)
+	}
+
+	// Inject gas consumption code
+	injectedFiles, err := injectFiles(address, files)
+	if err != nil {
+		return err
+	}
+
+	// Create contract directory
+	if err := os.MkdirAll(contractDir, 0755); err != nil {
+		return fmt.Errorf("failed to create contract directory: %w", err)
+	}
+
+	contractCode := &ContractCode{
+		Address:       address,
+		UpdateTime:    time.Now(),
+		Hash:          HashFiles(files),
+		Version:       1,
+		Files:         files,
+		InjectedFiles: injectedFiles,
 	}
 
 	// Save code files
-	if err := m.saveContractFiles(contractCode); err != nil {
+	if err := m.saveVersionFiles(contractCode); err != nil {
+		os.RemoveAll(contractDir)
+		return fmt.Errorf("failed to save contract files: %w", err)
+	}
+	if err := m.saveContractFiles(contractCode, nil); err != nil {
 		// Delete created directory
 		os.RemoveAll(contractDir)
 		return fmt.Errorf("failed to save contract files: %w", err)
@@ -101,12 +203,215 @@ func (m *Manager) RegisterCode(address core.Address, code []byte) error {
 	return nil
 }
 
+// injectFiles injects gas consumption code into each file of a contract made of several files.
+// The file number keeps the counters of the files apart.
+func injectFiles(address core.Address, files map[string][]byte) (map[string][]byte, error) {
+	injectedFiles := make(map[string][]byte, len(files))
+	for i, name := range slices.Sorted(maps.Keys(files)) {
+		if name != filepath.Base(name) {
+			return nil, fmt.Errorf("invalid contract file name: %q", name)
+		}
+		injectedCode, err := mock.AddFileGasConsumption(address.String(), i, files[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to inject gas consumption into %s: %w", name, err)
+		}
+		injectedFiles[name] = injectedCode
+	}
+	return injectedFiles, nil
+}
+
+// PrepareUpgrade stores the files of new code for an existing contract as its next version, by file name,
+// without activating it. The returned code can be compiled and checked before ActivateVersion makes it current.
+// Like for RegisterFiles, code with a single file is stored as OriginalCode, so versions can switch between
+// single and multi-file code.
+// The version follows the highest one in the history, files left by an upgrade that was never activated are replaced.
+func (m *Manager) PrepareUpgrade(address core.Address, files map[string][]byte) (*ContractCode, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("contract has no files: %s", address)
+	}
+	current, err := m.loadContractCode(address)
+	if err != nil {
+		return nil, fmt.Errorf("contract does not exist: %s: %w", address, err)
+	}
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	// Contracts registered before versioning get the directory of their first version, so it can be activated again
+	if metadata.Version == 0 {
+		if err := m.saveVersionFiles(current); err != nil {
+			return nil, fmt.Errorf("failed to save contract version: %w", err)
+		}
+	}
+	version := 0
+	for _, v := range metadata.history() {
+		version = max(version, v.Version)
+	}
+
+	contractCode := &ContractCode{
+		Address:    address,
+		UpdateTime: time.Now(),
+		Version:    version + 1,
+	}
+	if len(files) == 1 {
+		for _, code := range files {
+			// Inject gas consumption code
+			injectedCode, err := mock.AddGasConsumption(address.String(), code)
+			if err != nil {
+				return nil, fmt.Errorf("failed to inject gas consumption: %w", err)
+			}
+			contractCode.OriginalCode = code
+			contractCode.InjectedCode = injectedCode
+			contractCode.Hash = sha256.Sum256(code)
+		}
+	} else {
+		injectedFiles, err := injectFiles(address, files)
+		if err != nil {
+			return nil, err
+		}
+		contractCode.Files = files
+		contractCode.InjectedFiles = injectedFiles
+		contractCode.Hash = HashFiles(files)
+	}
+	if err := m.saveVersionFiles(contractCode); err != nil {
+		return nil, fmt.Errorf("failed to save contract version: %w", err)
+	}
+	return contractCode, nil
+}
+
+// ActivateVersion makes a stored version the current code of a contract.
+// The switch is atomic, readers see either the old or the new version.
+func (m *Manager) ActivateVersion(address core.Address, version int) error {
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return err
+	}
+	code, err := m.GetCodeVersion(address, version)
+	if err != nil {
+		return err
+	}
+	code.UpdateTime = time.Now()
+	if err := m.saveContractFiles(code, metadata.history()); err != nil {
+		return fmt.Errorf("failed to activate version %d: %w", version, err)
+	}
+	return nil
+}
+
+// GetVersions returns the version history of a contract, oldest first
+func (m *Manager) GetVersions(address core.Address) ([]VersionInfo, error) {
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.history(), nil
+}
+
+// GetCodeVersion retrieves a specific version of contract code
+func (m *Manager) GetCodeVersion(address core.Address, version int) (*ContractCode, error) {
+	dir := m.getVersionDir(address, version)
+
+	// Contracts made of several files keep them in directories
+	if _, err := os.Stat(filepath.Join(dir, "sources")); err == nil {
+		return m.getFilesVersion(address, version)
+	}
+
+	originalCode, err := os.ReadFile(filepath.Join(dir, "original.go.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original code of version %d: %w", version, err)
+	}
+	injectedCode, err := os.ReadFile(filepath.Join(dir, "injected.go"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read injected code of version %d: %w", version, err)
+	}
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	// Versions that were never activated have no history entry
+	updateTime := metadata.UpdateTime
+	for _, v := range metadata.history() {
+		if v.Version == version {
+			updateTime = v.UpdateTime
+		}
+	}
+
+	return &ContractCode{
+		Address:      address,
+		OriginalCode: originalCode,
+		InjectedCode: injectedCode,
+		Dependencies: metadata.Dependencies,
+		UpdateTime:   updateTime,
+		Hash:         sha256.Sum256(originalCode),
+		Version:      version,
+	}, nil
+}
+
+// getFilesVersion retrieves a specific version of a contract made of several files
+func (m *Manager) getFilesVersion(address core.Address, version int) (*ContractCode, error) {
+	dir := m.getVersionDir(address, version)
+
+	files, err := readFiles(filepath.Join(dir, "sources"), ".txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original code of version %d: %w", version, err)
+	}
+	injectedFiles, err := readFiles(filepath.Join(dir, "injected"), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read injected code of version %d: %w", version, err)
+	}
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	updateTime := metadata.UpdateTime
+	for _, v := range metadata.history() {
+		if v.Version == version {
+			updateTime = v.UpdateTime
+		}
+	}
+
+	return &ContractCode{
+		Address:       address,
+		Dependencies:  metadata.Dependencies,
+		UpdateTime:    updateTime,
+		Hash:          HashFiles(files),
+		Version:       version,
+		Files:         files,
+		InjectedFiles: injectedFiles,
+	}, nil
+}
+
+// readFiles reads the files of a directory by name, without suffix
+func readFiles(dir, suffix string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimSuffix(entry.Name(), suffix)] = data
+	}
+	return files, nil
+}
+
 // GetCode retrieves contract code
 func (m *Manager) GetCode(address core.Address) (*ContractCode, error) {
 	return m.loadContractCode(address)
 }
 
-// GetInjectedCode retrieves code after gas information injection
+// DeleteCode removes the code of a contract with all its versions
+func (m *Manager) DeleteCode(address core.Address) error {
+	if err := os.RemoveAll(m.getContractDir(address)); err != nil {
+		return fmt.Errorf("failed to delete contract code: %w", err)
+	}
+	return nil
+}
+
+// GetInjectedCode retrieves code after gas information injection.
+// Contracts made of several files have no single injected file, see ContractCode.InjectedSources.
 func (m *Manager) GetInjectedCode(address core.Address) ([]byte, error) {
 	code, err := m.GetCode(address)
 	if err != nil {
@@ -120,25 +425,71 @@ func (m *Manager) getContractDir(address core.Address) string {
 	return filepath.Join(m.rootDir, address.String())
 }
 
-// saveContractFiles saves contract related files
-func (m *Manager) saveContractFiles(code *ContractCode) error {
-	dir := m.getContractDir(code.Address)
+// getVersionDir gets the directory holding one version of a contract's code
+func (m *Manager) getVersionDir(address core.Address, version int) string {
+	return filepath.Join(m.getContractDir(address), "versions", fmt.Sprint(version))
+}
 
-	// Save original code
+// saveVersionFiles saves the code of one contract version, replacing any files the directory already has
+func (m *Manager) saveVersionFiles(code *ContractCode) error {
+	dir := m.getVersionDir(code.Address, code.Version)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear version directory: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create version directory: %w", err)
+	}
+	if code.Files != nil {
+		return saveFiles(dir, code)
+	}
 	if err := os.WriteFile(filepath.Join(dir, "original.go.txt"), code.OriginalCode, 0644); err != nil {
 		return fmt.Errorf("failed to save original code: %w", err)
 	}
-
-	// Save code after gas injection
 	if err := os.WriteFile(filepath.Join(dir, "injected.go"), code.InjectedCode, 0644); err != nil {
 		return fmt.Errorf("failed to save injected code: %w", err)
 	}
+	return nil
+}
+
+// saveFiles saves the files of one version of a contract made of several files.
+// Original files get a .txt suffix like original.go.txt, so Go tools don't take them for code.
+func saveFiles(dir string, code *ContractCode) error {
+	for _, sub := range []string{"sources", "injected"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return fmt.Errorf("failed to create version directory: %w", err)
+		}
+	}
+	for name, data := range code.Files {
+		if err := os.WriteFile(filepath.Join(dir, "sources", name+".txt"), data, 0644); err != nil {
+			return fmt.Errorf("failed to save original code: %w", err)
+		}
+	}
+	for name, data := range code.InjectedFiles {
+		if err := os.WriteFile(filepath.Join(dir, "injected", name), data, 0644); err != nil {
+			return fmt.Errorf("failed to save injected code: %w", err)
+		}
+	}
+	return nil
+}
+
+// saveContractFiles makes code the current version of a contract.
+// Metadata is replaced atomically and decides which version is current, the code files
+// next to it are copies of the current version.
+func (m *Manager) saveContractFiles(code *ContractCode, history []VersionInfo) error {
+	dir := m.getContractDir(code.Address)
 
 	// Create metadata
+	hash := hex.EncodeToString(code.Hash[:])
 	metadata := ContractMetadata{
-		Hash:         hex.EncodeToString(code.Hash[:]),
+		Hash:         hash,
 		UpdateTime:   code.UpdateTime,
 		Dependencies: code.Dependencies,
+		Version:      code.Version,
+		Versions: append(history, VersionInfo{
+			Version:    code.Version,
+			Hash:       hash,
+			UpdateTime: code.UpdateTime,
+		}),
 	}
 
 	// Serialize metadata to JSON
@@ -148,17 +499,69 @@ func (m *Manager) saveContractFiles(code *ContractCode) error {
 	}
 
 	// Save metadata
-	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), metadataBytes, 0644); err != nil {
+	tmpPath := filepath.Join(dir, "metadata.json.tmp")
+	if err := os.WriteFile(tmpPath, metadataBytes, 0644); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, "metadata.json")); err != nil {
 		return fmt.Errorf("failed to save metadata: %w", err)
 	}
 
+	// Contracts made of several files are only kept in their version directories
+	if code.Files != nil {
+		os.Remove(filepath.Join(dir, "original.go.txt"))
+		os.Remove(filepath.Join(dir, "injected.go"))
+		return nil
+	}
+
+	// Save original code
+	if err := os.WriteFile(filepath.Join(dir, "original.go.txt"), code.OriginalCode, 0644); err != nil {
+		return fmt.Errorf("failed to save original code: %w", err)
+	}
+
+	// Save code after gas injection
+	if err := os.WriteFile(filepath.Join(dir, "injected.go"), code.InjectedCode, 0644); err != nil {
+		return fmt.Errorf("failed to save injected code: %w", err)
+	}
+
 	return nil
 }
 
+// loadMetadata loads the metadata of a contract
+func (m *Manager) loadMetadata(address core.Address) (*ContractMetadata, error) {
+	metadataBytes, err := os.ReadFile(filepath.Join(m.getContractDir(address), "metadata.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var metadata ContractMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return &metadata, nil
+}
+
+// history returns the version history, contracts registered before versioning have a single version
+func (md *ContractMetadata) history() []VersionInfo {
+	if md.Version == 0 {
+		return []VersionInfo{{Version: 1, Hash: md.Hash, UpdateTime: md.UpdateTime}}
+	}
+	return append([]VersionInfo{}, md.Versions...)
+}
+
 // loadContractCode loads contract code from filesystem
 func (m *Manager) loadContractCode(address core.Address) (*ContractCode, error) {
 	dir := m.getContractDir(address)
 
+	// Read metadata, it decides which version is current
+	metadata, err := m.loadMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Version > 0 {
+		return m.GetCodeVersion(address, metadata.Version)
+	}
+
+	// Contracts registered before versioning only have the top-level files
 	// Read original code
 	originalCode, err := os.ReadFile(filepath.Join(dir, "original.go.txt"))
 	if err != nil {
@@ -171,18 +574,6 @@ func (m *Manager) loadContractCode(address core.Address) (*ContractCode, error)
 		return nil, fmt.Errorf("failed to read injected code: %w", err)
 	}
 
-	// Read metadata
-	metadataBytes, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata: %w", err)
-	}
-
-	// Parse metadata
-	var metadata ContractMetadata
-	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
-	}
-
 	// Parse hash
 	hashBytes, err := hex.DecodeString(metadata.Hash)
 	if err != nil {
@@ -198,5 +589,6 @@ func (m *Manager) loadContractCode(address core.Address) (*ContractCode, error)
 		Dependencies: metadata.Dependencies,
 		UpdateTime:   metadata.UpdateTime,
 		Hash:         hash,
+		Version:      1,
 	}, nil
 }
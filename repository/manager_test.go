@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -127,3 +128,212 @@ func main() {
 	require.NoError(t, err)
 	assert.Equal(t, code, originalCode)
 }
+
+func TestContractUpgrade(t *testing.T) {
+	// 创建临时目录
+	tmpDir, err := os.MkdirTemp("", "code_manager_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// 创建代码管理器
+	manager, err := NewManager(tmpDir)
+	require.NoError(t, err)
+
+	addr := core.AddressFromString("1234567890abcdef1234567890abcdef12345678")
+	code := []byte(`package main
+
+func main() {
+	// 版本1
+}`)
+	newCode := []byte(`package main
+
+func main() {
+	// 版本2
+}`)
+
+	// 升级不存在的合约应该失败
+	_, err = manager.PrepareUpgrade(addr, map[string][]byte{"contract.go": newCode})
+	assert.Error(t, err)
+
+	require.NoError(t, manager.RegisterCode(addr, code))
+
+	// 准备的新版本在激活之前不生效
+	prepared, err := manager.PrepareUpgrade(addr, map[string][]byte{"contract.go": newCode})
+	require.NoError(t, err)
+	assert.Equal(t, 2, prepared.Version)
+	current, err := manager.GetCode(addr)
+	require.NoError(t, err)
+	assert.Equal(t, 1, current.Version)
+	assert.Equal(t, code, current.OriginalCode)
+
+	// 激活新版本
+	require.NoError(t, manager.ActivateVersion(addr, prepared.Version))
+	current, err = manager.GetCode(addr)
+	require.NoError(t, err)
+	assert.Equal(t, 2, current.Version)
+	assert.Equal(t, newCode, current.OriginalCode)
+	assert.Equal(t, prepared.InjectedCode, current.InjectedCode)
+
+	// 验证版本历史
+	versions, err := manager.GetVersions(addr)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, 1, versions[0].Version)
+	assert.Equal(t, 2, versions[1].Version)
+
+	// 旧版本仍然可以读取
+	old, err := manager.GetCodeVersion(addr, 1)
+	require.NoError(t, err)
+	assert.Equal(t, code, old.OriginalCode)
+
+	// 激活不存在的版本应该失败
+	assert.Error(t, manager.ActivateVersion(addr, 3))
+}
+
+func TestPrepareUpgradeAfterFailedUpgrade(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "code_manager_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	manager, err := NewManager(tmpDir)
+	require.NoError(t, err)
+
+	addr := core.AddressFromString("1234567890abcdef1234567890abcdef12345678")
+	code := []byte("package token\n\nfunc Mint() {}\n")
+	require.NoError(t, manager.RegisterCode(addr, code))
+
+	// 未激活的多文件升级留下版本目录和多余的文件
+	files := map[string][]byte{
+		"a.go": []byte("package token\n\nfunc A() {}\n"),
+		"b.go": []byte("package token\n\nfunc B() {}\n"),
+	}
+	failed, err := manager.PrepareUpgrade(addr, files)
+	require.NoError(t, err)
+	stale := filepath.Join(tmpDir, addr.String(), "versions", "2", "injected", "stale.go")
+	require.NoError(t, os.WriteFile(stale, []byte("package token"), 0644))
+
+	// 重试的单文件升级替换掉这些文件
+	newCode := []byte("package token\n\nfunc Burn() {}\n")
+	prepared, err := manager.PrepareUpgrade(addr, map[string][]byte{"contract.go": newCode})
+	require.NoError(t, err)
+	assert.Equal(t, failed.Version, prepared.Version)
+	assert.NoFileExists(t, stale)
+	stored, err := manager.GetCodeVersion(addr, prepared.Version)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Files)
+	assert.Equal(t, newCode, stored.OriginalCode)
+
+	// 回退到旧版本后，新的升级不会覆盖历史中的版本
+	require.NoError(t, manager.ActivateVersion(addr, prepared.Version))
+	require.NoError(t, manager.ActivateVersion(addr, 1))
+	next, err := manager.PrepareUpgrade(addr, files)
+	require.NoError(t, err)
+	assert.Equal(t, 3, next.Version)
+	stored, err = manager.GetCodeVersion(addr, prepared.Version)
+	require.NoError(t, err)
+	assert.Equal(t, newCode, stored.OriginalCode)
+}
+
+func TestPrepareUpgradeBeforeVersioning(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "code_manager_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	manager, err := NewManager(tmpDir)
+	require.NoError(t, err)
+
+	// 版本管理之前注册的合约只有顶层文件，元数据没有版本
+	addr := core.AddressFromString("1234567890abcdef1234567890abcdef12345678")
+	code := []byte("package token\n\nfunc Mint() {}\n")
+	require.NoError(t, manager.RegisterCode(addr, code))
+	contractDir := filepath.Join(tmpDir, addr.String())
+	require.NoError(t, os.RemoveAll(filepath.Join(contractDir, "versions")))
+	metadata, err := manager.loadMetadata(addr)
+	require.NoError(t, err)
+	metadata.Version, metadata.Versions = 0, nil
+	metadataBytes, err := json.Marshal(metadata)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(contractDir, "metadata.json"), metadataBytes, 0644))
+
+	// 第一次升级保存版本1，之后仍然可以回退到它
+	prepared, err := manager.PrepareUpgrade(addr, map[string][]byte{"contract.go": []byte("package token\n\nfunc Burn() {}\n")})
+	require.NoError(t, err)
+	assert.Equal(t, 2, prepared.Version)
+	require.NoError(t, manager.ActivateVersion(addr, prepared.Version))
+	require.NoError(t, manager.ActivateVersion(addr, 1))
+	current, err := manager.GetCode(addr)
+	require.NoError(t, err)
+	assert.Equal(t, 1, current.Version)
+	assert.Equal(t, code, current.OriginalCode)
+}
+
+func TestRegisterFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "code_manager_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	manager, err := NewManager(tmpDir)
+	require.NoError(t, err)
+
+	addr := core.AddressFromString("1234567890abcdef1234567890abcdef12345678")
+	files := map[string][]byte{
+		"types.go": []byte(`package token
+
+type Account struct {
+	Balance uint64
+}
+
+func newAccount(balance uint64) Account {
+	if balance > 0 {
+		return Account{Balance: balance}
+	}
+	return Account{}
+}
+`),
+		"token.go": []byte(`package token
+
+func Mint(amount uint64) uint64 {
+	return newAccount(amount).Balance
+}
+`),
+	}
+
+	// 多文件合约，每个文件单独注入 gas 统计
+	require.NoError(t, manager.RegisterFiles(addr, files))
+	code, err := manager.GetCode(addr)
+	require.NoError(t, err)
+	assert.Equal(t, files, code.Files)
+	assert.Equal(t, HashFiles(files), code.Hash)
+	assert.Equal(t, 1, code.Version)
+	require.Len(t, code.InjectedFiles, 2)
+	assert.Contains(t, string(code.InjectedFiles["token.go"]), "vm_cover_atomic_0_")
+	assert.Contains(t, string(code.InjectedFiles["types.go"]), "vm_cover_atomic_1_")
+	assert.Equal(t, code.InjectedFiles, code.InjectedSources())
+	assert.NoFileExists(t, filepath.Join(tmpDir, addr.String(), "original.go.txt"))
+
+	// 重复注册失败
+	assert.Error(t, manager.RegisterFiles(addr, files))
+
+	// 单文件合约和 RegisterCode 一样保存
+	addr2 := core.AddressFromString("2222567890abcdef1234567890abcdef12345678")
+	require.NoError(t, manager.RegisterFiles(addr2, map[string][]byte{"token.go": files["token.go"]}))
+	code, err = manager.GetCode(addr2)
+	require.NoError(t, err)
+	assert.Nil(t, code.Files)
+	assert.Equal(t, files["token.go"], code.OriginalCode)
+	assert.Equal(t, map[string][]byte{"contract.go": code.InjectedCode}, code.InjectedSources())
+
+	// 升级可以在单文件和多文件之间切换
+	prepared, err := manager.PrepareUpgrade(addr2, files)
+	require.NoError(t, err)
+	require.NoError(t, manager.ActivateVersion(addr2, prepared.Version))
+	code, err = manager.GetCode(addr2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, code.Version)
+	assert.Equal(t, files, code.Files)
+	assert.Len(t, code.InjectedFiles, 2)
+	assert.NoFileExists(t, filepath.Join(tmpDir, addr2.String(), "original.go.txt"))
+	old, err := manager.GetCodeVersion(addr2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, files["token.go"], old.OriginalCode)
+}
@@ -0,0 +1,169 @@
+// Package state defines how blockchain state is committed to, so that contexts backed by
+// different storage produce the same state root for the same state.
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// Key prefixes of the different kinds of state leaves
+const (
+	balancePrefix byte = 0x01
+	objectPrefix  byte = 0x02
+	fieldPrefix   byte = 0x03
+)
+
+// BalanceLeaf returns the leaf of an account balance, zero balances are not part of the state
+func BalanceLeaf(addr core.Address, amount uint64) types.StateLeaf {
+	key := append([]byte{balancePrefix}, addr[:]...)
+	return types.StateLeaf{Key: key, Value: binary.BigEndian.AppendUint64(nil, amount)}
+}
+
+// ObjectLeaf returns the leaf of an object, its value is the object owner
+func ObjectLeaf(contract core.Address, id core.ObjectID, owner core.Address) types.StateLeaf {
+	key := append([]byte{objectPrefix}, contract[:]...)
+	key = append(key, id[:]...)
+	return types.StateLeaf{Key: key, Value: append([]byte{}, owner[:]...)}
+}
+
+// FieldLeaf returns the leaf of an object field
+func FieldLeaf(contract core.Address, id core.ObjectID, field string, value []byte) types.StateLeaf {
+	key := append([]byte{fieldPrefix}, contract[:]...)
+	key = append(key, id[:]...)
+	key = append(key, field...)
+	return types.StateLeaf{Key: key, Value: append([]byte{}, value...)}
+}
+
+// Root returns the Merkle root over a set of state leaves.
+// Leaves are sorted by key first, so the root does not depend on the order they are listed in.
+// The root of an empty state is the zero hash.
+func Root(leaves []types.StateLeaf) core.Hash {
+	return NewTree(leaves).Root()
+}
+
+// Proof proves that a leaf is part of the state committed to by a root
+type Proof struct {
+	Index    int         `json:"index"`    // Position of the leaf among the sorted leaves
+	Total    int         `json:"total"`    // Number of leaves in the state
+	Siblings []core.Hash `json:"siblings"` // Sibling hashes from the leaf up to the root
+}
+
+// Prove returns the inclusion proof of the leaf with the given key
+func Prove(leaves []types.StateLeaf, key []byte) (*Proof, error) {
+	return NewTree(leaves).Prove(key)
+}
+
+// VerifyProof checks that leaf is part of the state committed to by root
+func VerifyProof(root core.Hash, leaf types.StateLeaf, proof *Proof) bool {
+	if proof == nil || proof.Index < 0 || proof.Index >= proof.Total {
+		return false
+	}
+	hash := hashLeaf(leaf)
+	index, count, siblings := proof.Index, proof.Total, proof.Siblings
+	for count > 1 {
+		switch {
+		case index%2 == 1:
+			if len(siblings) == 0 {
+				return false
+			}
+			hash = hashNode(siblings[0], hash)
+			siblings = siblings[1:]
+		case index+1 < count:
+			if len(siblings) == 0 {
+				return false
+			}
+			hash = hashNode(hash, siblings[0])
+			siblings = siblings[1:]
+		}
+		// The last node of an odd level is carried up unchanged
+		index /= 2
+		count = (count + 1) / 2
+	}
+	return len(siblings) == 0 && hash == root
+}
+
+// Prover is implemented by blockchain contexts that commit to their state and prove parts of it
+type Prover interface {
+	StateRoot() (core.Hash, error)
+	Prove(contract core.Address, id core.ObjectID, field string) (*Proof, error)
+	ProveBalance(addr core.Address) (*Proof, error)
+}
+
+// Commit returns the state root of a blockchain context.
+// A context that implements Prover keeps its tree between blocks and only hashes the changed leaves again.
+func Commit(ctx types.BlockchainContext) (core.Hash, error) {
+	if prover, ok := ctx.(Prover); ok {
+		return prover.StateRoot()
+	}
+	leaves, err := ctx.StateLeaves()
+	if err != nil {
+		return core.Hash{}, err
+	}
+	return Root(leaves), nil
+}
+
+// ProveField returns the inclusion proof of an object field in a blockchain context,
+// with an empty field the proof is for the object itself and its owner.
+// A context that implements Prover proves it with the tree it keeps instead of building one.
+func ProveField(ctx types.BlockchainContext, contract core.Address, id core.ObjectID, field string) (*Proof, error) {
+	if prover, ok := ctx.(Prover); ok {
+		return prover.Prove(contract, id, field)
+	}
+	leaves, err := ctx.StateLeaves()
+	if err != nil {
+		return nil, err
+	}
+	return Prove(leaves, FieldKey(contract, id, field))
+}
+
+// FieldKey returns the key of the leaf of an object field, or of the object itself if field is empty
+func FieldKey(contract core.Address, id core.ObjectID, field string) []byte {
+	if field == "" {
+		return ObjectLeaf(contract, id, core.Address{}).Key
+	}
+	return FieldLeaf(contract, id, field, nil).Key
+}
+
+// ProveBalance returns the inclusion proof of an account balance in a blockchain context
+func ProveBalance(ctx types.BlockchainContext, addr core.Address) (*Proof, error) {
+	if prover, ok := ctx.(Prover); ok {
+		return prover.ProveBalance(addr)
+	}
+	leaves, err := ctx.StateLeaves()
+	if err != nil {
+		return nil, err
+	}
+	return Prove(leaves, BalanceLeaf(addr, 0).Key)
+}
+
+func sortLeaves(leaves []types.StateLeaf) []types.StateLeaf {
+	sorted := append([]types.StateLeaf{}, leaves...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	return sorted
+}
+
+// hashLeaf hashes a leaf, leaves and inner nodes use different prefixes so one can't pass for the other
+func hashLeaf(leaf types.StateLeaf) core.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(leaf.Key))))
+	h.Write(leaf.Key)
+	h.Write(leaf.Value)
+	return core.Hash(h.Sum(nil))
+}
+
+func hashNode(left, right core.Hash) core.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	return core.Hash(h.Sum(nil))
+}
@@ -0,0 +1,225 @@
+package state_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/govm-net/vm/context/db"
+	"github.com/govm-net/vm/context/memory"
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
+	"github.com/govm-net/vm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ state.Prover = &db.Context{}
+
+func TestRoot(t *testing.T) {
+	contract := core.Address{0x01}
+	id := core.ObjectID{0x02}
+	leaves := []types.StateLeaf{
+		state.BalanceLeaf(core.Address{0x03}, 100),
+		state.ObjectLeaf(contract, id, contract),
+		state.FieldLeaf(contract, id, "name", []byte("value")),
+	}
+
+	// 空状态的根为零哈希
+	assert.Equal(t, core.Hash{}, state.Root(nil))
+
+	// 根与叶子顺序无关
+	root := state.Root(leaves)
+	reordered := []types.StateLeaf{leaves[2], leaves[0], leaves[1]}
+	assert.Equal(t, root, state.Root(reordered))
+
+	// 任何值的变化都会改变根
+	changed := append([]types.StateLeaf{}, leaves...)
+	changed[2] = state.FieldLeaf(contract, id, "name", []byte("other"))
+	assert.NotEqual(t, root, state.Root(changed))
+	assert.NotEqual(t, root, state.Root(leaves[:2]))
+}
+
+func TestRootAcrossContexts(t *testing.T) {
+	dbPath := "./state_test.db"
+	t.Cleanup(func() {
+		os.Remove(dbPath)
+	})
+	contexts := []types.BlockchainContext{
+		memory.NewBlockchainContext(nil),
+		db.NewContext(map[string]any{"db_path": dbPath}),
+	}
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	var roots []core.Hash
+	for _, ctx := range contexts {
+		require.NoError(t, ctx.SetBlockInfo(1, 1000, core.Hash{0x10}))
+		require.NoError(t, ctx.SetTransactionInfo(core.Hash{0x11}, sender, contract, 0))
+
+		kept, err := ctx.CreateObjectWithID(contract, core.ObjectID{0x20})
+		require.NoError(t, err)
+		require.NoError(t, kept.Set(contract, sender, "count", []byte("1")))
+		require.NoError(t, kept.SetOwner(contract, contract, sender))
+
+		deleted, err := ctx.CreateObjectWithID(contract, core.ObjectID{0x21})
+		require.NoError(t, err)
+		require.NoError(t, deleted.Set(contract, sender, "count", []byte("2")))
+		require.NoError(t, ctx.DeleteObject(contract, deleted.ID()))
+
+		leaves, err := ctx.StateLeaves()
+		require.NoError(t, err)
+		assert.Len(t, leaves, 2)
+		roots = append(roots, state.Root(leaves))
+	}
+
+	// 相同的状态在不同的存储中产生相同的根
+	assert.Equal(t, roots[0], roots[1])
+}
+
+func TestTreeReplace(t *testing.T) {
+	contract := core.Address{0x01}
+	leaves := make(map[string]types.StateLeaf)
+	var tree *state.Tree
+	check := func(step string) {
+		var all []types.StateLeaf
+		for _, leaf := range leaves {
+			all = append(all, leaf)
+		}
+		root := state.Root(all)
+		assert.Equal(t, root, tree.Root(), step)
+		for _, leaf := range all {
+			proof, err := tree.Prove(leaf.Key)
+			require.NoError(t, err, step)
+			assert.True(t, state.VerifyProof(root, leaf, proof), step)
+		}
+	}
+
+	for i := 0; i < 9; i++ {
+		leaf := state.BalanceLeaf(core.Address{byte(i)}, uint64(i+1))
+		leaves[string(leaf.Key)] = leaf
+	}
+	var initial []types.StateLeaf
+	for _, leaf := range leaves {
+		initial = append(initial, leaf)
+	}
+	tree = state.NewTree(initial)
+	check("new tree")
+
+	// 修改值只重新计算叶子所在的路径
+	for _, i := range []int{0, 4, 8} {
+		leaf := state.BalanceLeaf(core.Address{byte(i)}, 1000)
+		leaves[string(leaf.Key)] = leaf
+		tree.Replace(leaf.Key, []types.StateLeaf{leaf})
+		check("change value")
+	}
+
+	// 增加和删除叶子会移动其后的叶子
+	for i := 0; i < 4; i++ {
+		id := core.ObjectID{byte(i)}
+		object := state.ObjectLeaf(contract, id, contract)
+		field := state.FieldLeaf(contract, id, "name", []byte{byte(i)})
+		leaves[string(object.Key)] = object
+		leaves[string(field.Key)] = field
+		tree.Replace(object.Key, []types.StateLeaf{object})
+		tree.Replace(state.FieldLeaf(contract, id, "", nil).Key, []types.StateLeaf{field})
+		check("add object")
+	}
+	for _, i := range []int{3, 0, 7} {
+		key := state.BalanceLeaf(core.Address{byte(i)}, 0).Key
+		delete(leaves, string(key))
+		tree.Replace(key, nil)
+		check("delete balance")
+	}
+
+	// 替换前缀下的所有叶子
+	id := core.ObjectID{0x02}
+	prefix := state.FieldLeaf(contract, id, "", nil).Key
+	for key := range leaves {
+		if strings.HasPrefix(key, string(prefix)) {
+			delete(leaves, key)
+		}
+	}
+	fields := []types.StateLeaf{
+		state.FieldLeaf(contract, id, "a", []byte("1")),
+		state.FieldLeaf(contract, id, "b", []byte("2")),
+	}
+	for _, leaf := range fields {
+		leaves[string(leaf.Key)] = leaf
+	}
+	tree.Replace(prefix, fields)
+	check("replace fields")
+
+	// 删除所有叶子后根为零哈希
+	for key := range leaves {
+		tree.Replace([]byte(key), nil)
+	}
+	assert.Equal(t, core.Hash{}, tree.Root())
+}
+
+func TestProve(t *testing.T) {
+	// 覆盖奇数和偶数叶子数量的树
+	for n := 1; n <= 9; n++ {
+		var leaves []types.StateLeaf
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, state.BalanceLeaf(core.Address{byte(i)}, uint64(i+1)))
+		}
+		root := state.Root(leaves)
+
+		for i, leaf := range leaves {
+			proof, err := state.Prove(leaves, leaf.Key)
+			require.NoError(t, err)
+			assert.True(t, state.VerifyProof(root, leaf, proof), "leaf %d of %d", i, n)
+
+			// 篡改的值或位置无法通过验证
+			tampered := state.BalanceLeaf(core.Address{byte(i)}, 1000)
+			assert.False(t, state.VerifyProof(root, tampered, proof))
+			if n > 1 {
+				moved := *proof
+				moved.Index = (proof.Index + 1) % n
+				assert.False(t, state.VerifyProof(root, leaf, &moved))
+			}
+		}
+	}
+
+	// 不存在的叶子无法证明
+	_, err := state.Prove(nil, []byte{0x01})
+	assert.Error(t, err)
+}
+
+func TestContextProofs(t *testing.T) {
+	ctx := memory.NewBlockchainContext(nil)
+	prover, ok := ctx.(state.Prover)
+	require.True(t, ok)
+
+	contract := core.Address{0x01}
+	sender := core.Address{0x02}
+	obj, err := ctx.CreateObjectWithID(contract, core.ObjectID{0x03})
+	require.NoError(t, err)
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("7")))
+
+	root, err := prover.StateRoot()
+	require.NoError(t, err)
+
+	// 轻客户端只需要根、字段值和证明即可验证
+	proof, err := prover.Prove(contract, obj.ID(), "count")
+	require.NoError(t, err)
+	assert.True(t, state.VerifyProof(root, state.FieldLeaf(contract, obj.ID(), "count", []byte("7")), proof))
+	assert.False(t, state.VerifyProof(root, state.FieldLeaf(contract, obj.ID(), "count", []byte("8")), proof))
+
+	proof, err = prover.Prove(contract, obj.ID(), "")
+	require.NoError(t, err)
+	assert.True(t, state.VerifyProof(root, state.ObjectLeaf(contract, obj.ID(), contract), proof))
+
+	// 修改之后的证明针对新的根
+	require.NoError(t, obj.Set(contract, sender, "count", []byte("8")))
+	proof, err = state.ProveField(ctx, contract, obj.ID(), "count")
+	require.NoError(t, err)
+	assert.False(t, state.VerifyProof(root, state.FieldLeaf(contract, obj.ID(), "count", []byte("8")), proof))
+	root, err = state.Commit(ctx)
+	require.NoError(t, err)
+	assert.True(t, state.VerifyProof(root, state.FieldLeaf(contract, obj.ID(), "count", []byte("8")), proof))
+
+	_, err = prover.ProveBalance(sender)
+	assert.Error(t, err)
+}
@@ -0,0 +1,259 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// Tree is the Merkle tree over a set of state leaves, kept between commits so that
+// only the leaves changed since the last root are hashed again.
+// A changed value rehashes the path of its leaf, an added or removed leaf moves every leaf after it
+// and rehashes the nodes above them. A Tree is not safe for concurrent use.
+type Tree struct {
+	keys   [][]byte      // sorted leaf keys
+	levels [][]core.Hash // levels[0] holds the leaf hashes, the last level the root
+	dirty  map[int]bool  // leaves whose value changed since the last root
+	moved  int           // leaves from this index on were added, removed or moved since the last root
+}
+
+// NewTree returns the tree over leaves, the order they are listed in does not matter.
+// The nodes above the leaves are hashed when the root is first needed.
+func NewTree(leaves []types.StateLeaf) *Tree {
+	sorted := sortLeaves(leaves)
+	t := &Tree{
+		keys:   make([][]byte, len(sorted)),
+		levels: [][]core.Hash{make([]core.Hash, len(sorted))},
+	}
+	for i, leaf := range sorted {
+		t.keys[i] = leaf.Key
+		t.levels[0][i] = hashLeaf(leaf)
+	}
+	return t
+}
+
+// Root returns the Merkle root over the leaves of the tree, the same as Root of those leaves
+func (t *Tree) Root() core.Hash {
+	t.rehash()
+	if len(t.keys) == 0 {
+		return core.Hash{}
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Prove returns the inclusion proof of the leaf with the given key
+func (t *Tree) Prove(key []byte) (*Proof, error) {
+	index := t.search(key)
+	if index == len(t.keys) || !bytes.Equal(t.keys[index], key) {
+		return nil, errors.New("state leaf not found")
+	}
+
+	t.rehash()
+	proof := &Proof{Index: index, Total: len(t.keys)}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// Replace replaces every leaf whose key starts with prefix by leaves, whose keys must all start with prefix.
+// Leaves that keep their value are not hashed again.
+func (t *Tree) Replace(prefix []byte, leaves []types.StateLeaf) {
+	kept := make(map[string]bool, len(leaves))
+	for _, leaf := range leaves {
+		kept[string(leaf.Key)] = true
+	}
+	from := t.search(prefix)
+	to := from
+	for to < len(t.keys) && bytes.HasPrefix(t.keys[to], prefix) {
+		to++
+	}
+	for i := to - 1; i >= from; i-- {
+		if !kept[string(t.keys[i])] {
+			t.remove(i)
+		}
+	}
+	for _, leaf := range leaves {
+		t.set(leaf)
+	}
+}
+
+// search returns the index of the first key not less than key
+func (t *Tree) search(key []byte) int {
+	return sort.Search(len(t.keys), func(i int) bool {
+		return bytes.Compare(t.keys[i], key) >= 0
+	})
+}
+
+func (t *Tree) set(leaf types.StateLeaf) {
+	hash := hashLeaf(leaf)
+	i := t.search(leaf.Key)
+	if i < len(t.keys) && bytes.Equal(t.keys[i], leaf.Key) {
+		if t.levels[0][i] != hash {
+			t.levels[0][i] = hash
+			if t.dirty == nil {
+				t.dirty = make(map[int]bool)
+			}
+			t.dirty[i] = true
+		}
+		return
+	}
+	t.keys = append(t.keys, nil)
+	copy(t.keys[i+1:], t.keys[i:])
+	t.keys[i] = leaf.Key
+	t.levels[0] = append(t.levels[0], core.Hash{})
+	copy(t.levels[0][i+1:], t.levels[0][i:])
+	t.levels[0][i] = hash
+	t.move(i)
+}
+
+func (t *Tree) remove(i int) {
+	t.keys = append(t.keys[:i], t.keys[i+1:]...)
+	t.levels[0] = append(t.levels[0][:i], t.levels[0][i+1:]...)
+	t.move(i)
+}
+
+// move records that the leaves from index i on moved, the dirty leaves among them are rehashed with them
+func (t *Tree) move(i int) {
+	t.moved = min(t.moved, i)
+}
+
+// rehash brings the nodes above the leaves up to date
+func (t *Tree) rehash() {
+	if t.moved == math.MaxInt && len(t.dirty) == 0 {
+		return
+	}
+	level, moved, dirty := t.levels[0], t.moved, t.dirty
+	levels := t.levels[:1]
+	for len(level) > 1 {
+		var next []core.Hash
+		if len(levels) < len(t.levels) {
+			next = t.levels[len(levels)]
+		}
+		size := (len(level) + 1) / 2
+		if len(next) > size {
+			next = next[:size]
+		} else {
+			next = append(next, make([]core.Hash, size-len(next))...)
+		}
+
+		moved /= 2
+		parents := make(map[int]bool, len(dirty))
+		for i := range dirty {
+			if p := i / 2; p < moved {
+				parents[p] = true
+				next[p] = node(level, p)
+			}
+		}
+		for p := moved; p < size; p++ {
+			next[p] = node(level, p)
+		}
+		levels = append(levels, next)
+		level, dirty = next, parents
+	}
+	t.levels = levels
+	t.moved, t.dirty = math.MaxInt, nil
+}
+
+// node returns the hash of node p from the level below it,
+// an odd node is carried up to the next level unchanged
+func node(level []core.Hash, p int) core.Hash {
+	if 2*p+1 == len(level) {
+		return level[2*p]
+	}
+	return hashNode(level[2*p], level[2*p+1])
+}
+
+// Source reads the current leaves of a state, used by Tracker to update its tree
+type Source interface {
+	// StateLeaves returns every leaf of the state
+	StateLeaves() ([]types.StateLeaf, error)
+	// BalanceLeaves returns the leaf of the balance of addr, none if it is zero
+	BalanceLeaves(addr core.Address) ([]types.StateLeaf, error)
+	// ObjectLeaves returns the leaves of object id of contract and of its fields, none if it doesn't exist
+	ObjectLeaves(contract core.Address, id core.ObjectID) ([]types.StateLeaf, error)
+}
+
+// objectRef identifies an object by its contract, which is part of the keys of its leaves
+type objectRef struct {
+	contract core.Address
+	id       core.ObjectID
+}
+
+// Tracker keeps the tree of a blockchain context between blocks. The context marks the balances and objects
+// it changes, including when it reverts them, and only their leaves are read again on the next commit.
+// The zero Tracker is ready to use, it builds the tree from every leaf the first time it is needed.
+type Tracker struct {
+	tree     *Tree
+	balances map[core.Address]bool
+	objects  map[objectRef]bool
+}
+
+// TouchBalance marks the balance of addr as changed
+func (t *Tracker) TouchBalance(addr core.Address) {
+	if t.tree == nil {
+		return
+	}
+	if t.balances == nil {
+		t.balances = make(map[core.Address]bool)
+	}
+	t.balances[addr] = true
+}
+
+// TouchObject marks object id of contract and its fields as changed
+func (t *Tracker) TouchObject(contract core.Address, id core.ObjectID) {
+	if t.tree == nil {
+		return
+	}
+	if t.objects == nil {
+		t.objects = make(map[objectRef]bool)
+	}
+	t.objects[objectRef{contract, id}] = true
+}
+
+// Tree returns the tree over the current state of src, updated with the leaves changed since it was last returned
+func (t *Tracker) Tree(src Source) (*Tree, error) {
+	if t.tree == nil {
+		leaves, err := src.StateLeaves()
+		if err != nil {
+			return nil, err
+		}
+		t.tree = NewTree(leaves)
+		return t.tree, nil
+	}
+	for addr := range t.balances {
+		leaves, err := src.BalanceLeaves(addr)
+		if err != nil {
+			return nil, err
+		}
+		t.tree.Replace(BalanceLeaf(addr, 0).Key, leaves)
+		delete(t.balances, addr)
+	}
+	for ref := range t.objects {
+		leaves, err := src.ObjectLeaves(ref.contract, ref.id)
+		if err != nil {
+			return nil, err
+		}
+		objectKey := ObjectLeaf(ref.contract, ref.id, core.Address{}).Key
+		var object, fields []types.StateLeaf
+		for _, leaf := range leaves {
+			if bytes.Equal(leaf.Key, objectKey) {
+				object = append(object, leaf)
+			} else {
+				fields = append(fields, leaf)
+			}
+		}
+		t.tree.Replace(objectKey, object)
+		t.tree.Replace(FieldLeaf(ref.contract, ref.id, "", nil).Key, fields)
+		delete(t.objects, ref)
+	}
+	return t.tree, nil
+}
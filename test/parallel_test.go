@@ -56,7 +56,7 @@ func BenchmarkParallelExecution(b *testing.B) {
 		core.HashFromString("0x1234567890ab"),
 		core.AddressFromString(sender),
 		contractAddr,
-		1000,
+		0,
 	)
 
 	_, err = engine.Execute(
@@ -4,6 +4,7 @@ package types
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"strings"
 )
 
@@ -56,6 +57,10 @@ const (
 	FuncSetObjectField // 13
 	// FuncGetObjectContract gets the contract of a state object
 	FuncGetObjectContract // 14
+	// FuncGetValue returns the value attached to the current call
+	FuncGetValue // 15
+	// FuncSelfDestruct destroys the current contract, sending its balance to a beneficiary
+	FuncSelfDestruct // 16
 )
 
 // HostBufferSize defines the size of the buffer used for data exchange between host and contract
@@ -101,6 +106,7 @@ type Context interface {
 
 	// Account operations related
 	Sender() Address                                // Get transaction sender or contract caller
+	Value() uint64                                  // Get the value the sender attached to the call
 	Balance(addr Address) uint64                    // Get account balance
 	Transfer(from, to Address, amount uint64) error // Transfer operation
 
@@ -112,9 +118,13 @@ type Context interface {
 
 	// Cross-contract calls
 	Call(contract Address, function string, args ...any) ([]byte, error)
+	CallWithValue(contract Address, function string, value uint64, args ...any) ([]byte, error) // Call, paying value to the callee
 
 	// Logs and events
 	Log(eventName string, keyValues ...any) // Log event
+
+	// Contract lifecycle
+	SelfDestruct(beneficiary Address) error // Destroy the contract once the execution succeeds, its balance goes to beneficiary
 }
 
 // Object 接口用于管理区块链状态对象
@@ -142,6 +152,7 @@ type CallParams struct {
 	Function string  `json:"function,omitempty"`
 	Args     []any   `json:"args,omitempty"`
 	GasLimit int64   `json:"gas_limit,omitempty"`
+	Value    uint64  `json:"value,omitempty"` // transferred from the caller to the callee, refunded if the call fails
 }
 
 type CallResult struct {
@@ -169,6 +180,11 @@ type DeleteObjectParams struct {
 	ID       ObjectID `json:"id,omitempty"`
 }
 
+type SelfDestructParams struct {
+	Contract    Address `json:"contract,omitempty"`
+	Beneficiary Address `json:"beneficiary,omitempty"`
+}
+
 type SetOwnerParams struct {
 	Contract Address  `json:"contract,omitempty"`
 	Sender   Address  `json:"sender,omitempty"`
@@ -188,6 +204,29 @@ type ExecutionResult struct {
 	Success bool   `json:"success"`
 	Data    any    `json:"data,omitempty"`
 	Error   string `json:"error,omitempty"`
+	GasUsed int64  `json:"gas_used,omitempty"`
+	Depth   int    `json:"depth,omitempty"` // deepest nested call reached, set by the engine
+
+	RawData json.RawMessage `json:"-"` // Data as returned by the contract, numbers are exact
+}
+
+// UnmarshalJSON decodes an execution result, keeping the JSON of its data in RawData
+func (r *ExecutionResult) UnmarshalJSON(data []byte) error {
+	type result ExecutionResult
+	var raw struct {
+		result
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = ExecutionResult(raw.result)
+	r.Data = nil
+	r.RawData = raw.Data
+	if len(raw.Data) > 0 {
+		return json.Unmarshal(raw.Data, &r.Data)
+	}
+	return nil
 }
 
 type LogParams struct {
@@ -202,8 +241,13 @@ type HandleContractCallParams struct {
 	Function string  `json:"function,omitempty"`
 	Args     []byte  `json:"args,omitempty"`
 	GasLimit int64   `json:"gas_limit,omitempty"`
+	Debug    bool    `json:"debug,omitempty"` // enables core.Debug output
 }
 
+// CallHandler executes a cross-contract call on behalf of a BlockchainContext,
+// running function of contract with caller as the sender and returning the JSON encoded result
+type CallHandler func(ctx BlockchainContext, caller Address, contract Address, function string, args ...any) ([]byte, error)
+
 // Context 是合约与区块链环境交互的主要接口
 type BlockchainContext interface {
 	// set block info and transaction info
@@ -218,6 +262,7 @@ type BlockchainContext interface {
 	GetGas() int64            // Get used gas
 	// Account operations related
 	Sender() Address                                          // Get transaction sender or contract caller
+	Value() uint64                                            // Get the value attached to the transaction
 	Balance(addr Address) uint64                              // Get account balance
 	Transfer(contract, from, to Address, amount uint64) error // Transfer operation
 
@@ -227,12 +272,53 @@ type BlockchainContext interface {
 	GetObject(contract Address, id ObjectID) (VMObject, error)            // Get specified object
 	GetObjectWithOwner(contract Address, owner Address) (VMObject, error) // Get object by owner
 	DeleteObject(contract Address, id ObjectID) error                     // Delete object
+	DeleteContractObjects(contract Address) ([]ObjectID, error)           // Delete every object of a contract, returns their IDs
 
 	// Cross-contract calls
 	Call(caller Address, contract Address, function string, args ...any) ([]byte, error)
+	SetCallHandler(handler CallHandler) // Set the handler that executes cross-contract calls
 
 	// Logs and events
 	Log(contract Address, eventName string, keyValues ...any) // Log event
+
+	// State journal - changes made after Snapshot can be discarded with RevertToSnapshot, or kept with CommitSnapshot.
+	// The outermost snapshot of an operation is committed once it succeeded, so the journal doesn't grow forever.
+	Snapshot() int                 // Take a snapshot of the current state, returns its id
+	RevertToSnapshot(id int) error // Revert all state changes made after the snapshot was taken
+	CommitSnapshot(id int) error   // Keep all state changes made after the snapshot, they can no longer be reverted
+
+	// State export - every balance, object and field, used to commit to the state
+	StateLeaves() ([]StateLeaf, error)
+}
+
+// ValueCaller is implemented by contexts that can attach value to cross-contract calls.
+// The value is transferred from the caller to the callee before the call and refunded if the call fails.
+type ValueCaller interface {
+	CallWithValue(caller Address, contract Address, function string, value uint64, args ...any) ([]byte, error)
+}
+
+// SelfDestructor is implemented by contexts that let contracts destroy themselves.
+// The state of contract is removed and its balance sent to beneficiary, see core.SelfDestruct.
+type SelfDestructor interface {
+	SelfDestruct(contract, beneficiary Address) error
+}
+
+// WriteChecker is implemented by contexts that may forbid state changes, such as read-only queries.
+// Host functions that change state call CheckWrite first and fail if it returns an error.
+type WriteChecker interface {
+	CheckWrite() error
+}
+
+// DryRunner is implemented by contexts that can run code against a throwaway copy of their state,
+// such as a database transaction that is rolled back. Nothing fn does through ctx reaches the context.
+type DryRunner interface {
+	DryRun(fn func(ctx BlockchainContext) error) error
+}
+
+// StateLeaf is one entry of the blockchain state, see package state for the key layout
+type StateLeaf struct {
+	Key   []byte
+	Value []byte
 }
 
 // Object 接口用于管理区块链状态对象
@@ -0,0 +1,87 @@
+package types
+
+import "encoding/json"
+
+// ReceiptStatus is the outcome of an executed transaction
+type ReceiptStatus uint8
+
+const (
+	// ReceiptStatusFailed means the execution failed and its state changes were reverted
+	ReceiptStatusFailed ReceiptStatus = iota
+	// ReceiptStatusSuccess means the execution completed and its state changes were kept
+	ReceiptStatusSuccess
+)
+
+// EventLog is an event emitted by a contract through Log
+type EventLog struct {
+	Contract  Address `json:"contract"`
+	Event     string  `json:"event"`
+	KeyValues []any   `json:"key_values,omitempty"`
+}
+
+// TraceEntry is output a contract wrote to stdout or stderr during an execution
+type TraceEntry struct {
+	Contract Address `json:"contract"`
+	Output   string  `json:"output"`
+}
+
+// OutputRecorder is implemented by blockchain contexts that collect the output of contracts into the execution trace
+type OutputRecorder interface {
+	RecordOutput(contract Address, output []byte)
+}
+
+// Receipt records the result of executing a transaction
+type Receipt struct {
+	TxHash         Hash          `json:"tx_hash"`
+	BlockHeight    uint64        `json:"block_height"`
+	Contract       Address       `json:"contract"`
+	Function       string        `json:"function"`
+	Status         ReceiptStatus `json:"status"`
+	Data           any           `json:"data,omitempty"`            // Return data of a successful execution
+	GasUsed        int64         `json:"gas_used"`                  // Gas used, including nested calls
+	Logs           []EventLog    `json:"logs,omitempty"`            // Events emitted, reverted calls emit none
+	CreatedObjects []ObjectID    `json:"created_objects,omitempty"` // Objects created by the execution
+	DeletedObjects []ObjectID    `json:"deleted_objects,omitempty"` // Objects deleted by the execution
+	RevertReason   string        `json:"revert_reason,omitempty"`   // Why a failed execution was reverted
+	Trace          []TraceEntry  `json:"trace,omitempty"`           // Contract output, kept for failed calls too
+
+	RawData json.RawMessage `json:"-"` // Data as returned by the contract, numbers are exact
+}
+
+// MarshalJSON encodes a receipt, its data is written from RawData when it is set so numbers stay exact
+func (r Receipt) MarshalJSON() ([]byte, error) {
+	type receipt Receipt
+	out := struct {
+		receipt
+		Data any `json:"data,omitempty"`
+	}{receipt: receipt(r), Data: r.Data}
+	if len(r.RawData) > 0 {
+		out.Data = r.RawData
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a receipt, keeping the JSON of its data in RawData
+func (r *Receipt) UnmarshalJSON(data []byte) error {
+	type receipt Receipt
+	var raw struct {
+		receipt
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = Receipt(raw.receipt)
+	r.Data = nil
+	r.RawData = raw.Data
+	if len(raw.Data) > 0 {
+		return json.Unmarshal(raw.Data, &r.Data)
+	}
+	return nil
+}
+
+// ReceiptStore is implemented by blockchain contexts that persist receipts
+type ReceiptStore interface {
+	SaveReceipt(receipt *Receipt) error
+	GetReceipt(txHash Hash) (*Receipt, error)
+}
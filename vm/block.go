@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/state"
+	"github.com/govm-net/vm/types"
+)
+
+// BlockHeader describes the block a list of transactions is executed in
+type BlockHeader struct {
+	Height uint64
+	Time   int64
+	Hash   core.Hash
+}
+
+// Tx is a transaction calling a contract function
+type Tx struct {
+	Hash     core.Hash
+	From     core.Address
+	Contract core.Address
+	Value    uint64
+	GasLimit int64 // Gas available to the transaction, the configured MaxGas if zero
+	Function string
+	Args     []byte // JSON encoded named arguments, as for Execute
+}
+
+// BlockResult is the outcome of executing a block
+type BlockResult struct {
+	Receipts  []*types.Receipt
+	GasUsed   int64
+	StateRoot core.Hash // Merkle root over all balances, objects and fields after the block
+}
+
+// ExecuteBlock sets the block context and executes the transactions in order, each with its own
+// sender, value and gas limit. Failed transactions are reverted and reported in their receipts,
+// the block itself only fails if the context or state can't be updated.
+func (e *Engine) ExecuteBlock(header BlockHeader, txs []Tx) (*BlockResult, error) {
+	if err := e.ctx.SetBlockInfo(header.Height, header.Time, header.Hash); err != nil {
+		return nil, fmt.Errorf("failed to set block info: %w", err)
+	}
+
+	result := &BlockResult{}
+	for i, tx := range txs {
+		if err := e.ctx.SetTransactionInfo(tx.Hash, tx.From, tx.Contract, tx.Value); err != nil {
+			return nil, fmt.Errorf("failed to set transaction %d info: %w", i, err)
+		}
+		gasLimit := tx.GasLimit
+		if gasLimit <= 0 {
+			gasLimit = e.maxGas
+		}
+		e.ctx.SetGasLimit(gasLimit)
+
+		receipt, err := e.ExecuteTx(tx.Contract, tx.Function, tx.Args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute transaction %d: %w", i, err)
+		}
+		result.Receipts = append(result.Receipts, receipt)
+		result.GasUsed += receipt.GasUsed
+	}
+
+	root, err := state.Commit(e.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit state: %w", err)
+	}
+	result.StateRoot = root
+	return result, nil
+}
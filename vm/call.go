@@ -0,0 +1,330 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+	"github.com/govm-net/vm/wasi"
+)
+
+// ErrCallDepthExceeded is returned when nested contract calls go deeper than the configured MaxCallDepth
+var ErrCallDepthExceeded = errors.New("max call depth exceeded")
+
+// ErrExecutionTimeout is returned when an execution runs longer than Config.ExecutionTimeout
+var ErrExecutionTimeout = wasi.ErrExecutionTimeout
+
+// ErrWriteInReadOnlyCall is returned when a contract changes state during a read-only query
+var ErrWriteInReadOnlyCall = errors.New("write in read-only call")
+
+// execution tracks the call stack and side effects of one top-level contract execution
+type execution struct {
+	ctx context.Context // aborts the execution when done, shared by nested calls
+
+	maxDepth int   // deepest call reached
+	readOnly bool  // state changes are rejected, nested calls inherit it
+	writeErr error // set when a state change was rejected in a read-only execution
+
+	// Side effects reported in the receipt, calls that fail discard their own
+	logs    []types.EventLog
+	created []core.ObjectID
+	deleted []core.ObjectID
+
+	// Contracts that destroyed themselves, their code is removed when the execution succeeds
+	destroyed []core.Address
+
+	// Output of all contracts, reverted calls included
+	trace []types.TraceEntry
+}
+
+// executionMark is the position of an execution's side effects, used to discard them on revert
+type executionMark struct {
+	logs, created, deleted, destroyed int
+}
+
+func (x *execution) mark() executionMark {
+	return executionMark{len(x.logs), len(x.created), len(x.deleted), len(x.destroyed)}
+}
+
+func (x *execution) rollback(m executionMark) {
+	x.logs = x.logs[:m.logs]
+	x.created = x.created[:m.created]
+	x.deleted = x.deleted[:m.deleted]
+	x.destroyed = x.destroyed[:m.destroyed]
+}
+
+// callFrame is the blockchain context seen by one contract execution.
+// It shares all state with the underlying context, but reports its own sender and contract address.
+type callFrame struct {
+	types.BlockchainContext
+	engine   *Engine
+	exec     *execution
+	depth    int
+	sender   core.Address
+	contract core.Address
+	value    uint64 // paid by the sender to the contract when the call starts
+	depthErr error  // set when a nested call of this frame was rejected for exceeding the depth limit
+
+	constructor bool // runs the constructor at deployment
+}
+
+// newFrame creates the frame for a call into contract.
+// Calls made from inside a frame extend its call stack, any other call starts a new execution.
+func (e *Engine) newFrame(ctx types.BlockchainContext, caller, contract core.Address) (*callFrame, error) {
+	frame := &callFrame{
+		BlockchainContext: ctx,
+		engine:            e,
+		exec:              &execution{},
+		depth:             1,
+		sender:            caller,
+		contract:          contract,
+	}
+	parent, nested := ctx.(*callFrame)
+	if nested {
+		frame.BlockchainContext = parent.BlockchainContext
+		frame.exec = parent.exec
+		frame.depth = parent.depth + 1
+	}
+	if frame.depth > e.maxCallDepth {
+		err := fmt.Errorf("%w: depth %d, max %d", ErrCallDepthExceeded, frame.depth, e.maxCallDepth)
+		if nested {
+			parent.depthErr = err
+		}
+		return nil, err
+	}
+	if frame.depth > frame.exec.maxDepth {
+		frame.exec.maxDepth = frame.depth
+	}
+	return frame, nil
+}
+
+func (f *callFrame) Sender() core.Address {
+	return f.sender
+}
+
+func (f *callFrame) ContractAddress() core.Address {
+	return f.contract
+}
+
+func (f *callFrame) Value() uint64 {
+	return f.value
+}
+
+// CheckWrite rejects state changes in a read-only execution
+func (f *callFrame) CheckWrite() error {
+	if !f.exec.readOnly {
+		return nil
+	}
+	if f.exec.writeErr == nil {
+		f.exec.writeErr = fmt.Errorf("%w: contract %s", ErrWriteInReadOnlyCall, f.contract)
+	}
+	return f.exec.writeErr
+}
+
+func (f *callFrame) Transfer(contract, from, to core.Address, amount uint64) error {
+	if err := f.CheckWrite(); err != nil {
+		return err
+	}
+	return f.BlockchainContext.Transfer(contract, from, to, amount)
+}
+
+func (f *callFrame) GetObject(contract core.Address, id core.ObjectID) (types.VMObject, error) {
+	obj, err := f.BlockchainContext.GetObject(contract, id)
+	if err != nil || !f.exec.readOnly {
+		return obj, err
+	}
+	return &readOnlyObject{VMObject: obj, frame: f}, nil
+}
+
+func (f *callFrame) GetObjectWithOwner(contract, owner core.Address) (types.VMObject, error) {
+	obj, err := f.BlockchainContext.GetObjectWithOwner(contract, owner)
+	if err != nil || !f.exec.readOnly {
+		return obj, err
+	}
+	return &readOnlyObject{VMObject: obj, frame: f}, nil
+}
+
+func (f *callFrame) CreateObject(contract core.Address) (types.VMObject, error) {
+	if err := f.CheckWrite(); err != nil {
+		return nil, err
+	}
+	obj, err := f.BlockchainContext.CreateObject(contract)
+	if err == nil {
+		f.exec.created = append(f.exec.created, obj.ID())
+	}
+	return obj, err
+}
+
+func (f *callFrame) CreateObjectWithID(contract core.Address, id core.ObjectID) (types.VMObject, error) {
+	if err := f.CheckWrite(); err != nil {
+		return nil, err
+	}
+	obj, err := f.BlockchainContext.CreateObjectWithID(contract, id)
+	if err == nil {
+		f.exec.created = append(f.exec.created, obj.ID())
+	}
+	return obj, err
+}
+
+func (f *callFrame) DeleteObject(contract core.Address, id core.ObjectID) error {
+	if err := f.CheckWrite(); err != nil {
+		return err
+	}
+	err := f.BlockchainContext.DeleteObject(contract, id)
+	if err == nil {
+		f.exec.deleted = append(f.exec.deleted, id)
+	}
+	return err
+}
+
+func (f *callFrame) Log(contract core.Address, eventName string, keyValues ...any) {
+	if f.CheckWrite() != nil {
+		return
+	}
+	f.BlockchainContext.Log(contract, eventName, keyValues...)
+	f.exec.logs = append(f.exec.logs, types.EventLog{Contract: contract, Event: eventName, KeyValues: keyValues})
+}
+
+// readOnlyObject is an object read in a read-only execution, its setters are rejected
+type readOnlyObject struct {
+	types.VMObject
+	frame *callFrame
+}
+
+func (o *readOnlyObject) SetOwner(contract, sender, addr core.Address) error {
+	return o.frame.CheckWrite()
+}
+
+func (o *readOnlyObject) Set(contract, sender core.Address, field string, value []byte) error {
+	return o.frame.CheckWrite()
+}
+
+// RecordOutput adds the output of a contract to the execution trace
+func (f *callFrame) RecordOutput(contract core.Address, output []byte) {
+	f.exec.trace = append(f.exec.trace, types.TraceEntry{Contract: contract, Output: string(output)})
+}
+
+// Call runs a nested contract call one level deeper in this frame's call stack
+func (f *callFrame) Call(caller core.Address, contract core.Address, function string, args ...any) ([]byte, error) {
+	return f.engine.call(f, caller, contract, function, args...)
+}
+
+// CallWithValue calls another contract, paying value from caller to it
+func (f *callFrame) CallWithValue(caller core.Address, contract core.Address, function string, value uint64, args ...any) ([]byte, error) {
+	return f.engine.callWithValue(f, caller, contract, function, value, args...)
+}
+
+// call executes a contract function on behalf of another contract.
+// It is installed as the call handler of the blockchain context, so a contract calling ctx.Call ends up here.
+// The callee runs with the gas currently left to the caller, and its state changes are reverted if it fails,
+// in which case all of that gas is spent.
+func (e *Engine) call(ctx types.BlockchainContext, caller core.Address, contract core.Address, function string, args ...any) ([]byte, error) {
+	return e.callWithValue(ctx, caller, contract, function, 0, args...)
+}
+
+// callWithValue executes a cross-contract call that pays value from caller to the callee, see run
+func (e *Engine) callWithValue(ctx types.BlockchainContext, caller core.Address, contract core.Address, function string, value uint64, args ...any) ([]byte, error) {
+	abiInfo, err := e.getABI(contract)
+	if err != nil {
+		return nil, err
+	}
+	argsBytes, err := abiInfo.EncodeArgs(function, args)
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := e.newFrame(ctx, caller, contract)
+	if err != nil {
+		return nil, err
+	}
+	frame.value = value
+	gasLimit := ctx.GetGas()
+	result, err := e.run(frame, function, argsBytes)
+	// The caller pays for the callee. A failed call, or one that didn't report its gas, costs all the gas it got,
+	// and the reported gas is kept within it, since unmetered contracts report their own.
+	gasUsed := gasLimit
+	if err == nil && result != nil {
+		gasUsed = min(max(result.GasUsed, 0), gasLimit)
+	}
+	ctx.SetGasLimit(gasLimit - gasUsed)
+	if err != nil {
+		return nil, err
+	}
+	// Functions without output have no result
+	if result == nil {
+		return nil, nil
+	}
+	return json.Marshal(result.Data)
+}
+
+// run executes a contract function inside the given frame.
+// The value of the frame is transferred from the sender to the contract first.
+// All state changes made by an unsuccessful execution are reverted, which refunds the value.
+func (e *Engine) run(frame *callFrame, function string, args []byte) (*types.ExecutionResult, error) {
+	if isDestroyed(frame.BlockchainContext, frame.contract) {
+		return nil, fmt.Errorf("%w: %s", ErrContractDestroyed, frame.contract)
+	}
+	if !frame.constructor && e.isConstructor(frame.contract, function) {
+		return nil, fmt.Errorf("%w: %s", ErrConstructorCall, frame.contract)
+	}
+	snapshot := frame.Snapshot()
+	mark := frame.exec.mark()
+
+	// The wall-clock timeout covers the whole call tree.
+	// Every call tree gets its own context, the native runtime tells its nested calls apart by it.
+	if frame.exec.ctx == nil {
+		runCtx, cancel := context.WithCancel(context.Background())
+		if e.config != nil && e.config.ExecutionTimeout > 0 {
+			runCtx, cancel = context.WithTimeout(runCtx, e.config.ExecutionTimeout)
+		}
+		defer cancel()
+		frame.exec.ctx = runCtx
+	}
+
+	// Pay the contract before it runs, so it can spend the value
+	if frame.value > 0 {
+		if err := frame.Transfer(frame.contract, frame.sender, frame.contract, frame.value); err != nil {
+			frame.RevertToSnapshot(snapshot)
+			return nil, fmt.Errorf("failed to pay value: %w", err)
+		}
+	}
+
+	// Execute contract function
+	var result *types.ExecutionResult
+	var err error
+	if e.native != nil && e.native.Has(frame.contract) {
+		result, err = e.native.Execute(frame.exec.ctx, frame, frame.contract, function, args)
+	} else {
+		result, err = e.runtime.Execute(frame.exec.ctx, frame, frame.contract, function, args)
+	}
+	if err == nil && result != nil && !result.Success {
+		err = fmt.Errorf("contract execution failed: %s", result.Error)
+	}
+	if result != nil {
+		result.Depth = frame.exec.maxDepth
+	}
+	// Surface a rejected nested call as the cause, the contract itself only sees a failed call.
+	// Only this frame's own calls count: callers that handled the failure don't report it.
+	if err != nil && frame.depthErr != nil && !errors.Is(err, ErrCallDepthExceeded) {
+		err = fmt.Errorf("%w: %v", frame.depthErr, err)
+	}
+	// A rejected write fails the query even if the contract ignored the error
+	if frame.exec.writeErr != nil && !errors.Is(err, ErrWriteInReadOnlyCall) {
+		if err == nil {
+			err = frame.exec.writeErr
+		} else {
+			err = fmt.Errorf("%w: %v", frame.exec.writeErr, err)
+		}
+	}
+	if err != nil {
+		frame.exec.rollback(mark)
+		if rerr := frame.RevertToSnapshot(snapshot); rerr != nil {
+			return result, fmt.Errorf("failed to revert state: %v, after: %w", rerr, err)
+		}
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/govm-net/vm/abi"
+	"github.com/govm-net/vm/core"
+)
+
+// ErrConstructorCall is returned when the constructor of a contract is called after its deployment
+var ErrConstructorCall = errors.New("constructor can only run at deployment")
+
+// constructorArgs encodes the arguments of the constructor, before anything is deployed.
+// Contracts without a constructor take no arguments.
+func constructorArgs(abiInfo *abi.ABI, args []any) ([]byte, error) {
+	if abiInfo.Constructor == "" {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("contract has no constructor, got %d arguments", len(args))
+		}
+		return nil, nil
+	}
+	return abiInfo.EncodeArgs(abiInfo.Constructor, args)
+}
+
+// completeDeploy saves the ABI of a contract whose code was deployed after snapshot, and runs its constructor.
+// The state changes of the deployment are committed once it succeeded, and reverted otherwise.
+func (e *Engine) completeDeploy(contractAddr core.Address, abiInfo *abi.ABI, args []byte, snapshot int) error {
+	e.abiLock.Lock()
+	err := e.saveABI(contractAddr, abiInfo)
+	e.abiLock.Unlock()
+	if err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return err
+	}
+	if err := e.construct(contractAddr, abiInfo, args, snapshot); err != nil {
+		return err
+	}
+	if err := e.ctx.CommitSnapshot(snapshot); err != nil {
+		return fmt.Errorf("failed to commit state: %w", err)
+	}
+	return nil
+}
+
+// construct runs the constructor of a contract that was just deployed, with the deployer as sender.
+// If it fails, the deployment is undone: the contract is removed and the state reverted to snapshot.
+func (e *Engine) construct(contractAddr core.Address, abiInfo *abi.ABI, args []byte, snapshot int) error {
+	if abiInfo.Constructor == "" {
+		return nil
+	}
+	frame, err := e.newFrame(e.ctx, e.ctx.Sender(), contractAddr)
+	if err == nil {
+		frame.constructor = true
+		_, err = e.run(frame, abiInfo.Constructor, args)
+	}
+	if err == nil {
+		e.removeDestroyed(frame.exec)
+		return nil
+	}
+
+	e.DeleteContract(contractAddr)
+	if rerr := e.ctx.RevertToSnapshot(snapshot); rerr != nil {
+		return fmt.Errorf("failed to revert state: %v, after constructor failed: %w", rerr, err)
+	}
+	return fmt.Errorf("constructor failed: %w", err)
+}
+
+// isConstructor reports whether function is the constructor of a deployed contract
+func (e *Engine) isConstructor(contractAddr core.Address, function string) bool {
+	abiInfo, err := e.getABI(contractAddr)
+	return err == nil && abiInfo.Constructor != "" && abiInfo.Constructor == function
+}
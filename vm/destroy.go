@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// ErrContractDestroyed is returned when a destroyed contract is called, or its address is deployed to again
+// without Config.AllowRedeploy
+var ErrContractDestroyed = errors.New("contract destroyed")
+
+// tombstoneID is the ID of the object that marks a destroyed contract.
+// It is part of the state, so the address stays destroyed after a restart and on every node.
+func tombstoneID(contractAddr core.Address) core.ObjectID {
+	return core.ObjectID(sha256.Sum256(append([]byte("tombstone:"), contractAddr[:]...)))
+}
+
+// isDestroyed reports whether the contract at contractAddr was destroyed
+func isDestroyed(ctx types.BlockchainContext, contractAddr core.Address) bool {
+	_, err := ctx.GetObject(contractAddr, tombstoneID(contractAddr))
+	return err == nil
+}
+
+// destroyState sends the balance of a contract to beneficiary, deletes all its objects and marks it as destroyed.
+// It returns the IDs of the deleted objects, and changes nothing if it fails.
+func destroyState(ctx types.BlockchainContext, contractAddr, beneficiary core.Address) ([]core.ObjectID, error) {
+	if beneficiary == contractAddr {
+		return nil, fmt.Errorf("beneficiary can't be the destroyed contract")
+	}
+	snapshot := ctx.Snapshot()
+	ids, err := func() ([]core.ObjectID, error) {
+		if balance := ctx.Balance(contractAddr); balance > 0 {
+			if err := ctx.Transfer(contractAddr, contractAddr, beneficiary, balance); err != nil {
+				return nil, fmt.Errorf("failed to transfer balance: %w", err)
+			}
+		}
+		ids, err := ctx.DeleteContractObjects(contractAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete contract objects: %w", err)
+		}
+		if _, err := ctx.CreateObjectWithID(contractAddr, tombstoneID(contractAddr)); err != nil {
+			return nil, fmt.Errorf("failed to mark contract as destroyed: %w", err)
+		}
+		return ids, nil
+	}()
+	if err != nil {
+		if rerr := ctx.RevertToSnapshot(snapshot); rerr != nil {
+			return nil, fmt.Errorf("failed to revert state: %v, after: %w", rerr, err)
+		}
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SelfDestruct destroys the contract running in this frame.
+// Its state is destroyed right away and reverted if the call fails, its code is removed once the execution succeeded.
+func (f *callFrame) SelfDestruct(contract, beneficiary core.Address) error {
+	if err := f.CheckWrite(); err != nil {
+		return err
+	}
+	if contract != f.contract {
+		return fmt.Errorf("contract %s can't destroy contract %s", f.contract, contract)
+	}
+	ids, err := destroyState(f.BlockchainContext, contract, beneficiary)
+	if err != nil {
+		return err
+	}
+	f.exec.deleted = append(f.exec.deleted, ids...)
+	f.exec.destroyed = append(f.exec.destroyed, contract)
+	return nil
+}
+
+// removeDestroyed removes the code of the contracts that destroyed themselves in a successful execution
+func (e *Engine) removeDestroyed(exec *execution) {
+	for _, contractAddr := range exec.destroyed {
+		e.DeleteContract(contractAddr)
+	}
+}
+
+// DestroyContract destroys a deployed contract: its balance is sent to beneficiary, its objects are deleted,
+// and its code, WASM and ABI are removed. Contracts can also destroy themselves, see core.SelfDestruct.
+// The address is marked as destroyed in the state, calls to it fail with ErrContractDestroyed,
+// and it can only be deployed to again if Config.AllowRedeploy is set.
+func (e *Engine) DestroyContract(contractAddr, beneficiary core.Address) error {
+	if _, err := e.getABI(contractAddr); err != nil {
+		return fmt.Errorf("contract not found: %w", err)
+	}
+	if isDestroyed(e.ctx, contractAddr) {
+		return fmt.Errorf("%w: %s", ErrContractDestroyed, contractAddr)
+	}
+	snapshot := e.ctx.Snapshot()
+	if _, err := destroyState(e.ctx, contractAddr, beneficiary); err != nil {
+		return fmt.Errorf("failed to destroy contract: %w", err)
+	}
+	if err := e.ctx.CommitSnapshot(snapshot); err != nil {
+		return fmt.Errorf("failed to commit state: %w", err)
+	}
+	e.DeleteContract(contractAddr)
+	return nil
+}
+
+// checkRedeploy refuses to deploy to the address of a destroyed contract unless Config.AllowRedeploy is set
+func (e *Engine) checkRedeploy(contractAddr core.Address) error {
+	if !isDestroyed(e.ctx, contractAddr) || e.config.AllowRedeploy {
+		return nil
+	}
+	return fmt.Errorf("%w: %s, redeployment is not allowed", ErrContractDestroyed, contractAddr)
+}
+
+// clearTombstone removes the destroyed mark of an address that is deployed to again
+func (e *Engine) clearTombstone(contractAddr core.Address) error {
+	if !isDestroyed(e.ctx, contractAddr) {
+		return nil
+	}
+	if err := e.ctx.DeleteObject(contractAddr, tombstoneID(contractAddr)); err != nil {
+		return fmt.Errorf("failed to clear destroyed contract: %w", err)
+	}
+	return nil
+}
@@ -2,15 +2,19 @@ package vm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/govm-net/vm/abi"
 	"github.com/govm-net/vm/api"
 	"github.com/govm-net/vm/compiler"
 	"github.com/govm-net/vm/context"
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/native"
 	"github.com/govm-net/vm/repository"
 	"github.com/govm-net/vm/types"
 	"github.com/govm-net/vm/wasi"
@@ -18,13 +22,32 @@ import (
 
 // Engine is responsible for contract deployment and execution
 type Engine struct {
-	config        *Config
-	maker         *compiler.Maker
-	wazero_engine *wasi.WazeroVM
-	codeManager   *repository.Manager
-	ctx           types.BlockchainContext // Blockchain context
+	config      *Config
+	maker       *compiler.Maker
+	runtime     wasi.Runtime    // Runs deployed contracts, chosen by Config.Runtime
+	native      *native.Runtime // Contracts linked into the host, see DeployNative
+	codeManager *repository.Manager
+	ctx         types.BlockchainContext // Blockchain context
+
+	// Maximum depth of nested contract calls
+	maxCallDepth int
+	// Gas limit of transactions that don't set one
+	maxGas int64
+
+	// Parsed ABIs of deployed contracts
+	abis    map[core.Address]*abi.ABI
+	abiLock sync.RWMutex
+
+	// Decides who may upgrade contracts, upgrades are refused when nil
+	upgradeAuth UpgradeAuthorizer
 }
 
+// UpgradeAuthorizer decides whether sender may upgrade the code of contract, returning an error if not
+type UpgradeAuthorizer func(ctx types.BlockchainContext, contract, sender core.Address) error
+
+// ErrUpgradeNotAuthorized is returned when a contract upgrade is refused
+var ErrUpgradeNotAuthorized = errors.New("contract upgrade not authorized")
+
 // Config represents engine configuration
 type Config struct {
 	// Contract related configuration
@@ -33,8 +56,22 @@ type Config struct {
 	CodeManagerDir   string         // Code manager storage directory
 	ContextType      string         // Blockchain context type
 	ContextParams    map[string]any // Blockchain context parameters
+	GasMetering      bool           // Meter gas on the host by instrumenting contract WASM code
+	ExecutionTimeout time.Duration  // Wall-clock limit of one execution including nested calls, 0 for none
+	DeterministicEnv bool           // Derive WASI clocks and randomness from the block and capture contract output
+	Debug            bool           // Let contracts print core.Debug output into the execution trace
+	Runtime          string         // Contract runtime, one of the Runtime* constants, RuntimeWazero if empty
+	AllowRedeploy    bool           // Allow deploying to the address of a destroyed contract, see DestroyContract
 }
 
+// Contract runtimes of Config.Runtime
+const (
+	RuntimeWazero      = "wazero"      // wazero, compiling contracts where supported and interpreting them elsewhere
+	RuntimeCompiler    = "compiler"    // wazero compiling contracts to machine code
+	RuntimeInterpreter = "interpreter" // wazero interpreting contracts
+	RuntimeNative      = "native"      // Go contracts linked into the host, see native.Register
+)
+
 // NewEngine creates a new contract engine
 func NewEngine(config *Config) (*Engine, error) {
 	// Ensure configuration is valid
@@ -52,10 +89,11 @@ func NewEngine(config *Config) (*Engine, error) {
 	contractConfig.MaxCodeSize = uint64(config.MaxContractSize)
 	maker := compiler.NewMaker(contractConfig)
 
-	// Create WazeroEngine instance
-	wazero_engine, err := wasi.NewWazeroVM(config.WASIContractsDir)
+	// Create contract runtime
+	nativeRuntime := native.NewRuntime().WithDebug(config.Debug)
+	runtime, err := newRuntime(config, contractConfig, nativeRuntime)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create wazero engine: %w", err)
+		return nil, err
 	}
 
 	// Create code manager
@@ -68,17 +106,30 @@ func NewEngine(config *Config) (*Engine, error) {
 		return nil, fmt.Errorf("failed to get default context: %w", err)
 	}
 
-	return &Engine{
-		config:        config,
-		maker:         maker,
-		wazero_engine: wazero_engine,
-		codeManager:   codeManager,
-		ctx:           ctx,
-	}, nil
+	e := &Engine{
+		config:       config,
+		maker:        maker,
+		runtime:      runtime,
+		native:       nativeRuntime,
+		codeManager:  codeManager,
+		ctx:          ctx,
+		maxCallDepth: int(contractConfig.MaxCallDepth),
+		maxGas:       int64(contractConfig.MaxGas),
+		abis:         make(map[core.Address]*abi.ABI),
+	}
+	ctx.SetCallHandler(e.call)
+	return e, nil
 }
 
 func (e *Engine) WithContext(ctx types.BlockchainContext) *Engine {
 	e.ctx = ctx
+	ctx.SetCallHandler(e.call)
+	return e
+}
+
+// WithUpgradeAuthorizer sets the hook that decides who may upgrade contracts
+func (e *Engine) WithUpgradeAuthorizer(auth UpgradeAuthorizer) *Engine {
+	e.upgradeAuth = auth
 	return e
 }
 
@@ -100,132 +151,500 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("WASI contracts directory is empty")
 	}
 
+	switch config.Runtime {
+	case "", RuntimeWazero, RuntimeCompiler, RuntimeInterpreter, RuntimeNative:
+	default:
+		return fmt.Errorf("unknown runtime: %s", config.Runtime)
+	}
+
 	return nil
 }
 
-// DeployContractWithAddress deploys a contract with specified address
-func (e *Engine) DeployContractWithAddress(code []byte, contractAddr core.Address) error {
+// DeployContractWithAddress deploys a contract with specified address.
+// If the contract has a constructor, it runs with args as part of the deployment, see DeployContract.
+func (e *Engine) DeployContractWithAddress(code []byte, contractAddr core.Address, args ...any) error {
+	return e.DeployContractFilesWithAddress(map[string][]byte{"contract.go": code}, contractAddr, args...)
+}
+
+// DeployContractFiles deploys a contract package made of several files, by file name, see DeployContract.
+// The files must belong to the same package, the ABI is extracted across all of them.
+// The address is derived from all files and the sender of the current context.
+func (e *Engine) DeployContractFiles(files map[string][]byte, args ...any) (core.Address, error) {
+	if len(files) == 1 {
+		// Single file contracts get the same address as with DeployContract
+		for _, code := range files {
+			return e.DeployContract(code, args...)
+		}
+	}
+	hash := repository.HashFiles(files)
+	contractAddr := api.DefaultContractAddressGenerator(hash[:], e.ctx.Sender())
+	return contractAddr, e.DeployContractFilesWithAddress(files, contractAddr, args...)
+}
+
+// DeployContractFilesWithAddress deploys a contract package made of several files with specified address,
+// see DeployContractWithAddress.
+func (e *Engine) DeployContractFilesWithAddress(files map[string][]byte, contractAddr core.Address, args ...any) error {
+	if err := e.checkRedeploy(contractAddr); err != nil {
+		return err
+	}
+
 	// Validate contract code
-	if err := e.maker.ValidateContract(code); err != nil {
+	if err := e.validate(files); err != nil {
 		return fmt.Errorf("contract validation failed: %w", err)
 	}
 
-	// Save contract code, add gas consumption
-	err := e.codeManager.RegisterCode(contractAddr, code)
+	// Parse contract code to get ABI information
+	abi, err := abi.ExtractABIFromFiles(files)
 	if err != nil {
-		return fmt.Errorf("failed to save contract code: %w", err)
+		return fmt.Errorf("failed to parse contract ABI: %w", err)
+	}
+	argsBytes, err := constructorArgs(abi, args)
+	if err != nil {
+		return err
 	}
 
-	// Parse contract code to get ABI information
-	abi, err := abi.ExtractABI(code)
+	// Save contract code, add gas consumption
+	err = e.codeManager.RegisterFiles(contractAddr, files)
 	if err != nil {
-		return fmt.Errorf("failed to parse contract ABI: %w", err)
+		return fmt.Errorf("failed to save contract code: %w", err)
 	}
+
 	// If there are no external functions in ABI, no need to compile to wasm, it might just be a public module
 	if len(abi.Functions) == 0 {
 		return nil
 	}
 
 	// Add gas consumption
-	code, err = e.codeManager.GetInjectedCode(contractAddr)
+	code, err := e.codeManager.GetCode(contractAddr)
 	if err != nil {
 		return fmt.Errorf("failed to get contract code: %w", err)
 	}
 
 	// Compile contract
-	wasmCode, err := e.maker.CompileContract(code)
+	wasmCode, err := e.compile(code.InjectedSources())
 	if err != nil {
 		return fmt.Errorf("contract compilation failed: %w", err)
 	}
 
 	// Deploy contract
-	_, err = e.wazero_engine.DeployContractWithAddress(e.ctx, wasmCode, core.ZeroAddress, contractAddr)
+	snapshot := e.ctx.Snapshot()
+	if err := e.clearTombstone(contractAddr); err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return err
+	}
+	_, err = e.runtime.DeployContractWithAddress(e.ctx, wasmCode, core.ZeroAddress, contractAddr)
+	if err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return fmt.Errorf("contract deployment failed: %w", err)
+	}
+	return e.completeDeploy(contractAddr, abi, argsBytes, snapshot)
+}
+
+// DeployWasm deploys a prebuilt WASM contract together with its ABI, for contracts not built from Go source by the engine.
+// The address is derived from the code and the sender of the current context.
+func (e *Engine) DeployWasm(wasmCode []byte, abiJSON []byte, args ...any) (core.Address, error) {
+	contractAddr := api.DefaultContractAddressGenerator(wasmCode, e.ctx.Sender())
+	return contractAddr, e.DeployWasmWithAddress(wasmCode, abiJSON, contractAddr, args...)
+}
+
+// DeployWasmWithAddress deploys a prebuilt WASM contract with its ABI at the specified address.
+// The module must only import host functions and export the functions the host calls, see wasi.WazeroVM.ValidateModule.
+func (e *Engine) DeployWasmWithAddress(wasmCode []byte, abiJSON []byte, contractAddr core.Address, args ...any) error {
+	wazeroVM, ok := e.runtime.(*wasi.WazeroVM)
+	if !ok {
+		return fmt.Errorf("runtime %s can't run WASM contracts", e.config.Runtime)
+	}
+	if err := e.checkRedeploy(contractAddr); err != nil {
+		return err
+	}
+	if uint64(len(wasmCode)) > e.config.MaxContractSize {
+		return fmt.Errorf("contract size exceeds maximum allowed size of %d bytes", e.config.MaxContractSize)
+	}
+
+	var abiInfo abi.ABI
+	if err := json.Unmarshal(abiJSON, &abiInfo); err != nil {
+		return fmt.Errorf("failed to parse contract ABI: %w", err)
+	}
+	if len(abiInfo.Functions) == 0 {
+		return fmt.Errorf("contract ABI has no functions")
+	}
+	argsBytes, err := constructorArgs(&abiInfo, args)
 	if err != nil {
+		return err
+	}
+	if err := wazeroVM.ValidateModule(wasmCode); err != nil {
+		return fmt.Errorf("contract validation failed: %w", err)
+	}
+
+	snapshot := e.ctx.Snapshot()
+	if err := e.clearTombstone(contractAddr); err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return err
+	}
+	if _, err := wazeroVM.DeployContractWithAddress(e.ctx, wasmCode, core.ZeroAddress, contractAddr); err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
 		return fmt.Errorf("contract deployment failed: %w", err)
 	}
+	return e.completeDeploy(contractAddr, &abiInfo, argsBytes, snapshot)
+}
 
+// DeployNative deploys a contract that is linked into the host and runs in native mode.
+// source is the contract code the ABI is extracted from, handlers are the generated NativeHandlers of its package.
+// Native contracts are not compiled or stored, they are only known to this engine, but they read and change
+// state exactly like WASM contracts and can call and be called by them.
+func (e *Engine) DeployNative(contractAddr core.Address, source []byte, handlers map[string]native.Handler, args ...any) error {
+	if err := e.checkRedeploy(contractAddr); err != nil {
+		return err
+	}
+	abiInfo, err := abi.ExtractABI(source)
+	if err != nil {
+		return fmt.Errorf("failed to parse contract ABI: %w", err)
+	}
+	for _, fn := range abiInfo.Functions {
+		if _, ok := handlers[fn.Name]; !ok {
+			return fmt.Errorf("no handler for function %s", fn.Name)
+		}
+	}
+	argsBytes, err := constructorArgs(abiInfo, args)
+	if err != nil {
+		return err
+	}
+
+	snapshot := e.ctx.Snapshot()
+	if err := e.clearTombstone(contractAddr); err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return err
+	}
+	if err := e.native.Deploy(e.ctx, contractAddr, handlers); err != nil {
+		e.ctx.RevertToSnapshot(snapshot)
+		return fmt.Errorf("contract deployment failed: %w", err)
+	}
+	return e.completeDeploy(contractAddr, abiInfo, argsBytes, snapshot)
+}
+
+// saveABI writes the ABI file of a contract and caches it, abiLock must be held
+func (e *Engine) saveABI(contractAddr core.Address, abiInfo *abi.ABI) error {
 	// Convert ABI to JSON
-	abiJSON, err := json.MarshalIndent(abi, "", "  ")
+	abiJSON, err := json.MarshalIndent(abiInfo, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal ABI: %w", err)
 	}
 
-	// Save contract ABI file
-	abiPath := filepath.Join(e.config.WASIContractsDir, fmt.Sprintf("%x.abi", contractAddr))
-	if err := os.WriteFile(abiPath, abiJSON, 0644); err != nil {
+	// Save contract ABI file, renamed into place so it is never seen half written
+	if err := replaceFile(e.abiPath(contractAddr), abiJSON); err != nil {
 		return fmt.Errorf("failed to save contract ABI: %w", err)
 	}
 
+	e.abis[contractAddr] = abiInfo
+	return nil
+}
+
+// abiPath returns the path of the ABI file of a contract
+func (e *Engine) abiPath(contractAddr core.Address) string {
+	return filepath.Join(e.config.WASIContractsDir, fmt.Sprintf("%x.abi", contractAddr))
+}
+
+// replaceFile writes a file through a temporary file renamed into place, so it is never seen half written
+func replaceFile(path string, data []byte) error {
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
 	return nil
 }
 
-// DeployContract deploys a contract
-func (e *Engine) DeployContract(code []byte) (core.Address, error) {
+// UpgradeContract replaces the code of a deployed contract, keeping its address and state objects.
+// The upgrade must be allowed by the authorizer set with WithUpgradeAuthorizer, the sender of the current context is checked.
+// The new code is compiled before anything is replaced, and the code, WASM and ABI are then swapped together:
+// if any of them can't be replaced, the contract keeps running its previous version.
+// The new code is a set of files by file name like for DeployContractFiles, a contract can be upgraded from
+// a single file to several files and back. Destroyed contracts can't be upgraded.
+func (e *Engine) UpgradeContract(contractAddr core.Address, files map[string][]byte) error {
+	if e.upgradeAuth == nil {
+		return fmt.Errorf("%w: no upgrade authorizer configured", ErrUpgradeNotAuthorized)
+	}
+	if err := e.upgradeAuth(e.ctx, contractAddr, e.ctx.Sender()); err != nil {
+		return fmt.Errorf("%w: %v", ErrUpgradeNotAuthorized, err)
+	}
+	if isDestroyed(e.ctx, contractAddr) {
+		return fmt.Errorf("%w: %s", ErrContractDestroyed, contractAddr)
+	}
+
+	// Validate contract code
+	if err := e.validate(files); err != nil {
+		return fmt.Errorf("contract validation failed: %w", err)
+	}
+	abiInfo, err := abi.ExtractABIFromFiles(files)
+	if err != nil {
+		return fmt.Errorf("failed to parse contract ABI: %w", err)
+	}
+	if len(abiInfo.Functions) == 0 {
+		return fmt.Errorf("upgraded contract has no exported functions")
+	}
+
+	code, err := e.codeManager.PrepareUpgrade(contractAddr, files)
+	if err != nil {
+		return fmt.Errorf("failed to save contract code: %w", err)
+	}
+
+	// Compile contract
+	wasmCode, err := e.compile(code.InjectedSources())
+	if err != nil {
+		return fmt.Errorf("contract compilation failed: %w", err)
+	}
+
+	e.abiLock.Lock()
+	defer e.abiLock.Unlock()
+	return e.swapCode(contractAddr, code.Version, wasmCode, abiInfo)
+}
+
+// swapCode makes a prepared version the current code of a contract, replacing its WASM and ABI with it.
+// The new ABI is written before anything is replaced, and every step is undone if a later one fails.
+// The version is activated last, so a failed upgrade leaves no trace in the version history. abiLock must be held.
+func (e *Engine) swapCode(contractAddr core.Address, version int, wasmCode []byte, abiInfo *abi.ABI) error {
+	previousCode, err := e.runtime.Code(contractAddr)
+	if err != nil {
+		return fmt.Errorf("failed to get contract code: %w", err)
+	}
+	abiPath := e.abiPath(contractAddr)
+	previousABI, err := os.ReadFile(abiPath)
+	if err != nil {
+		return fmt.Errorf("failed to read contract ABI: %w", err)
+	}
+	abiJSON, err := json.MarshalIndent(abiInfo, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal ABI: %w", err)
+	}
+	if err := os.WriteFile(abiPath+".tmp", abiJSON, 0644); err != nil {
+		return fmt.Errorf("failed to save contract ABI: %w", err)
+	}
+	defer os.Remove(abiPath + ".tmp")
+
+	if err := e.runtime.UpgradeContract(contractAddr, wasmCode); err != nil {
+		return fmt.Errorf("contract deployment failed: %w", err)
+	}
+	err = os.Rename(abiPath+".tmp", abiPath)
+	if err != nil {
+		err = fmt.Errorf("failed to save contract ABI: %w", err)
+	} else if err = e.codeManager.ActivateVersion(contractAddr, version); err != nil {
+		if rerr := replaceFile(abiPath, previousABI); rerr != nil {
+			err = fmt.Errorf("failed to restore contract ABI: %v, after: %w", rerr, err)
+		}
+	}
+	if err != nil {
+		if rerr := e.runtime.UpgradeContract(contractAddr, previousCode); rerr != nil {
+			return fmt.Errorf("failed to restore contract code: %v, after: %w", rerr, err)
+		}
+		return err
+	}
+
+	e.abis[contractAddr] = abiInfo
+	return nil
+}
+
+// DeployContract deploys a contract.
+// A contract with a constructor (an exported function marked with abi.ConstructorDirective) runs it with args right after
+// the code is deployed, with the sender of the current context as sender. If the constructor fails the deployment
+// is undone, and the constructor can't be called afterwards.
+func (e *Engine) DeployContract(code []byte, args ...any) (core.Address, error) {
 	contractAddr := api.DefaultContractAddressGenerator(code, e.ctx.Sender())
-	return contractAddr, e.DeployContractWithAddress(code, contractAddr)
+	return contractAddr, e.DeployContractWithAddress(code, contractAddr, args...)
 }
 
+// DeleteContract removes the code of a contract: its WASM, ABI and stored source.
+// Its state is kept, use DestroyContract to remove the contract for good.
 func (e *Engine) DeleteContract(contractAddr core.Address) {
-	e.wazero_engine.DeleteContract(e.ctx, contractAddr)
+	e.abiLock.Lock()
+	delete(e.abis, contractAddr)
+	os.Remove(e.abiPath(contractAddr))
+	e.abiLock.Unlock()
+	e.native.Delete(contractAddr)
+	e.runtime.DeleteContract(e.ctx, contractAddr)
+	e.codeManager.DeleteCode(contractAddr)
 }
 
-// ExecuteContract executes a contract function
-func (e *Engine) ExecuteContract(contractAddr core.Address, function string, args ...interface{}) (interface{}, error) {
+// getABI returns the ABI of a deployed contract, loading it from the ABI file on first use
+func (e *Engine) getABI(contractAddr core.Address) (*abi.ABI, error) {
+	e.abiLock.RLock()
+	abiInfo, ok := e.abis[contractAddr]
+	e.abiLock.RUnlock()
+	if ok {
+		return abiInfo, nil
+	}
+
 	// Read contract ABI file
-	abiPath := filepath.Join(e.config.WASIContractsDir, fmt.Sprintf("%x.abi", contractAddr))
+	abiPath := e.abiPath(contractAddr)
 	abiData, err := os.ReadFile(abiPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read contract ABI: %w", err)
 	}
 
 	// Parse ABI JSON
-	var abiInfo abi.ABI
-	if err := json.Unmarshal(abiData, &abiInfo); err != nil {
+	abiInfo = &abi.ABI{}
+	if err := json.Unmarshal(abiData, abiInfo); err != nil {
 		return nil, fmt.Errorf("failed to parse ABI JSON: %w", err)
 	}
-	var funcInfo abi.Function
-	for _, fn := range abiInfo.Functions {
-		if fn.Name == function {
-			funcInfo = fn
-			break
+
+	e.abiLock.Lock()
+	e.abis[contractAddr] = abiInfo
+	e.abiLock.Unlock()
+	return abiInfo, nil
+}
+
+// ExecuteContract executes a contract function and returns its result as the types of the function outputs,
+// see abi.ABI.DecodeResult.
+// args are positional or a single map[string]any by parameter name, and are converted to the parameter types
+// of the contract ABI, see abi.ABI.EncodeArgs.
+func (e *Engine) ExecuteContract(contractAddr core.Address, function string, args ...interface{}) (interface{}, error) {
+	abiInfo, err := e.getABI(contractAddr)
+	if err != nil {
+		return nil, err
+	}
+	argsBytes, err := abiInfo.EncodeArgs(function, args)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := e.ExecuteWithResult(contractAddr, function, argsBytes)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	data := result.RawData
+	if data == nil {
+		if data, err = json.Marshal(result.Data); err != nil {
+			return nil, fmt.Errorf("failed to marshal result: %w", err)
 		}
 	}
+	return abiInfo.DecodeResult(function, data)
+}
+
+// DecodeResult converts the result of a contract function to the types of its outputs, see abi.ABI.DecodeResult.
+// Pass Receipt.RawData rather than Receipt.Data for receipts, large integers in Data are already rounded.
+func (e *Engine) DecodeResult(contractAddr core.Address, function string, data any) (any, error) {
+	abiInfo, err := e.getABI(contractAddr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return abiInfo.DecodeResult(function, raw)
+}
 
-	// Verify if function exists
-	if funcInfo.Name == "" {
-		return nil, fmt.Errorf("function %s not found in contract", function)
+// ExecuteContract executes a contract function with raw parameters, parameters are json.marshal(map[string]any)
+// All state changes made by an unsuccessful execution are reverted.
+func (e *Engine) Execute(contractAddr core.Address, function string, args []byte) (interface{}, error) {
+	result, err := e.ExecuteWithResult(contractAddr, function, args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
 	}
-	fArgs := funcInfo.Inputs
+	return result.Data, nil
+}
 
-	params := make(map[string]interface{})
-	// If the first parameter is core.Context and input length is less than required parameters, add nil as first parameter, otherwise match error
-	if len(fArgs) > len(args) && fArgs[0].Type == "core.Context" {
-		args = append([]any{nil}, args...)
+// ExecuteWithResult is like Execute, but returns the full execution result, including gas used and call depth reached.
+// The result is also returned with the error when the contract itself failed.
+// The value of the transaction in the context is paid to the contract, see core.Value.
+func (e *Engine) ExecuteWithResult(contractAddr core.Address, function string, args []byte) (*types.ExecutionResult, error) {
+	frame, err := e.newFrame(e.ctx, e.ctx.Sender(), contractAddr)
+	if err != nil {
+		return nil, err
+	}
+	frame.value = e.ctx.Value()
+	snapshot := e.ctx.Snapshot()
+	result, err := e.run(frame, function, args)
+	if err == nil {
+		e.removeDestroyed(frame.exec)
 	}
-	// Convert parameters to map
-	for i, arg := range args {
-		params[fArgs[i].Name] = arg
+	// A failed execution was already reverted, committing only releases its snapshot
+	if cerr := e.ctx.CommitSnapshot(snapshot); cerr != nil && err == nil {
+		return result, fmt.Errorf("failed to commit state: %w", cerr)
+	}
+	return result, err
+}
+
+// ExecuteTx executes a contract function as a transaction and returns its receipt.
+// The value of the transaction is paid from the sender to the contract before it runs.
+// A failed execution is reverted, refunding the value, and reported through the receipt status and revert reason,
+// the error is only set when the receipt itself can't be produced or persisted.
+// An execution stopped by Config.ExecutionTimeout fails with ErrExecutionTimeout as its revert reason.
+// Contexts implementing types.ReceiptStore persist the receipt.
+func (e *Engine) ExecuteTx(contractAddr core.Address, function string, args []byte) (*types.Receipt, error) {
+	receipt := &types.Receipt{
+		TxHash:      e.ctx.TransactionHash(),
+		BlockHeight: e.ctx.BlockHeight(),
+		Contract:    contractAddr,
+		Function:    function,
 	}
 
-	// Convert parameters to JSON
-	argsBytes, err := json.Marshal(params)
+	gasBefore := e.ctx.GetGas()
+	frame, err := e.newFrame(e.ctx, e.ctx.Sender(), contractAddr)
+	if err != nil {
+		return nil, err
+	}
+	frame.value = e.ctx.Value()
+	snapshot := e.ctx.Snapshot()
+	result, err := e.run(frame, function, args)
+	if result != nil {
+		receipt.GasUsed = result.GasUsed
+	} else {
+		receipt.GasUsed = gasBefore - e.ctx.GetGas()
+	}
+	receipt.Trace = frame.exec.trace
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal function arguments: %w", err)
+		receipt.Status = types.ReceiptStatusFailed
+		receipt.RevertReason = err.Error()
+	} else {
+		receipt.Status = types.ReceiptStatusSuccess
+		e.removeDestroyed(frame.exec)
+		if result != nil {
+			receipt.Data = result.Data
+			receipt.RawData = result.RawData
+		}
+		receipt.Logs = frame.exec.logs
+		receipt.CreatedObjects = frame.exec.created
+		receipt.DeletedObjects = frame.exec.deleted
 	}
 
-	return e.Execute(contractAddr, function, argsBytes)
+	// The receipt is saved with the state changes of the transaction, none of them are kept without the other
+	if store, ok := e.ctx.(types.ReceiptStore); ok {
+		if err := store.SaveReceipt(receipt); err != nil {
+			if rerr := e.ctx.RevertToSnapshot(snapshot); rerr != nil {
+				return receipt, fmt.Errorf("failed to revert state: %v, after failing to save receipt: %w", rerr, err)
+			}
+			return receipt, fmt.Errorf("failed to save receipt: %w", err)
+		}
+	}
+	if err := e.ctx.CommitSnapshot(snapshot); err != nil {
+		return receipt, fmt.Errorf("failed to commit state: %w", err)
+	}
+	return receipt, nil
 }
 
-// ExecuteContract executes a contract function with raw parameters, parameters are json.marshal(map[string]any)
-func (e *Engine) Execute(contractAddr core.Address, function string, args []byte) (interface{}, error) {
-	// Execute contract function
-	return e.wazero_engine.ExecuteContract(e.ctx, contractAddr, function, args)
+// Query executes a contract function as a read-only (static) call and returns its result.
+// Transfers, object changes and logs fail with ErrWriteInReadOnlyCall, also in nested calls,
+// and nothing is persisted even on success: it runs on a throwaway copy of the state, see dryRun.
+func (e *Engine) Query(contractAddr core.Address, function string, args []byte) (interface{}, error) {
+	result, err := e.dryRun(contractAddr, function, args, e.ctx.Sender(), 0, e.ctx.GetGas(), true)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return result.Data, nil
 }
 
 // Close closes the engine
 func (e *Engine) Close() error {
-	if err := e.wazero_engine.Close(); err != nil {
-		return fmt.Errorf("failed to close wazero engine: %w", err)
+	if err := e.runtime.Close(); err != nil {
+		return fmt.Errorf("failed to close contract runtime: %w", err)
 	}
 	return nil
 }
@@ -1,15 +1,24 @@
 package vm
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	_ "github.com/govm-net/vm/context/db"
 	"github.com/govm-net/vm/context/memory"
 	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/native"
+	"github.com/govm-net/vm/types"
 )
 
 //go:embed testdata/counter_contract.go
@@ -200,3 +209,1182 @@ func TestEngine_DeployAndExecuteContract2(t *testing.T) {
 	}
 
 }
+
+func TestCallDepthLimit(t *testing.T) {
+	engine := &Engine{maxCallDepth: 3}
+	ctx := memory.NewBlockchainContext(nil)
+
+	a := core.Address{0x01}
+	b := core.Address{0x02}
+
+	// Top-level execution starts at depth 1, every nested call adds one
+	frame, err := engine.newFrame(ctx, a, b)
+	if err != nil {
+		t.Fatalf("newFrame() error = %v", err)
+	}
+	for depth := 2; depth <= 3; depth++ {
+		caller := frame.contract
+		frame, err = engine.newFrame(frame, caller, core.Address{byte(depth)})
+		if err != nil {
+			t.Fatalf("newFrame() depth %d error = %v", depth, err)
+		}
+		if frame.depth != depth {
+			t.Fatalf("frame depth = %d, want %d", frame.depth, depth)
+		}
+		if frame.Sender() != caller {
+			t.Fatalf("frame sender = %v, want %v", frame.Sender(), caller)
+		}
+	}
+
+	_, err = engine.newFrame(frame, a, b)
+	if !errors.Is(err, ErrCallDepthExceeded) {
+		t.Fatalf("newFrame() error = %v, want %v", err, ErrCallDepthExceeded)
+	}
+	if frame.exec.maxDepth != 3 || frame.depthErr == nil {
+		t.Fatalf("max depth = %d, depth error = %v, want 3 and a depth error", frame.exec.maxDepth, frame.depthErr)
+	}
+
+	// A call from outside any frame starts a new call stack
+	frame, err = engine.newFrame(ctx, a, b)
+	if err != nil || frame.depth != 1 {
+		t.Fatalf("newFrame() = %v, %v, want depth 1", frame, err)
+	}
+}
+
+func TestCallDepthErrorScope(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	contract := core.Address{0x30}
+	source := []byte(`package recurse
+
+func Recurse() {}
+
+func Catch() {}
+`)
+	handlers := map[string]native.Handler{
+		"Recurse": func(params []byte) (any, error) {
+			_, err := core.Call(contract, "Recurse")
+			return nil, err
+		},
+		"Catch": func(params []byte) (any, error) {
+			if _, err := core.Call(contract, "Recurse"); err == nil {
+				return nil, errors.New("Recurse succeeded")
+			}
+			return nil, errors.New("unrelated")
+		},
+	}
+	if err := engine.DeployNative(contract, source, handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+	engine.GetContext().SetGasLimit(10000000)
+
+	if _, err := engine.ExecuteContract(contract, "Recurse"); err == nil || !strings.Contains(err.Error(), ErrCallDepthExceeded.Error()) {
+		t.Fatalf("Recurse error = %v, want %v", err, ErrCallDepthExceeded)
+	}
+	// The rejected call was handled by a nested frame, the caller failed for its own reason
+	_, err = engine.ExecuteContract(contract, "Catch")
+	if err == nil || errors.Is(err, ErrCallDepthExceeded) || !strings.Contains(err.Error(), "unrelated") {
+		t.Fatalf("Catch error = %v, want only the unrelated failure", err)
+	}
+}
+
+func TestCallFrameRecordsSideEffects(t *testing.T) {
+	engine := &Engine{maxCallDepth: 8}
+	ctx := memory.NewBlockchainContext(nil)
+	contract := core.Address{0x01}
+
+	frame, err := engine.newFrame(ctx, core.Address{0x02}, contract)
+	if err != nil {
+		t.Fatalf("newFrame() error = %v", err)
+	}
+	kept, err := frame.CreateObject(contract)
+	if err != nil {
+		t.Fatalf("CreateObject() error = %v", err)
+	}
+	frame.Log(contract, "Created", "id", kept.ID())
+
+	// Side effects of a call that is rolled back are not reported
+	mark := frame.exec.mark()
+	dropped, err := frame.CreateObject(contract)
+	if err != nil {
+		t.Fatalf("CreateObject() error = %v", err)
+	}
+	if err := frame.DeleteObject(contract, dropped.ID()); err != nil {
+		t.Fatalf("DeleteObject() error = %v", err)
+	}
+	frame.Log(contract, "Dropped")
+	frame.exec.rollback(mark)
+
+	if len(frame.exec.created) != 1 || frame.exec.created[0] != kept.ID() {
+		t.Fatalf("created = %v, want [%v]", frame.exec.created, kept.ID())
+	}
+	if len(frame.exec.deleted) != 0 {
+		t.Fatalf("deleted = %v, want none", frame.exec.deleted)
+	}
+	if len(frame.exec.logs) != 1 || frame.exec.logs[0].Event != "Created" {
+		t.Fatalf("logs = %v, want only Created", frame.exec.logs)
+	}
+}
+
+func TestUpgradeContractAuthorization(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	contract := core.Address{0x01}
+
+	// Upgrades are refused until an authorizer is configured
+	err = engine.UpgradeContract(contract, map[string][]byte{"contract.go": counterContractCode})
+	if !errors.Is(err, ErrUpgradeNotAuthorized) {
+		t.Fatalf("UpgradeContract() error = %v, want %v", err, ErrUpgradeNotAuthorized)
+	}
+
+	var checked core.Address
+	engine.WithUpgradeAuthorizer(func(ctx types.BlockchainContext, c, sender core.Address) error {
+		checked = c
+		return fmt.Errorf("sender %s is not the admin", sender)
+	})
+	err = engine.UpgradeContract(contract, map[string][]byte{"contract.go": counterContractCode})
+	if !errors.Is(err, ErrUpgradeNotAuthorized) {
+		t.Fatalf("UpgradeContract() error = %v, want %v", err, ErrUpgradeNotAuthorized)
+	}
+	if checked != contract {
+		t.Fatalf("authorizer checked %v, want %v", checked, contract)
+	}
+}
+
+func TestUpgradeContractRollback(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := &Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+		Runtime:          RuntimeNative,
+	}
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+	engine.WithUpgradeAuthorizer(func(ctx types.BlockchainContext, c, sender core.Address) error { return nil })
+
+	contract := core.Address{0x0d}
+	native.Register("countercontract", counterHandlers())
+	if err := engine.DeployContractWithAddress(counterContractCode, contract); err != nil {
+		t.Fatalf("DeployContractWithAddress() error = %v", err)
+	}
+	// The new version is split into two files
+	upgraded := map[string][]byte{
+		"counter.go": bytes.Replace(counterContractCode, []byte("package countercontract"), []byte("package upgradedcounter"), 1),
+		"version.go": []byte("package upgradedcounter\n\nfunc Version() uint64 {\n\treturn 2\n}\n"),
+	}
+	handlers := counterHandlers()
+	handlers["Version"] = func(params []byte) (any, error) { return uint64(2), nil }
+	native.Register("upgradedcounter", handlers)
+
+	// Activating the new version fails after the code was replaced, the upgrade is undone
+	previous, err := engine.runtime.Code(contract)
+	if err != nil {
+		t.Fatalf("Code() error = %v", err)
+	}
+	blocker := filepath.Join(config.CodeManagerDir, contract.String(), "metadata.json.tmp")
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := engine.UpgradeContract(contract, upgraded); err == nil {
+		t.Fatalf("UpgradeContract() with a failing activation succeeded")
+	}
+	if code, err := engine.runtime.Code(contract); err != nil || !bytes.Equal(code, previous) {
+		t.Fatalf("runtime code after a failed upgrade = %d bytes, %v, want the previous code", len(code), err)
+	}
+	abiData, err := os.ReadFile(filepath.Join(config.WASIContractsDir, fmt.Sprintf("%x.abi", contract)))
+	if err != nil || bytes.Contains(abiData, []byte("Version")) {
+		t.Fatalf("ABI after a failed upgrade = %s, %v, want the previous ABI", abiData, err)
+	}
+	if _, err := engine.ExecuteContract(contract, "Version"); err == nil {
+		t.Fatalf("calling a function of the failed upgrade succeeded")
+	}
+	if versions, err := engine.codeManager.GetVersions(contract); err != nil || len(versions) != 1 {
+		t.Fatalf("versions after a failed upgrade = %v, %v, want 1", versions, err)
+	}
+
+	os.Remove(blocker)
+	if err := engine.UpgradeContract(contract, upgraded); err != nil {
+		t.Fatalf("UpgradeContract() error = %v", err)
+	}
+	engine.GetContext().SetGasLimit(1000000)
+	if result, err := engine.ExecuteContract(contract, "Version"); err != nil || result != uint64(2) {
+		t.Fatalf("Version() = %v, %v, want 2", result, err)
+	}
+	if versions, err := engine.codeManager.GetVersions(contract); err != nil || len(versions) != 2 {
+		t.Fatalf("versions = %v, %v, want 2", versions, err)
+	}
+	if code, err := engine.codeManager.GetCode(contract); err != nil || len(code.Files) != 2 {
+		t.Fatalf("GetCode() after a multi-file upgrade = %+v, %v, want 2 files", code, err)
+	}
+
+	// Destroyed contracts stay destroyed
+	if err := engine.DestroyContract(contract, core.Address{0x0e}); err != nil {
+		t.Fatalf("DestroyContract() error = %v", err)
+	}
+	if err := engine.UpgradeContract(contract, upgraded); !errors.Is(err, ErrContractDestroyed) {
+		t.Fatalf("UpgradeContract() of a destroyed contract error = %v, want %v", err, ErrContractDestroyed)
+	}
+}
+
+func TestExecuteBlockFailedTransaction(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	empty, err := engine.ExecuteBlock(BlockHeader{Height: 1, Time: 1000}, nil)
+	if err != nil {
+		t.Fatalf("ExecuteBlock() error = %v", err)
+	}
+
+	// A transaction calling a missing contract fails on its own, the block still executes
+	txHash := core.Hash{0x01}
+	result, err := engine.ExecuteBlock(BlockHeader{Height: 2, Time: 2000}, []Tx{{
+		Hash:     txHash,
+		From:     core.Address{0x02},
+		Contract: core.Address{0x03},
+		Function: "Missing",
+	}})
+	if err != nil {
+		t.Fatalf("ExecuteBlock() error = %v", err)
+	}
+	if len(result.Receipts) != 1 {
+		t.Fatalf("ExecuteBlock() receipts = %d, want 1", len(result.Receipts))
+	}
+	receipt := result.Receipts[0]
+	if receipt.Status != types.ReceiptStatusFailed || receipt.RevertReason == "" {
+		t.Fatalf("receipt = %+v, want a failed receipt with a revert reason", receipt)
+	}
+	if receipt.TxHash != txHash || receipt.BlockHeight != 2 {
+		t.Fatalf("receipt tx/block = %v/%d, want %v/2", receipt.TxHash, receipt.BlockHeight, txHash)
+	}
+	if result.StateRoot != empty.StateRoot {
+		t.Fatalf("state root changed by a failed transaction")
+	}
+}
+
+func TestReadOnlyFrameRejectsWrites(t *testing.T) {
+	engine := &Engine{maxCallDepth: 8}
+	ctx := memory.NewBlockchainContext(nil)
+	contract := core.Address{0x01}
+	obj, err := ctx.CreateObject(contract)
+	if err != nil {
+		t.Fatalf("CreateObject() error = %v", err)
+	}
+
+	frame, err := engine.newFrame(ctx, core.Address{0x02}, contract)
+	if err != nil {
+		t.Fatalf("newFrame() error = %v", err)
+	}
+	frame.exec.readOnly = true
+
+	// Reads still work
+	readObj, err := frame.GetObject(contract, obj.ID())
+	if err != nil {
+		t.Fatalf("GetObject() error = %v", err)
+	}
+	if _, err := frame.CreateObject(contract); !errors.Is(err, ErrWriteInReadOnlyCall) {
+		t.Fatalf("CreateObject() error = %v, want %v", err, ErrWriteInReadOnlyCall)
+	}
+	if err := readObj.Set(contract, contract, "name", []byte(`"x"`)); !errors.Is(err, ErrWriteInReadOnlyCall) {
+		t.Fatalf("Set() error = %v, want %v", err, ErrWriteInReadOnlyCall)
+	}
+	if err := frame.DeleteObject(contract, obj.ID()); !errors.Is(err, ErrWriteInReadOnlyCall) {
+		t.Fatalf("DeleteObject() error = %v, want %v", err, ErrWriteInReadOnlyCall)
+	}
+	frame.Log(contract, "Ignored")
+	if len(frame.exec.logs) != 0 {
+		t.Fatalf("logs = %v, want none", frame.exec.logs)
+	}
+
+	// Nested calls inherit the read-only mode
+	nested, err := engine.newFrame(frame, contract, core.Address{0x03})
+	if err != nil {
+		t.Fatalf("newFrame() error = %v", err)
+	}
+	if err := nested.Transfer(nested.contract, nested.contract, contract, 1); !errors.Is(err, ErrWriteInReadOnlyCall) {
+		t.Fatalf("Transfer() error = %v, want %v", err, ErrWriteInReadOnlyCall)
+	}
+	if _, err := ctx.GetObject(contract, obj.ID()); err != nil {
+		t.Fatalf("object was deleted: %v", err)
+	}
+}
+
+func TestEstimateGasLeavesContextUntouched(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1234)
+	before, err := ctx.StateLeaves()
+	if err != nil {
+		t.Fatalf("StateLeaves() error = %v", err)
+	}
+
+	if _, err := engine.EstimateGas(core.Address{0x03}, "Missing", nil, core.Address{0x02}, 0); err == nil {
+		t.Fatalf("EstimateGas() of a missing contract succeeded")
+	}
+	if _, err := engine.Query(core.Address{0x03}, "Missing", nil); err == nil {
+		t.Fatalf("Query() of a missing contract succeeded")
+	}
+	if gas := ctx.GetGas(); gas != 1234 {
+		t.Fatalf("gas = %d after dry runs, want 1234", gas)
+	}
+	after, err := ctx.StateLeaves()
+	if err != nil {
+		t.Fatalf("StateLeaves() error = %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("state changed by dry runs: %d leaves, want %d", len(after), len(before))
+	}
+}
+
+func TestNativeContract(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	handlers := counterHandlers()
+	delete(handlers, "Reset")
+	contract := core.Address{0x0a}
+	if err := engine.DeployNative(contract, counterContractCode, handlers); err == nil {
+		t.Fatalf("DeployNative() without a Reset handler succeeded")
+	}
+	handlers = counterHandlers()
+	if err := engine.DeployNative(contract, counterContractCode, handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1000000)
+	if _, err := engine.ExecuteContract(contract, "Initialize"); err != nil {
+		t.Fatalf("Initialize error = %v", err)
+	}
+	receipt, err := engine.ExecuteTx(contract, "Increment", []byte(`{"value":5}`))
+	if err != nil {
+		t.Fatalf("ExecuteTx() error = %v", err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccess {
+		t.Fatalf("Increment failed: %s", receipt.RevertReason)
+	}
+	if value, ok := receipt.Data.(float64); !ok || value != 5 {
+		t.Fatalf("Increment result = %v, want 5", receipt.Data)
+	}
+	if len(receipt.Logs) != 1 || receipt.Logs[0].Event != "increment" {
+		t.Fatalf("logs = %+v, want one increment event", receipt.Logs)
+	}
+	if receipt.GasUsed <= 0 {
+		t.Fatalf("GasUsed = %d, want > 0", receipt.GasUsed)
+	}
+	// Committed executions leave no undo operations behind
+	if id := ctx.Snapshot(); id != 0 {
+		t.Fatalf("journal has %d entries after committed executions, want 0", id)
+	}
+
+	// A panic reverts the call and records the Go stack trace
+	receipt, err = engine.ExecuteTx(contract, "GetCounter", nil)
+	if err != nil {
+		t.Fatalf("ExecuteTx() error = %v", err)
+	}
+	if receipt.Status != types.ReceiptStatusFailed {
+		t.Fatalf("GetCounter succeeded, want a failure")
+	}
+	if len(receipt.Trace) != 1 || !strings.Contains(receipt.Trace[0].Output, "unexpected call") {
+		t.Fatalf("trace = %+v, want the panic", receipt.Trace)
+	}
+}
+
+// counterHandlers returns native handlers of testdata/counter_contract.go like the generated ones,
+// GetCounter panics so tests can check how panics are reported
+func counterHandlers() map[string]native.Handler {
+	return map[string]native.Handler{
+		"Initialize": func(params []byte) (any, error) {
+			obj, err := core.GetObject(core.ObjectID{})
+			core.Assert(err)
+			core.Assert(obj.Set("counter_value", uint64(0)))
+			core.Log("initialize", "contract_address", core.ContractAddress())
+			return int32(0), nil
+		},
+		"Increment": func(params []byte) (any, error) {
+			var args struct {
+				Value uint64 `json:"value,omitempty"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+			obj, err := core.GetObject(core.ObjectID{})
+			core.Assert(err)
+			var current uint64
+			core.Assert(obj.Get("counter_value", &current))
+			core.Assert(obj.Set("counter_value", current+args.Value))
+			core.Log("increment", "to", current+args.Value)
+			return current + args.Value, nil
+		},
+		"GetCounter": func(params []byte) (any, error) {
+			panic("unexpected call")
+		},
+		"Reset": func(params []byte) (any, error) { return nil, nil },
+	}
+}
+
+func TestNativeRuntimeConcurrentCalls(t *testing.T) {
+	runtime := native.NewRuntime()
+	handlers := map[string]native.Handler{
+		"Whoami": func(params []byte) (any, error) {
+			// Read the address many times, a call of another tree must not take over in between
+			addr := core.ContractAddress()
+			for i := 0; i < 100; i++ {
+				if core.ContractAddress() != addr {
+					return nil, errors.New("contract address changed during the call")
+				}
+			}
+			return addr.String(), nil
+		},
+	}
+	contracts := make([]core.Address, 8)
+	for i := range contracts {
+		contracts[i] = core.Address{0x30, byte(i)}
+		if err := runtime.Deploy(memory.NewBlockchainContext(nil), contracts[i], handlers); err != nil {
+			t.Fatalf("Deploy() error = %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(contracts)*10)
+	for _, contract := range contracts {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Every call tree has its own context, like the engine gives them
+				runCtx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				ctx := memory.NewBlockchainContext(nil)
+				ctx.SetGasLimit(1000000)
+				result, err := runtime.Execute(runCtx, ctx, contract, "Whoami", nil)
+				if err != nil {
+					errs <- err
+				} else if !result.Success || result.Data != contract.String() {
+					errs <- fmt.Errorf("Whoami() of %s = %v, %s", contract, result.Data, result.Error)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestNativeRuntime(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := &Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+		Runtime:          "unknown",
+	}
+	if _, err := NewEngine(config); err == nil {
+		t.Fatalf("NewEngine() with an unknown runtime succeeded")
+	}
+	config.Runtime = RuntimeNative
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	// Contracts deploy from source once their package is linked in
+	contract := core.Address{0x0b}
+	unregistered := bytes.Replace(counterContractCode, []byte("package countercontract"), []byte("package unregistered"), 1)
+	if err := engine.DeployContractWithAddress(unregistered, core.Address{0x0c}); err == nil {
+		t.Fatalf("DeployContractWithAddress() of an unregistered package succeeded")
+	}
+	native.Register("countercontract", counterHandlers())
+	if err := engine.DeployContractWithAddress(counterContractCode, contract); err != nil {
+		t.Fatalf("DeployContractWithAddress() error = %v", err)
+	}
+
+	engine.GetContext().SetGasLimit(1000000)
+	if _, err := engine.ExecuteContract(contract, "Initialize"); err != nil {
+		t.Fatalf("Initialize error = %v", err)
+	}
+	result, err := engine.ExecuteContract(contract, "Increment", uint64(3))
+	if err != nil {
+		t.Fatalf("Increment error = %v", err)
+	}
+	if value, ok := result.(uint64); !ok || value != 3 {
+		t.Fatalf("Increment result = %v, want 3", result)
+	}
+
+	// Contract packages can be split into several files
+	files := map[string][]byte{
+		"counter.go": counterContractCode,
+		"helpers.go": []byte("package countercontract\n\nfunc double(v uint64) uint64 {\n\treturn v * 2\n}\n"),
+	}
+	multi, err := engine.DeployContractFiles(files)
+	if err != nil {
+		t.Fatalf("DeployContractFiles() error = %v", err)
+	}
+	if multi == contract {
+		t.Fatalf("DeployContractFiles() reused address %s", multi)
+	}
+	code, err := engine.codeManager.GetCode(multi)
+	if err != nil || len(code.Files) != 2 || len(code.InjectedFiles) != 2 {
+		t.Fatalf("GetCode() of a multi-file contract = %+v, %v", code, err)
+	}
+	if _, err := engine.ExecuteContract(multi, "Initialize"); err != nil {
+		t.Fatalf("Initialize error = %v", err)
+	}
+	if result, err := engine.ExecuteContract(multi, "Increment", uint64(2)); err != nil || result != uint64(2) {
+		t.Fatalf("Increment result = %v, %v, want 2", result, err)
+	}
+	files["other.go"] = []byte("package other\n")
+	if _, err := engine.DeployContractFiles(files); err == nil {
+		t.Fatalf("DeployContractFiles() of files of different packages succeeded")
+	}
+
+	engine.DeleteContract(contract)
+	if _, err := engine.ExecuteContract(contract, "Increment", uint64(3)); err == nil {
+		t.Fatalf("Increment of a deleted contract succeeded")
+	}
+}
+
+// prebuiltContractModule is a minimal contract module: it imports env.get_block_height, exports its memory
+// and the functions called by the host, and handle_contract_call returns no result
+var prebuiltContractModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: () -> i32, (i32) -> i32, (i32, i32) -> (), (i32, i32) -> i32
+	0x01, 0x15, 0x04, 0x60, 0x00, 0x01, 0x7f, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	0x60, 0x02, 0x7f, 0x7f, 0x00, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+	// import section: env.get_block_height of type 0
+	0x02, 0x18, 0x01, 0x03, 'e', 'n', 'v', 0x10, 'g', 'e', 't', '_', 'b', 'l', 'o', 'c', 'k',
+	'_', 'h', 'e', 'i', 'g', 'h', 't', 0x00, 0x00,
+	// function section: allocate, deallocate, handle_contract_call, get_buffer_address
+	0x03, 0x05, 0x04, 0x01, 0x02, 0x03, 0x00,
+	// memory section: min 1 page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export section
+	0x07, 0x4e, 0x05,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x08, 'a', 'l', 'l', 'o', 'c', 'a', 't', 'e', 0x00, 0x01,
+	0x0a, 'd', 'e', 'a', 'l', 'l', 'o', 'c', 'a', 't', 'e', 0x00, 0x02,
+	0x14, 'h', 'a', 'n', 'd', 'l', 'e', '_', 'c', 'o', 'n', 't', 'r', 'a', 'c', 't', '_', 'c', 'a', 'l', 'l', 0x00, 0x03,
+	0x12, 'g', 'e', 't', '_', 'b', 'u', 'f', 'f', 'e', 'r', '_', 'a', 'd', 'd', 'r', 'e', 's', 's', 0x00, 0x04,
+	// code section: every function returns 0, deallocate returns nothing
+	0x0a, 0x13, 0x04,
+	0x04, 0x00, 0x41, 0x00, 0x0b,
+	0x02, 0x00, 0x0b,
+	0x04, 0x00, 0x41, 0x00, 0x0b,
+	0x04, 0x00, 0x41, 0x00, 0x0b,
+}
+
+func TestDeployWasm(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	abiJSON := []byte(`{"package_name":"prebuilt","functions":[{"name":"Ping"}]}`)
+	if _, err := engine.DeployWasm(prebuiltContractModule, []byte(`{}`)); err == nil {
+		t.Fatalf("DeployWasm() without ABI functions succeeded")
+	}
+	if _, err := engine.DeployWasm(prebuiltContractModule[:len(prebuiltContractModule)-5], abiJSON); err == nil {
+		t.Fatalf("DeployWasm() of a truncated module succeeded")
+	}
+	contract, err := engine.DeployWasm(prebuiltContractModule, abiJSON)
+	if err != nil {
+		t.Fatalf("DeployWasm() error = %v", err)
+	}
+
+	engine.GetContext().SetGasLimit(1000000)
+	if _, err := engine.ExecuteContract(contract, "Ping"); err != nil {
+		t.Fatalf("Ping error = %v", err)
+	}
+	if _, err := engine.ExecuteContract(contract, "Missing"); err == nil {
+		t.Fatalf("calling a function missing from the ABI succeeded")
+	}
+
+	// Other contracts can call functions without results
+	caller := core.Address{0x21}
+	handlers := map[string]native.Handler{
+		"CallPing": func(params []byte) (any, error) {
+			data, err := core.Call(contract, "Ping")
+			if err != nil {
+				return nil, err
+			}
+			return len(data), nil
+		},
+	}
+	if err := engine.DeployNative(caller, []byte("package caller\n\nfunc CallPing() int { return 0 }\n"), handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+	result, err := engine.ExecuteContract(caller, "CallPing")
+	if err != nil {
+		t.Fatalf("CallPing error = %v", err)
+	}
+	if result != 0 {
+		t.Fatalf("CallPing() = %v, want no result data", result)
+	}
+}
+
+func TestConstructor(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	source := []byte(`package owned
+
+//govm:constructor
+func Init(supply uint64) {}
+
+func Owner() string { return "" }
+`)
+	handlers := map[string]native.Handler{
+		"Init": func(params []byte) (any, error) {
+			var args struct {
+				Supply uint64 `json:"supply,omitempty"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+			if args.Supply == 0 {
+				return nil, errors.New("supply is required")
+			}
+			obj, err := core.GetObject(core.ObjectID{})
+			core.Assert(err)
+			core.Assert(obj.Set("owner", core.Sender().String()))
+			return nil, nil
+		},
+		"Owner": func(params []byte) (any, error) {
+			obj, err := core.GetObject(core.ObjectID{})
+			core.Assert(err)
+			var owner string
+			core.Assert(obj.Get("owner", &owner))
+			return owner, nil
+		},
+	}
+
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1000000)
+	deployer := core.Address{0x0d}
+	ctx.SetTransactionInfo(core.Hash{}, deployer, core.Address{}, 0)
+
+	// A failing constructor undoes the deployment
+	failed := core.Address{0x0e}
+	if err := engine.DeployNative(failed, source, handlers, uint64(0)); err == nil {
+		t.Fatalf("DeployNative() with a failing constructor succeeded")
+	}
+	if _, err := engine.ExecuteContract(failed, "Owner"); err == nil {
+		t.Fatalf("contract with a failed constructor was deployed")
+	}
+	var id core.ObjectID
+	copy(id[:], failed[:])
+	if _, err := ctx.GetObject(failed, id); err == nil {
+		t.Fatalf("object of a contract with a failed constructor was kept")
+	}
+
+	contract := core.Address{0x0f}
+	if err := engine.DeployNative(contract, source, handlers, uint64(100), "extra"); err == nil {
+		t.Fatalf("DeployNative() with too many constructor arguments succeeded")
+	}
+	if err := engine.DeployNative(contract, source, handlers, uint64(100)); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+	owner, err := engine.ExecuteContract(contract, "Owner")
+	if err != nil {
+		t.Fatalf("Owner error = %v", err)
+	}
+	if owner != deployer.String() {
+		t.Fatalf("owner = %v, want the deployer %s", owner, deployer)
+	}
+
+	// The constructor can't run again
+	if _, err := engine.ExecuteContract(contract, "Init", uint64(1)); !errors.Is(err, ErrConstructorCall) {
+		t.Fatalf("Init error = %v, want %v", err, ErrConstructorCall)
+	}
+
+	// Without the directive Init is a regular function, it doesn't run at deployment
+	plain := core.Address{0x1f}
+	unmarked := bytes.Replace(source, []byte("//govm:constructor\n"), nil, 1)
+	if err := engine.DeployNative(plain, unmarked, handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+	if _, err := engine.ExecuteContract(plain, "Owner"); err == nil {
+		t.Fatalf("Init ran at deployment without the constructor directive")
+	}
+	if _, err := engine.ExecuteContract(plain, "Init", uint64(1)); err != nil {
+		t.Fatalf("Init error = %v", err)
+	}
+}
+
+func TestPayableCalls(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sender := core.Address{0x10}
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+		ContextParams:    map[string]any{"balances": map[core.Address]uint64{sender: 1000}},
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	source := []byte(`package payable
+
+func Pay() uint64 { return 0 }
+
+func Fail() {}
+
+func Forward(to string) uint64 { return 0 }
+
+func Max() uint64 { return 0 }
+`)
+	handlers := map[string]native.Handler{
+		"Pay": func(params []byte) (any, error) {
+			return core.Value(), nil
+		},
+		"Fail": func(params []byte) (any, error) {
+			return nil, errors.New("rejected")
+		},
+		"Max": func(params []byte) (any, error) {
+			return uint64(math.MaxUint64), nil
+		},
+		"Forward": func(params []byte) (any, error) {
+			var args struct {
+				To string `json:"to,omitempty"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+			data, err := core.CallWithValue(core.AddressFromString(args.To), "Pay", 40)
+			if err != nil {
+				return nil, err
+			}
+			var value uint64
+			return value, json.Unmarshal(data, &value)
+		},
+	}
+	first, second := core.Address{0x11}, core.Address{0x12}
+	for _, contract := range []core.Address{first, second} {
+		if err := engine.DeployNative(contract, source, handlers); err != nil {
+			t.Fatalf("DeployNative() error = %v", err)
+		}
+	}
+
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1000000)
+	ctx.SetTransactionInfo(core.Hash{0x01}, sender, first, 100)
+	receipt, err := engine.ExecuteTx(first, "Pay", nil)
+	if err != nil || receipt.Status != types.ReceiptStatusSuccess {
+		t.Fatalf("Pay failed: %v %s", err, receipt.RevertReason)
+	}
+	if receipt.Data != float64(100) {
+		t.Fatalf("Value() = %v, want 100", receipt.Data)
+	}
+	if ctx.Balance(sender) != 900 || ctx.Balance(first) != 100 {
+		t.Fatalf("balances = %d, %d, want 900, 100", ctx.Balance(sender), ctx.Balance(first))
+	}
+
+	// A failed call refunds the value
+	receipt, err = engine.ExecuteTx(first, "Fail", nil)
+	if err != nil || receipt.Status != types.ReceiptStatusFailed {
+		t.Fatalf("Fail succeeded: %v", err)
+	}
+	if ctx.Balance(sender) != 900 || ctx.Balance(first) != 100 {
+		t.Fatalf("balances after a failed call = %d, %d, want 900, 100", ctx.Balance(sender), ctx.Balance(first))
+	}
+
+	// Results decode exactly from the receipt, also after it was stored
+	ctx.SetTransactionInfo(core.Hash{0x02}, sender, first, 0)
+	receipt, err = engine.ExecuteTx(first, "Max", nil)
+	if err != nil || receipt.Status != types.ReceiptStatusSuccess {
+		t.Fatalf("Max failed: %v %s", err, receipt.RevertReason)
+	}
+	stored, _ := json.Marshal(receipt)
+	var loaded types.Receipt
+	if err := json.Unmarshal(stored, &loaded); err != nil {
+		t.Fatalf("failed to decode receipt: %v", err)
+	}
+	for _, raw := range []json.RawMessage{receipt.RawData, loaded.RawData} {
+		if max, err := engine.DecodeResult(first, "Max", raw); err != nil || max != uint64(math.MaxUint64) {
+			t.Fatalf("DecodeResult() = %v, %v, want %d", max, err, uint64(math.MaxUint64))
+		}
+	}
+
+	// Contracts pay each other
+	result, err := engine.ExecuteContract(first, "Forward", second.String())
+	if err != nil {
+		t.Fatalf("Forward error = %v", err)
+	}
+	if result != uint64(40) {
+		t.Fatalf("Forward() = %v, want 40", result)
+	}
+	if ctx.Balance(first) != 60 || ctx.Balance(second) != 40 {
+		t.Fatalf("balances = %d, %d, want 60, 40", ctx.Balance(first), ctx.Balance(second))
+	}
+
+	// Paying more than the balance fails
+	ctx.SetTransactionInfo(core.Hash{0x03}, sender, first, 10000)
+	if _, err := engine.ExecuteContract(first, "Pay"); err == nil {
+		t.Fatalf("Pay with more than the sender's balance succeeded")
+	}
+
+	// Estimates pay the value without keeping it
+	if _, err := engine.EstimateGas(first, "Pay", nil, sender, 50); err != nil {
+		t.Fatalf("EstimateGas() error = %v", err)
+	}
+	if _, err := engine.EstimateGas(first, "Pay", nil, sender, 10000); err == nil {
+		t.Fatalf("EstimateGas() with more than the sender's balance succeeded")
+	}
+	if ctx.Balance(sender) != 900 || ctx.Balance(first) != 60 {
+		t.Fatalf("balances after estimates = %d, %d, want 900, 60", ctx.Balance(sender), ctx.Balance(first))
+	}
+
+	// A failed nested call costs the caller all the gas it got, a successful one what it used
+	ctx.SetTransactionInfo(core.Hash{0x04}, sender, first, 0)
+	ctx.SetGasLimit(100000)
+	if _, err := engine.call(ctx, first, second, "Fail"); err == nil {
+		t.Fatalf("call of Fail succeeded")
+	}
+	if gas := ctx.GetGas(); gas != 0 {
+		t.Fatalf("gas after a failed call = %d, want 0", gas)
+	}
+	ctx.SetGasLimit(100000)
+	if _, err := engine.call(ctx, first, second, "Max"); err != nil {
+		t.Fatalf("call of Max error = %v", err)
+	}
+	if gas := ctx.GetGas(); gas <= 0 || gas > 100000 {
+		t.Fatalf("gas after a successful call = %d, want more than 0 and at most 100000", gas)
+	}
+}
+
+func TestSelfDestruct(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sender, beneficiary := core.Address{0x10}, core.Address{0x20}
+	config := &Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "memory",
+		ContextParams:    map[string]any{"balances": map[core.Address]uint64{sender: 1000}},
+	}
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	source := []byte(`package vault
+
+func Store() {}
+
+func Destroy(to string) {}
+
+func DestroyAndFail(to string) {}
+`)
+	destroy := func(params []byte) error {
+		var args struct {
+			To string `json:"to,omitempty"`
+		}
+		if err := json.Unmarshal(params, &args); err != nil {
+			return err
+		}
+		return core.SelfDestruct(core.AddressFromString(args.To))
+	}
+	handlers := map[string]native.Handler{
+		"Store": func(params []byte) (any, error) {
+			return nil, core.CreateObject().Set("amount", core.Value())
+		},
+		"Destroy": func(params []byte) (any, error) {
+			return nil, destroy(params)
+		},
+		"DestroyAndFail": func(params []byte) (any, error) {
+			if err := destroy(params); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("rejected")
+		},
+	}
+	contract := core.Address{0x11}
+	if err := engine.DeployNative(contract, source, handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1000000)
+	ctx.SetTransactionInfo(core.Hash{0x01}, sender, contract, 100)
+	if _, err := engine.ExecuteContract(contract, "Store"); err != nil {
+		t.Fatalf("Store error = %v", err)
+	}
+	ctx.SetTransactionInfo(core.Hash{0x02}, sender, contract, 0)
+
+	// A failed call undoes the self-destruct
+	if _, err := engine.ExecuteContract(contract, "DestroyAndFail", beneficiary.String()); err == nil {
+		t.Fatalf("DestroyAndFail succeeded")
+	}
+	if ctx.Balance(contract) != 100 || ctx.Balance(beneficiary) != 0 {
+		t.Fatalf("balances = %d, %d, want 100, 0", ctx.Balance(contract), ctx.Balance(beneficiary))
+	}
+	if _, err := engine.ExecuteContract(contract, "Store"); err != nil {
+		t.Fatalf("Store after a failed self-destruct error = %v", err)
+	}
+
+	args, _ := json.Marshal(map[string]any{"to": beneficiary.String()})
+	receipt, err := engine.ExecuteTx(contract, "Destroy", args)
+	if err != nil || receipt.Status != types.ReceiptStatusSuccess {
+		t.Fatalf("Destroy failed: %v %s", err, receipt.RevertReason)
+	}
+	// The contract object and the two stored objects
+	if len(receipt.DeletedObjects) != 3 {
+		t.Fatalf("deleted objects = %d, want 3", len(receipt.DeletedObjects))
+	}
+	if ctx.Balance(contract) != 0 || ctx.Balance(beneficiary) != 100 {
+		t.Fatalf("balances = %d, %d, want 0, 100", ctx.Balance(contract), ctx.Balance(beneficiary))
+	}
+	for _, id := range receipt.DeletedObjects {
+		if _, err := ctx.GetObject(contract, id); err == nil {
+			t.Fatalf("object %s still exists", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.WASIContractsDir, fmt.Sprintf("%x.abi", contract))); !os.IsNotExist(err) {
+		t.Fatalf("ABI file still exists: %v", err)
+	}
+	if _, err := engine.ExecuteContract(contract, "Store"); err == nil {
+		t.Fatalf("calling a destroyed contract succeeded")
+	}
+	if err := engine.DeployNative(contract, source, handlers); !errors.Is(err, ErrContractDestroyed) {
+		t.Fatalf("redeploy error = %v, want ErrContractDestroyed", err)
+	}
+
+	config.AllowRedeploy = true
+	if err := engine.DeployNative(contract, source, handlers); err != nil {
+		t.Fatalf("redeploy error = %v", err)
+	}
+	if _, err := engine.ExecuteContract(contract, "Store"); err != nil {
+		t.Fatalf("Store after redeploy error = %v", err)
+	}
+
+	// The host destroys contracts too
+	if err := engine.DestroyContract(contract, beneficiary); err != nil {
+		t.Fatalf("DestroyContract() error = %v", err)
+	}
+	if _, err := engine.ExecuteContract(contract, "Store"); err == nil {
+		t.Fatalf("calling a destroyed contract succeeded")
+	}
+	if err := engine.DestroyContract(contract, beneficiary); err == nil {
+		t.Fatalf("destroying a destroyed contract succeeded")
+	}
+}
+
+func TestRedeployStartsWithEmptyState(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "engine_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := NewEngine(&Config{
+		MaxContractSize:  1024 * 1024,
+		WASIContractsDir: filepath.Join(tmpDir, "contracts"),
+		CodeManagerDir:   filepath.Join(tmpDir, "code"),
+		ContextType:      "db",
+		ContextParams:    map[string]any{"db_path": filepath.Join(tmpDir, "state.db")},
+		AllowRedeploy:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	defer engine.Close()
+
+	source := []byte(`package store
+
+func Save() {}
+
+func Drop() {}
+
+func Destroy() {}
+`)
+	handlers := map[string]native.Handler{
+		"Save": func(params []byte) (any, error) {
+			obj, err := core.GetObject(core.ObjectID{})
+			if err != nil {
+				return nil, err
+			}
+			return nil, obj.Set("name", "old")
+		},
+		"Drop": func(params []byte) (any, error) {
+			// Spend some gas first, the refund of the deletion can't exceed it
+			obj, err := core.GetObject(core.ObjectID{})
+			if err != nil {
+				return nil, err
+			}
+			if err := obj.Set("note", "dropped"); err != nil {
+				return nil, err
+			}
+			core.DeleteObject(core.ObjectID{})
+			return nil, nil
+		},
+		"Destroy": func(params []byte) (any, error) {
+			return nil, core.SelfDestruct(core.Address{0x20})
+		},
+	}
+	contract := core.Address{0x11}
+	if err := engine.DeployNative(contract, source, handlers); err != nil {
+		t.Fatalf("DeployNative() error = %v", err)
+	}
+	ctx := engine.GetContext()
+	ctx.SetGasLimit(1000000)
+	for _, function := range []string{"Save", "Drop", "Destroy"} {
+		if _, err := engine.ExecuteContract(contract, function); err != nil {
+			t.Fatalf("%s error = %v", function, err)
+		}
+	}
+
+	// The default object of the redeployed contract has none of the old fields
+	if err := engine.DeployNative(contract, source, handlers); err != nil {
+		t.Fatalf("redeploy error = %v", err)
+	}
+	var id core.ObjectID
+	copy(id[:], contract[:])
+	obj, err := ctx.GetObject(contract, id)
+	if err != nil {
+		t.Fatalf("GetObject() error = %v", err)
+	}
+	if value, err := obj.Get(contract, "name"); err != nil || value != nil {
+		t.Fatalf("field after redeploy = %q, %v, want none", value, err)
+	}
+	leaves, err := ctx.StateLeaves()
+	if err != nil {
+		t.Fatalf("StateLeaves() error = %v", err)
+	}
+	for _, leaf := range leaves {
+		if bytes.Contains(leaf.Key, []byte("name")) {
+			t.Fatalf("state still holds the old field: %x", leaf.Key)
+		}
+	}
+}
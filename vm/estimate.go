@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/govm-net/vm/core"
+	"github.com/govm-net/vm/types"
+)
+
+// dryRun executes a contract function as sender, paying it value, with the given gas limit and throws away its effects.
+// Contexts that implement types.DryRunner run it on a throwaway copy of their state; other contexts are reverted
+// to a snapshot and get their gas back afterwards, whether the execution succeeds or not.
+func (e *Engine) dryRun(contractAddr core.Address, function string, args []byte, sender core.Address, value uint64, gasLimit int64, readOnly bool) (result *types.ExecutionResult, err error) {
+	exec := func(ctx types.BlockchainContext) error {
+		frame, err := e.newFrame(ctx, sender, contractAddr)
+		if err != nil {
+			return err
+		}
+		frame.exec.readOnly = readOnly
+		frame.value = value
+		ctx.SetGasLimit(gasLimit)
+		result, err = e.run(frame, function, args)
+		return err
+	}
+	if runner, ok := e.ctx.(types.DryRunner); ok {
+		if err := runner.DryRun(exec); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	gasBefore := e.ctx.GetGas()
+	snapshot := e.ctx.Snapshot()
+	defer func() {
+		e.ctx.SetGasLimit(gasBefore)
+		if rerr := e.ctx.RevertToSnapshot(snapshot); rerr != nil && err == nil {
+			result, err = nil, fmt.Errorf("failed to revert dry run state: %w", rerr)
+		}
+	}()
+	if err := exec(e.ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// EstimateGas executes a contract function as sender, paying it value, without persisting anything and returns
+// the gas it used, including the gas of nested calls and net of the refunds for deleted objects.
+// The execution runs with the engine's maximum gas, an error is returned if it fails.
+func (e *Engine) EstimateGas(contractAddr core.Address, function string, args []byte, sender core.Address, value uint64) (int64, error) {
+	result, err := e.dryRun(contractAddr, function, args, sender, value, e.maxGas, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate gas: %w", err)
+	}
+	if result == nil {
+		return 0, fmt.Errorf("failed to estimate gas: no execution result")
+	}
+	return result.GasUsed, nil
+}
+
+// EstimateGasLimit returns the minimum gas limit with which the contract function succeeds.
+// Because of refunds an execution may need more gas than it finally uses, so the limit is
+// binary searched between the gas used and the engine's maximum gas.
+func (e *Engine) EstimateGasLimit(contractAddr core.Address, function string, args []byte, sender core.Address, value uint64) (int64, error) {
+	used, err := e.EstimateGas(contractAddr, function, args, sender, value)
+	if err != nil {
+		return 0, err
+	}
+	succeeds := func(limit int64) bool {
+		_, err := e.dryRun(contractAddr, function, args, sender, value, limit, false)
+		return err == nil
+	}
+	if used > 0 && succeeds(used) {
+		return used, nil
+	}
+
+	// lo always fails and hi always succeeds
+	lo, hi := used, e.maxGas
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if succeeds(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/govm-net/vm/api"
+	"github.com/govm-net/vm/native"
+	"github.com/govm-net/vm/wasi"
+)
+
+var _ wasi.Runtime = (*native.Runtime)(nil)
+
+// newRuntime creates the contract runtime selected by config
+func newRuntime(config *Config, contractConfig api.ContractConfig, nativeRuntime *native.Runtime) (wasi.Runtime, error) {
+	var mode wasi.Mode
+	switch config.Runtime {
+	case RuntimeNative:
+		return nativeRuntime, nil
+	case "", RuntimeWazero:
+		mode = wasi.ModeAuto
+	case RuntimeCompiler:
+		mode = wasi.ModeCompiler
+	case RuntimeInterpreter:
+		mode = wasi.ModeInterpreter
+	default:
+		return nil, fmt.Errorf("unknown runtime: %s", config.Runtime)
+	}
+
+	wazeroVM, err := wasi.NewWazeroVMWithMode(config.WASIContractsDir, contractConfig, mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wazero engine: %w", err)
+	}
+	wazeroVM.WithMetering(config.GasMetering).WithDeterministic(config.DeterministicEnv).
+		WithDebug(config.Debug)
+	return wazeroVM, nil
+}
+
+// validate checks the source files of a contract before it is deployed.
+// The native runtime runs packages already built into the host, so their source is not built again.
+func (e *Engine) validate(files map[string][]byte) error {
+	if e.config.Runtime == RuntimeNative {
+		return e.maker.ValidateSourceFiles(files)
+	}
+	return e.maker.ValidateContractFiles(files)
+}
+
+// compile turns the source files of a contract into the code deployed to the runtime.
+// WASM runtimes get the code compiled by tinygo, the native runtime finds the linked package from the
+// package clause of the source itself, any file of the package will do.
+func (e *Engine) compile(files map[string][]byte) ([]byte, error) {
+	if e.config.Runtime == RuntimeNative {
+		return files[slices.Min(slices.Collect(maps.Keys(files)))], nil
+	}
+	return e.maker.CompileContractFiles(files)
+}
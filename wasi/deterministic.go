@@ -0,0 +1,87 @@
+package wasi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/govm-net/vm/types"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Deterministic WASI environment.
+//
+// Contracts run on every node and must produce the same result everywhere. In deterministic mode
+// the WASI clocks and random source of a contract instance are derived from the block and transaction
+// being executed, sleeping returns immediately, there are no environment variables, arguments or files,
+// and stdout and stderr are captured into the execution trace instead of the node's output.
+
+// WithDeterministic enables or disables the deterministic WASI environment
+func (vm *WazeroVM) WithDeterministic(enabled bool) *WazeroVM {
+	vm.deterministic = enabled
+	return vm
+}
+
+// deterministicConfig restricts the WASI environment of a module instance to values derived from ctx,
+// output written by the instance is collected in out
+func deterministicConfig(config wazero.ModuleConfig, ctx types.BlockchainContext, out *bytes.Buffer) wazero.ModuleConfig {
+	blockTime := ctx.BlockTime()
+
+	// The monotonic clock starts at the block time and advances one nanosecond per read,
+	// so loops waiting for time to pass still terminate
+	nanotime := blockTime * 1e9
+	return config.
+		WithStdin(bytes.NewReader(nil)).
+		WithStdout(out).
+		WithStderr(out).
+		WithWalltime(func() (int64, int32) { return blockTime, 0 }, sys.ClockResolution(1)).
+		WithNanotime(func() int64 { nanotime++; return nanotime }, sys.ClockResolution(1)).
+		WithNanosleep(func(int64) {}).
+		WithOsyield(func() {}).
+		WithRandSource(newSeededRand(randSeed(ctx)))
+}
+
+// randSeed derives the random seed of an execution from the transaction, block and contract
+func randSeed(ctx types.BlockchainContext) [32]byte {
+	h := sha256.New()
+	txHash := ctx.TransactionHash()
+	contract := ctx.ContractAddress()
+	sender := ctx.Sender()
+	h.Write(txHash[:])
+	binary.Write(h, binary.BigEndian, ctx.BlockHeight())
+	h.Write(contract[:])
+	h.Write(sender[:])
+	var seed [32]byte
+	copy(seed[:], h.Sum(nil))
+	return seed
+}
+
+// seededRand is a deterministic random stream, SHA-256 of the seed and a block counter
+type seededRand struct {
+	seed    [32]byte
+	counter uint64
+	block   []byte
+}
+
+func newSeededRand(seed [32]byte) *seededRand {
+	return &seededRand{seed: seed}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.block) == 0 {
+			var buf [40]byte
+			copy(buf[:], r.seed[:])
+			binary.BigEndian.PutUint64(buf[32:], r.counter)
+			r.counter++
+			sum := sha256.Sum256(buf[:])
+			r.block = sum[:]
+		}
+		c := copy(p[n:], r.block)
+		r.block = r.block[c:]
+		n += c
+	}
+	return n, nil
+}
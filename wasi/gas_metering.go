@@ -0,0 +1,720 @@
+package wasi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Host-side gas metering.
+//
+// When metering is enabled, contract code is instrumented before compilation: a mutable i64 global
+// holding the remaining gas is appended to the module and exported as gasGlobalName, and every basic
+// block starts with a charge for the instructions it contains. The charge traps with `unreachable`
+// once the remaining gas drops below zero, so the meter cannot be bypassed by code inside the module.
+// Bulk memory and table instructions are also charged per byte or entry they touch, read from their length
+// operand at runtime. Host functions charge the same global, which is set from the BlockchainContext before
+// each execution. The module must be validated before it is instrumented: references to the index of the gas
+// global are invalid in the original module, but would reach the gas global once it is appended.
+
+// gasGlobalName is the export name of the injected gas global
+const gasGlobalName = "govm_gas"
+
+// hostCallGas is the base gas charged for every host function call, data passed in is charged per byte
+const hostCallGas = 100
+
+// ErrOutOfGas is returned when a metered execution exhausts its gas limit
+var ErrOutOfGas = errors.New("out of gas")
+
+// WASM section ids
+const (
+	sectionCustom    = 0
+	sectionType      = 1
+	sectionImport    = 2
+	sectionFunction  = 3
+	sectionTable     = 4
+	sectionMemory    = 5
+	sectionGlobal    = 6
+	sectionExport    = 7
+	sectionElement   = 9
+	sectionCode      = 10
+	sectionDataCount = 12
+)
+
+// WASM opcodes used by the instrumentation
+const (
+	opUnreachable = 0x00
+	opBlock       = 0x02
+	opLoop        = 0x03
+	opIf          = 0x04
+	opElse        = 0x05
+	opEnd         = 0x0B
+	opBr          = 0x0C
+	opBrIf        = 0x0D
+	opBrTable     = 0x0E
+	opReturn      = 0x0F
+	opLocalGet    = 0x20
+	opLocalSet    = 0x21
+	opGlobalGet   = 0x23
+	opGlobalSet   = 0x24
+	opI64Const    = 0x42
+	opI64LtS      = 0x53
+	opI64Sub      = 0x7D
+	opI64ExtendU  = 0xAD
+	opMisc        = 0xFC
+
+	blockTypeEmpty = 0x40
+	valTypeI64     = 0x7E
+	externGlobal   = 0x03
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+type wasmSection struct {
+	id      byte
+	content []byte
+}
+
+// instrumentGas returns a copy of a WASM module with gas metering injected
+func instrumentGas(code []byte) ([]byte, error) {
+	sections, err := parseSections(code)
+	if err != nil {
+		return nil, err
+	}
+
+	// The gas global is appended after all imported and defined globals
+	gasIndex, err := countGlobals(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := paramCounts(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	global := []byte{valTypeI64, 0x01, opI64Const, 0x00, opEnd}
+	export := appendName(nil, gasGlobalName)
+	export = append(export, externGlobal)
+	export = appendULEB(export, uint64(gasIndex))
+
+	sections, err = appendEntry(sections, sectionGlobal, global, nil)
+	if err != nil {
+		return nil, err
+	}
+	sections, err = appendEntry(sections, sectionExport, export, checkExportName(gasGlobalName))
+	if err != nil {
+		return nil, err
+	}
+	err = instrumentCode(sections, func(fn uint32, body []byte) ([]byte, error) {
+		if int(fn) >= len(params) {
+			return nil, errors.New("function has no type")
+		}
+		return instrumentBody(body, gasIndex, params[fn])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeSections(sections), nil
+}
+
+// parseSections splits a WASM module into its sections
+func parseSections(code []byte) ([]wasmSection, error) {
+	if len(code) < len(wasmHeader) || string(code[:len(wasmHeader)]) != string(wasmHeader) {
+		return nil, errors.New("invalid wasm header")
+	}
+
+	var sections []wasmSection
+	r := &wasmReader{buf: code, pos: len(wasmHeader)}
+	for !r.eof() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		content, err := r.vec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read section %d: %w", id, err)
+		}
+		sections = append(sections, wasmSection{id: id, content: content})
+	}
+	return sections, nil
+}
+
+// encodeSections assembles a WASM module from its sections
+func encodeSections(sections []wasmSection) []byte {
+	out := append([]byte{}, wasmHeader...)
+	for _, s := range sections {
+		out = append(out, s.id)
+		out = appendULEB(out, uint64(len(s.content)))
+		out = append(out, s.content...)
+	}
+	return out
+}
+
+// countGlobals returns the number of imported and defined globals, which is the index of the next global
+func countGlobals(sections []wasmSection) (uint32, error) {
+	var count uint32
+	for _, s := range sections {
+		var n uint32
+		var err error
+		switch s.id {
+		case sectionImport:
+			n, err = countImportedGlobals(s.content)
+		case sectionGlobal:
+			n, err = (&wasmReader{buf: s.content}).u32()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read section %d: %w", s.id, err)
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// paramCounts returns the number of parameters of every function defined in a module, in code section order
+func paramCounts(sections []wasmSection) ([]uint32, error) {
+	var types, params []uint32
+	for _, s := range sections {
+		r := &wasmReader{buf: s.content}
+		var err error
+		switch s.id {
+		case sectionType:
+			err = r.each(func() error {
+				if form, err := r.byte(); err != nil {
+					return err
+				} else if form != 0x60 {
+					return fmt.Errorf("invalid function type 0x%02x", form)
+				}
+				n, err := r.u32()
+				if err != nil {
+					return err
+				}
+				// Value types are single bytes
+				if _, err := r.bytes(int(n)); err != nil {
+					return err
+				}
+				types = append(types, n)
+				_, err = r.vec()
+				return err
+			})
+		case sectionFunction:
+			err = r.each(func() error {
+				typeIdx, err := r.u32()
+				if err != nil {
+					return err
+				}
+				if int(typeIdx) >= len(types) {
+					return fmt.Errorf("invalid type index %d", typeIdx)
+				}
+				params = append(params, types[typeIdx])
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read section %d: %w", s.id, err)
+		}
+	}
+	return params, nil
+}
+
+// sectionOrder returns the position of a known section in the module, custom sections have none
+func sectionOrder(id byte) int {
+	switch id {
+	case sectionCustom:
+		return -1
+	case sectionDataCount:
+		// The data count section sits between the element and code sections
+		return sectionElement*2 + 1
+	default:
+		return int(id) * 2
+	}
+}
+
+// appendEntry appends an entry to a vector section, creating the section in place if the module lacks it
+func appendEntry(sections []wasmSection, id byte, entry []byte, check func(content []byte) error) ([]wasmSection, error) {
+	for i, s := range sections {
+		if s.id != id {
+			continue
+		}
+		if check != nil {
+			if err := check(s.content); err != nil {
+				return nil, err
+			}
+		}
+		r := &wasmReader{buf: s.content}
+		n, err := r.u32()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read section %d: %w", id, err)
+		}
+		content := appendULEB(nil, uint64(n)+1)
+		content = append(content, s.content[r.pos:]...)
+		sections[i].content = append(content, entry...)
+		return sections, nil
+	}
+
+	pos := len(sections)
+	for i, s := range sections {
+		if sectionOrder(s.id) > sectionOrder(id) {
+			pos = i
+			break
+		}
+	}
+	section := wasmSection{id: id, content: append([]byte{0x01}, entry...)}
+	sections = append(sections[:pos], append([]wasmSection{section}, sections[pos:]...)...)
+	return sections, nil
+}
+
+// countImportedGlobals returns the number of globals in an import section
+func countImportedGlobals(content []byte) (uint32, error) {
+	r := &wasmReader{buf: content}
+	var globals uint32
+	err := r.eachImport(func(kind byte) error {
+		if kind == externGlobal {
+			globals++
+		}
+		return r.skipImportDesc(kind)
+	})
+	return globals, err
+}
+
+// checkExportName returns a check rejecting modules that already export name
+func checkExportName(name string) func(content []byte) error {
+	return func(content []byte) error {
+		r := &wasmReader{buf: content}
+		return r.each(func() error {
+			exported, err := r.vec()
+			if err != nil {
+				return err
+			}
+			if string(exported) == name {
+				return fmt.Errorf("module already exports %s", name)
+			}
+			if _, err := r.byte(); err != nil {
+				return err
+			}
+			return r.skipLEB()
+		})
+	}
+}
+
+// instrumentCode rewrites every function body in the code section of a module, fn is the index of the body
+// in the code section
+func instrumentCode(sections []wasmSection, rewrite func(fn uint32, body []byte) ([]byte, error)) error {
+	for i, s := range sections {
+		if s.id != sectionCode {
+			continue
+		}
+		r := &wasmReader{buf: s.content}
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		out := appendULEB(nil, uint64(n))
+		for j := uint32(0); j < n; j++ {
+			body, err := r.vec()
+			if err != nil {
+				return fmt.Errorf("failed to read function %d: %w", j, err)
+			}
+			body, err = rewrite(j, body)
+			if err != nil {
+				return fmt.Errorf("failed to instrument function %d: %w", j, err)
+			}
+			out = appendULEB(out, uint64(len(body)))
+			out = append(out, body...)
+		}
+		sections[i].content = out
+	}
+	return nil
+}
+
+// instrumentBody splits a function body into basic blocks and prefixes each of them with a charge
+// of one gas per instruction. A block ends after any instruction that starts, ends or leaves a block,
+// so the start of every loop iteration and every branch target is charged.
+// Bulk memory and table instructions are charged their length operand on top, which is kept in an i32 local
+// appended to the locals of the function, params is the number of its parameters.
+func instrumentBody(body []byte, gasIndex, params uint32) ([]byte, error) {
+	r := &wasmReader{buf: body}
+	groups, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	groupsStart := r.pos
+	locals := uint64(params)
+	for i := uint32(0); i < groups; i++ {
+		n, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.byte(); err != nil {
+			return nil, err
+		}
+		locals += uint64(n)
+	}
+	if locals >= 1<<32-1 {
+		return nil, errors.New("too many locals")
+	}
+	groupsEnd, lengthLocal := r.pos, uint32(locals)
+
+	var out, block []byte
+	bulk, cost := false, int64(0)
+	for !r.eof() {
+		start := r.pos
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipChecked(op, gasIndex); err != nil {
+			return nil, err
+		}
+		cost++
+		if op == opMisc && chargesLength(body[start+1:]) {
+			bulk = true
+			block = appendLengthCharge(block, gasIndex, lengthLocal)
+		}
+		block = append(block, body[start:r.pos]...)
+		switch op {
+		case opUnreachable, opBlock, opLoop, opIf, opElse, opEnd, opBr, opBrIf, opBrTable, opReturn:
+			out = appendCharge(out, gasIndex, cost)
+			out = append(out, block...)
+			block, cost = block[:0], 0
+		}
+	}
+	if len(block) != 0 {
+		return nil, errors.New("function body does not end with end")
+	}
+
+	header := body[:groupsEnd]
+	if bulk {
+		header = appendULEB(nil, uint64(groups)+1)
+		header = append(header, body[groupsStart:groupsEnd]...)
+		header = append(header, 0x01, valTypeI32)
+	}
+	return append(header, out...), nil
+}
+
+// chargesLength reports whether the 0xFC prefixed instruction whose operands start at imm takes a length,
+// the number of bytes or table entries it touches, as its last operand
+func chargesLength(imm []byte) bool {
+	sub, err := (&wasmReader{buf: imm}).u32()
+	if err != nil {
+		return false
+	}
+	switch sub {
+	case 8, 10, 11, 12, 14, 15, 17:
+		// memory.init, memory.copy, memory.fill, table.init, table.copy, table.grow, table.fill
+		return true
+	}
+	return false
+}
+
+// appendLengthCharge appends code that charges one gas per unit of the length on top of the operand stack,
+// leaving the stack as it was
+func appendLengthCharge(out []byte, gasIndex, lengthLocal uint32) []byte {
+	out = append(out, opLocalSet)
+	out = appendULEB(out, uint64(lengthLocal))
+	out = append(out, opGlobalGet)
+	out = appendULEB(out, uint64(gasIndex))
+	out = append(out, opLocalGet)
+	out = appendULEB(out, uint64(lengthLocal))
+	out = append(out, opI64ExtendU, opI64Sub, opGlobalSet)
+	out = appendULEB(out, uint64(gasIndex))
+	out = append(out, opGlobalGet)
+	out = appendULEB(out, uint64(gasIndex))
+	out = append(out, opI64Const, 0x00, opI64LtS, opIf, blockTypeEmpty, opUnreachable, opEnd, opLocalGet)
+	return appendULEB(out, uint64(lengthLocal))
+}
+
+// appendCharge appends code that subtracts cost from the gas global and traps when it goes negative
+func appendCharge(out []byte, gasIndex uint32, cost int64) []byte {
+	out = append(out, opGlobalGet)
+	out = appendULEB(out, uint64(gasIndex))
+	out = append(out, opI64Const)
+	out = appendSLEB(out, cost)
+	out = append(out, opI64Sub, opGlobalSet)
+	out = appendULEB(out, uint64(gasIndex))
+	out = append(out, opGlobalGet)
+	out = appendULEB(out, uint64(gasIndex))
+	return append(out, opI64Const, 0x00, opI64LtS, opIf, blockTypeEmpty, opUnreachable, opEnd)
+}
+
+// wasmReader decodes the WASM binary format
+type wasmReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *wasmReader) eof() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.eof() {
+		return 0, errors.New("unexpected end of wasm")
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) bytes(n int) ([]byte, error) {
+	if n < 0 || len(r.buf)-r.pos < n {
+		return nil, errors.New("unexpected end of wasm")
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// u32 reads an unsigned LEB128 value
+func (r *wasmReader) u32() (uint32, error) {
+	var v uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("invalid LEB128 value")
+}
+
+// skipLEB skips a signed or unsigned LEB128 value of any size
+func (r *wasmReader) skipLEB() error {
+	for i := 0; i < 10; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+	return errors.New("invalid LEB128 value")
+}
+
+// vec reads a length prefixed byte vector
+func (r *wasmReader) vec() ([]byte, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	return r.bytes(int(n))
+}
+
+// skipLocals skips the local declarations at the start of a function body
+func (r *wasmReader) skipLocals() error {
+	groups, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < groups; i++ {
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *wasmReader) skipLimits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if err := r.skipLEB(); err != nil {
+		return err
+	}
+	if flags&0x01 != 0 {
+		return r.skipLEB()
+	}
+	return nil
+}
+
+// skipChecked skips the immediate operands of an instruction like skipImmediates, and rejects references
+// to globals at or above globals, the index where instrumentation appends its own
+func (r *wasmReader) skipChecked(op byte, globals uint32) error {
+	if op != opGlobalGet && op != opGlobalSet {
+		return r.skipImmediates(op)
+	}
+	index, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if index >= globals {
+		return fmt.Errorf("invalid global index %d, the module has %d globals", index, globals)
+	}
+	return nil
+}
+
+// skipImmediates skips the immediate operands of an instruction
+func (r *wasmReader) skipImmediates(op byte) error {
+	switch {
+	case op == opBlock || op == opLoop || op == opIf:
+		// Block type is empty, a value type or a signed type index
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if b == blockTypeEmpty || (b >= 0x6F && b <= 0x7F) {
+			return nil
+		}
+		r.pos--
+		return r.skipLEB()
+	case op == opBr || op == opBrIf || op == 0x10 || op == 0xD2 || (op >= 0x20 && op <= 0x26):
+		// br, br_if, call, ref.func, local.*, global.*, table.get, table.set
+		return r.skipLEB()
+	case op == opBrTable:
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i <= n; i++ {
+			if err := r.skipLEB(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case op == 0x11:
+		// call_indirect
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+		return r.skipLEB()
+	case op == 0x1C:
+		// select with types
+		_, err := r.vec()
+		return err
+	case op >= 0x28 && op <= 0x3E:
+		// memory load and store
+		return r.skipMemArg()
+	case op == 0x3F || op == 0x40 || op == 0xD0:
+		// memory.size, memory.grow, ref.null
+		_, err := r.byte()
+		return err
+	case op == 0x41 || op == opI64Const:
+		return r.skipLEB()
+	case op == 0x43:
+		_, err := r.bytes(4)
+		return err
+	case op == 0x44:
+		_, err := r.bytes(8)
+		return err
+	case op == 0xFC:
+		return r.skipMiscImmediates()
+	case op == 0xFD:
+		return r.skipVectorImmediates()
+	case op <= 0x01 || op == opElse || op == opEnd || op == opReturn || op == 0x1A || op == 0x1B ||
+		(op >= 0x45 && op <= 0xC4) || op == 0xD1:
+		return nil
+	default:
+		return fmt.Errorf("unsupported opcode 0x%02x", op)
+	}
+}
+
+func (r *wasmReader) skipMemArg() error {
+	if err := r.skipLEB(); err != nil {
+		return err
+	}
+	return r.skipLEB()
+}
+
+// skipMiscImmediates skips the operands of 0xFC prefixed instructions
+func (r *wasmReader) skipMiscImmediates() error {
+	sub, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case sub <= 7:
+		// saturating truncation
+		return nil
+	case sub == 8:
+		// memory.init
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+		_, err := r.byte()
+		return err
+	case sub == 10:
+		// memory.copy
+		_, err := r.bytes(2)
+		return err
+	case sub == 11:
+		// memory.fill
+		_, err := r.byte()
+		return err
+	case sub == 12 || sub == 14:
+		// table.init, table.copy
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+		return r.skipLEB()
+	case sub <= 17:
+		// data.drop, elem.drop, table.grow, table.size, table.fill
+		return r.skipLEB()
+	default:
+		return fmt.Errorf("unsupported opcode 0xfc %d", sub)
+	}
+}
+
+// skipVectorImmediates skips the operands of 0xFD prefixed (SIMD) instructions
+func (r *wasmReader) skipVectorImmediates() error {
+	sub, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case sub <= 11 || sub == 92 || sub == 93:
+		// v128 loads and stores
+		return r.skipMemArg()
+	case sub == 12 || sub == 13:
+		// v128.const, i8x16.shuffle
+		_, err := r.bytes(16)
+		return err
+	case sub >= 21 && sub <= 34:
+		// extract and replace lane
+		_, err := r.byte()
+		return err
+	case sub >= 84 && sub <= 91:
+		// load and store lane
+		if err := r.skipMemArg(); err != nil {
+			return err
+		}
+		_, err := r.byte()
+		return err
+	default:
+		return nil
+	}
+}
+
+func appendULEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b = append(b, c|0x80)
+			continue
+		}
+		return append(b, c)
+	}
+}
+
+func appendSLEB(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	b = appendULEB(b, uint64(len(name)))
+	return append(b, name...)
+}
@@ -0,0 +1,267 @@
+package wasi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Resource limits of contract instances.
+//
+// Linear memory is capped by the runtime, and modules declaring more memory than allowed are rejected at
+// deploy time. wazero doesn't cap tables, so with a table limit every table must declare a maximum within it,
+// which table.grow can't go past. wazero has no limit on the call stack of a module,
+// so when a stack depth is configured every call site is wrapped with code that counts the depth
+// in an injected i32 global, exported as depthGlobalName, and traps once it exceeds the limit.
+
+// depthGlobalName is the export name of the injected call depth global
+const depthGlobalName = "govm_call_depth"
+
+// ErrStackOverflow is returned when nested function calls inside a contract exceed the stack depth limit
+var ErrStackOverflow = errors.New("stack depth exceeded")
+
+// WASM opcodes used by the call depth instrumentation
+const (
+	opCall         = 0x10
+	opCallIndirect = 0x11
+	opI32Const     = 0x41
+	opI32GtU       = 0x4B
+	opI32Add       = 0x6A
+	opI32Sub       = 0x6B
+
+	valTypeI32   = 0x7F
+	externTable  = 0x01
+	externMemory = 0x02
+)
+
+// checkModuleLimits rejects modules whose declared memory minimum exceeds the limit, and with a table limit
+// modules with a table that has no maximum or whose maximum exceeds it. 0 means no limit.
+func checkModuleLimits(code []byte, maxMemoryPages, maxTableSize uint32) error {
+	sections, err := parseSections(code)
+	if err != nil {
+		return err
+	}
+	checkMemory := func(min uint32) error {
+		if maxMemoryPages > 0 && min > maxMemoryPages {
+			return fmt.Errorf("memory minimum of %d pages exceeds the limit of %d pages", min, maxMemoryPages)
+		}
+		return nil
+	}
+	checkTable := func(max uint32, hasMax bool) error {
+		if maxTableSize == 0 {
+			return nil
+		}
+		if !hasMax {
+			return fmt.Errorf("table has no maximum size, the limit is %d entries", maxTableSize)
+		}
+		if max > maxTableSize {
+			return fmt.Errorf("table maximum of %d entries exceeds the limit of %d entries", max, maxTableSize)
+		}
+		return nil
+	}
+
+	for _, s := range sections {
+		r := &wasmReader{buf: s.content}
+		switch s.id {
+		case sectionImport:
+			err = r.eachImport(func(kind byte) error {
+				switch kind {
+				case externTable:
+					if _, err := r.byte(); err != nil {
+						return err
+					}
+					_, max, hasMax, err := r.limits()
+					if err != nil {
+						return err
+					}
+					return checkTable(max, hasMax)
+				case externMemory:
+					min, _, _, err := r.limits()
+					if err != nil {
+						return err
+					}
+					return checkMemory(min)
+				}
+				return r.skipImportDesc(kind)
+			})
+		case sectionTable:
+			err = r.each(func() error {
+				if _, err := r.byte(); err != nil {
+					return err
+				}
+				_, max, hasMax, err := r.limits()
+				if err != nil {
+					return err
+				}
+				return checkTable(max, hasMax)
+			})
+		case sectionMemory:
+			err = r.each(func() error {
+				min, _, _, err := r.limits()
+				if err != nil {
+					return err
+				}
+				return checkMemory(min)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instrumentCallDepth returns a copy of a WASM module that traps when nested calls go deeper than maxDepth
+func instrumentCallDepth(code []byte, maxDepth uint32) ([]byte, error) {
+	sections, err := parseSections(code)
+	if err != nil {
+		return nil, err
+	}
+	depthIndex, err := countGlobals(sections)
+	if err != nil {
+		return nil, err
+	}
+	global := []byte{valTypeI32, 0x01, opI32Const, 0x00, opEnd}
+	export := appendName(nil, depthGlobalName)
+	export = append(export, externGlobal)
+	export = appendULEB(export, uint64(depthIndex))
+
+	sections, err = appendEntry(sections, sectionGlobal, global, nil)
+	if err != nil {
+		return nil, err
+	}
+	sections, err = appendEntry(sections, sectionExport, export, checkExportName(depthGlobalName))
+	if err != nil {
+		return nil, err
+	}
+	err = instrumentCode(sections, func(_ uint32, body []byte) ([]byte, error) {
+		return instrumentCalls(body, depthIndex, maxDepth)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeSections(sections), nil
+}
+
+// instrumentCalls increments the depth global before every call, trapping above maxDepth, and decrements it after
+func instrumentCalls(body []byte, depthIndex, maxDepth uint32) ([]byte, error) {
+	r := &wasmReader{buf: body}
+	if err := r.skipLocals(); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, body[:r.pos]...)
+
+	for !r.eof() {
+		start := r.pos
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipChecked(op, depthIndex); err != nil {
+			return nil, err
+		}
+		if op != opCall && op != opCallIndirect {
+			out = append(out, body[start:r.pos]...)
+			continue
+		}
+
+		// The depth update leaves the operand stack untouched, so call arguments and results stay in place
+		out = appendDepthChange(out, depthIndex, opI32Add)
+		out = append(out, opGlobalGet)
+		out = appendULEB(out, uint64(depthIndex))
+		out = append(out, opI32Const)
+		out = appendSLEB(out, int64(maxDepth))
+		out = append(out, opI32GtU, opIf, blockTypeEmpty, opUnreachable, opEnd)
+		out = append(out, body[start:r.pos]...)
+		out = appendDepthChange(out, depthIndex, opI32Sub)
+	}
+	return out, nil
+}
+
+// appendDepthChange appends code that adds or subtracts one from the depth global
+func appendDepthChange(out []byte, depthIndex uint32, op byte) []byte {
+	out = append(out, opGlobalGet)
+	out = appendULEB(out, uint64(depthIndex))
+	out = append(out, opI32Const, 0x01, op, opGlobalSet)
+	return appendULEB(out, uint64(depthIndex))
+}
+
+// stackOverflow reports err as ErrStackOverflow when an instrumented module went deeper than maxDepth.
+// A trap does not unwind the depth global, so it still holds the depth that was rejected.
+func stackOverflow(m api.Module, maxDepth uint32, err error) error {
+	depth := m.ExportedGlobal(depthGlobalName)
+	if err != nil && depth != nil && uint32(depth.Get()) > maxDepth && !errors.Is(err, ErrStackOverflow) {
+		return fmt.Errorf("%w: %v", ErrStackOverflow, err)
+	}
+	return err
+}
+
+// each calls fn for every entry of a vector
+func (r *wasmReader) each(fn func() error) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachImport calls fn with the kind of every import, fn must consume the import description
+func (r *wasmReader) eachImport(fn func(kind byte) error) error {
+	return r.each(func() error {
+		if _, err := r.vec(); err != nil {
+			return err
+		}
+		if _, err := r.vec(); err != nil {
+			return err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return err
+		}
+		return fn(kind)
+	})
+}
+
+// skipImportDesc skips the description of an import of the given kind
+func (r *wasmReader) skipImportDesc(kind byte) error {
+	switch kind {
+	case 0x00: // function
+		return r.skipLEB()
+	case externTable:
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+		return r.skipLimits()
+	case externMemory:
+		return r.skipLimits()
+	case externGlobal:
+		_, err := r.bytes(2)
+		return err
+	default:
+		return fmt.Errorf("unknown import kind %d", kind)
+	}
+}
+
+// limits reads limits and returns their minimum, and their maximum if they have one
+func (r *wasmReader) limits() (min, max uint32, hasMax bool, err error) {
+	flags, err := r.byte()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if min, err = r.u32(); err != nil {
+		return 0, 0, false, err
+	}
+	if flags&0x01 != 0 {
+		if max, err = r.u32(); err != nil {
+			return 0, 0, false, err
+		}
+		hasMax = true
+	}
+	return min, max, hasMax, nil
+}
@@ -0,0 +1,55 @@
+package wasi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/govm-net/vm/types"
+	"github.com/tetratelabs/wazero"
+)
+
+// Runtime executes contract code for the engine.
+// WazeroVM runs WebAssembly, other implementations may run contracts differently as long as
+// they serve the core API from the BlockchainContext passed to Execute.
+type Runtime interface {
+	// DeployContractWithAddress stores code for a contract and creates its default object
+	DeployContractWithAddress(ctx types.BlockchainContext, code []byte, sender types.Address, contractAddr types.Address) (types.Address, error)
+	// UpgradeContract replaces the code of a deployed contract, keeping its state objects
+	UpgradeContract(contractAddr types.Address, code []byte) error
+	// Code returns the code a contract was deployed or last upgraded with
+	Code(contractAddr types.Address) ([]byte, error)
+	// Execute calls a contract function with JSON encoded parameters
+	Execute(runCtx context.Context, ctx types.BlockchainContext, contractAddr types.Address, functionName string, params []byte) (*types.ExecutionResult, error)
+	// DeleteContract removes the code of a contract
+	DeleteContract(ctx types.BlockchainContext, contractAddr types.Address)
+	// Close releases the resources of the runtime
+	Close() error
+}
+
+var _ Runtime = (*WazeroVM)(nil)
+
+// Mode selects how wazero runs contract code
+type Mode int
+
+const (
+	// ModeAuto compiles contracts to machine code where wazero supports it, and interprets them elsewhere
+	ModeAuto Mode = iota
+	// ModeCompiler compiles contracts to machine code, only supported by wazero on amd64 and arm64
+	ModeCompiler
+	// ModeInterpreter interprets contracts, slower but starts faster and runs everywhere
+	ModeInterpreter
+)
+
+// runtimeConfig returns the wazero runtime configuration of the mode
+func (m Mode) runtimeConfig() (wazero.RuntimeConfig, error) {
+	switch m {
+	case ModeAuto:
+		return wazero.NewRuntimeConfig(), nil
+	case ModeCompiler:
+		return wazero.NewRuntimeConfigCompiler(), nil
+	case ModeInterpreter:
+		return wazero.NewRuntimeConfigInterpreter(), nil
+	default:
+		return nil, fmt.Errorf("unknown wazero mode: %d", m)
+	}
+}
@@ -0,0 +1,66 @@
+package wasi
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ErrInvalidModule is returned when a prebuilt module doesn't fit the contract interface of the host
+var ErrInvalidModule = errors.New("invalid contract module")
+
+// contractExports are the functions every contract module must export, with their signatures
+var contractExports = map[string]struct{ params, results []api.ValueType }{
+	"allocate":             {[]api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+	"deallocate":           {[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil},
+	"handle_contract_call": {[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+	"get_buffer_address":   {nil, []api.ValueType{api.ValueTypeI32}},
+}
+
+// ValidateModule checks that WASM code not built by the compiler package can run as a contract:
+// it may only import functions of the env and WASI host modules with matching signatures,
+// and must export its memory and the functions the host calls.
+func (vm *WazeroVM) ValidateModule(wasmCode []byte) error {
+	if err := checkModuleLimits(wasmCode, vm.config.MaxMemoryPages, vm.config.MaxTableSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidModule, err)
+	}
+	compiled, err := vm.runtime.CompileModule(vm.ctx, wasmCode)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidModule, err)
+	}
+	defer compiled.Close(vm.ctx)
+
+	if len(compiled.ImportedMemories()) > 0 {
+		return fmt.Errorf("%w: memory must not be imported", ErrInvalidModule)
+	}
+	for _, fn := range compiled.ImportedFunctions() {
+		moduleName, name, _ := fn.Import()
+		if moduleName != "env" && moduleName != "wasi_snapshot_preview1" {
+			return fmt.Errorf("%w: import from unknown module %s", ErrInvalidModule, moduleName)
+		}
+		host, ok := vm.runtime.Module(moduleName).ExportedFunctionDefinitions()[name]
+		if !ok {
+			return fmt.Errorf("%w: unknown host function %s.%s", ErrInvalidModule, moduleName, name)
+		}
+		if !slices.Equal(fn.ParamTypes(), host.ParamTypes()) || !slices.Equal(fn.ResultTypes(), host.ResultTypes()) {
+			return fmt.Errorf("%w: signature of host function %s.%s does not match", ErrInvalidModule, moduleName, name)
+		}
+	}
+
+	if len(compiled.ExportedMemories()) == 0 {
+		return fmt.Errorf("%w: memory is not exported", ErrInvalidModule)
+	}
+	exports := compiled.ExportedFunctions()
+	for name, sig := range contractExports {
+		fn, ok := exports[name]
+		if !ok {
+			return fmt.Errorf("%w: function %s is not exported", ErrInvalidModule, name)
+		}
+		if !slices.Equal(fn.ParamTypes(), sig.params) || !slices.Equal(fn.ResultTypes(), sig.results) {
+			return fmt.Errorf("%w: exported function %s has the wrong signature", ErrInvalidModule, name)
+		}
+	}
+	return nil
+}
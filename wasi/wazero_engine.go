@@ -1,14 +1,18 @@
 package wasi
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	api1 "github.com/govm-net/vm/api"
 	"github.com/govm-net/vm/core"
@@ -28,14 +32,64 @@ type WazeroVM struct {
 	contractDir string
 
 	// wazero runtime
-	ctx context.Context
+	ctx     context.Context
+	runtime wazero.Runtime
+	cache   wazero.CompilationCache
 
 	// env module
 	envModule api.Module
+
+	// Compiled modules of deployed contracts
+	modules map[types.Address]*cachedModule
+
+	// Meter gas on the host by instrumenting contract code
+	metering bool
+
+	// Resource limits of contract instances
+	config api1.ContractConfig
+
+	// Derive clocks and randomness from the block and capture output, see WithDeterministic
+	deterministic bool
+
+	// Let contracts print core.Debug output
+	debug bool
+}
+
+// ErrExecutionTimeout is returned when the context.Context of an execution hits its deadline
+var ErrExecutionTimeout = errors.New("execution timeout")
+
+// blockchainContextKey is the context.Context key of the BlockchainContext used by host functions
+type blockchainContextKey struct{}
+
+// withBlockchainContext returns a copy of parent carrying the BlockchainContext of an execution
+func withBlockchainContext(parent context.Context, ctx types.BlockchainContext) context.Context {
+	return context.WithValue(parent, blockchainContextKey{}, ctx)
+}
+
+// blockchainContext returns the BlockchainContext of the execution that invoked a host function
+func blockchainContext(ctx context.Context) types.BlockchainContext {
+	bc, _ := ctx.Value(blockchainContextKey{}).(types.BlockchainContext)
+	return bc
 }
 
-// NewWazeroVM creates a new wazero virtual machine instance
+// NewWazeroVM creates a new wazero virtual machine instance with the default contract limits
 func NewWazeroVM(contractDir string) (*WazeroVM, error) {
+	return NewWazeroVMWithConfig(contractDir, api1.DefaultContractConfig())
+}
+
+// NewWazeroVMWithConfig creates a new wazero virtual machine instance,
+// contract instances are limited to the memory, table size and stack depth of config
+func NewWazeroVMWithConfig(contractDir string, config api1.ContractConfig) (*WazeroVM, error) {
+	return NewWazeroVMWithMode(contractDir, config, ModeAuto)
+}
+
+// NewWazeroVMWithMode creates a new wazero virtual machine instance running contracts in the given mode
+func NewWazeroVMWithMode(contractDir string, config api1.ContractConfig, mode Mode) (*WazeroVM, error) {
+	runtimeConfig, err := mode.runtimeConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Ensure contract directory exists
 	if contractDir != "" {
 		if err := os.MkdirAll(contractDir, 0755); err != nil {
@@ -45,11 +99,35 @@ func NewWazeroVM(contractDir string) (*WazeroVM, error) {
 
 	// Create wazero runtime
 	ctx := context.Background()
+	// Executions are aborted when their context.Context is done, even inside loops without host calls
+	runtimeConfig = runtimeConfig.WithCloseOnContextDone(true)
+	if config.MaxMemoryPages > 0 {
+		runtimeConfig = runtimeConfig.WithMemoryLimitPages(config.MaxMemoryPages)
+	}
+
+	// Persist compiled code next to the contracts so restarts don't recompile
+	var cache wazero.CompilationCache
+	if contractDir != "" {
+		cache, err = wazero.NewCompilationCacheWithDir(filepath.Join(contractDir, "cache"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compilation cache: %w", err)
+		}
+		runtimeConfig = runtimeConfig.WithCompilationCache(cache)
+	}
 
 	vm := &WazeroVM{
 		// contracts:   make(map[types.Address][]byte),
 		contractDir: contractDir,
 		ctx:         ctx,
+		runtime:     wazero.NewRuntimeWithConfig(ctx, runtimeConfig),
+		cache:       cache,
+		modules:     make(map[types.Address]*cachedModule),
+		config:      config,
+	}
+
+	if err := vm.initHostModules(); err != nil {
+		vm.Close()
+		return nil, err
 	}
 
 	return vm, nil
@@ -68,6 +146,9 @@ func (vm *WazeroVM) DeployContractWithAddress(ctx types.BlockchainContext, wasmC
 	if len(wasmCode) == 0 {
 		return types.Address{}, errors.New("contract code cannot be empty")
 	}
+	if err := checkModuleLimits(wasmCode, vm.config.MaxMemoryPages, vm.config.MaxTableSize); err != nil {
+		return types.Address{}, fmt.Errorf("contract exceeds resource limits: %w", err)
+	}
 
 	// Store contract code
 	// vm.contractsLock.Lock()
@@ -85,30 +166,104 @@ func (vm *WazeroVM) DeployContractWithAddress(ctx types.BlockchainContext, wasmC
 		}
 	}
 
+	// Drop any module compiled from previous code at this address
+	vm.contractsLock.Lock()
+	vm.evictModule(contractAddr)
+	vm.contractsLock.Unlock()
+
 	return contractAddr, nil
 }
 
+// UpgradeContract replaces the code of a deployed contract, its state objects are kept.
+// The new code is written next to the old one and renamed over it, so executions see either version.
+func (vm *WazeroVM) UpgradeContract(contractAddr types.Address, wasmCode []byte) error {
+	if len(wasmCode) == 0 {
+		return errors.New("contract code cannot be empty")
+	}
+	if err := checkModuleLimits(wasmCode, vm.config.MaxMemoryPages, vm.config.MaxTableSize); err != nil {
+		return fmt.Errorf("contract exceeds resource limits: %w", err)
+	}
+	contractPath := filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)+".wasm")
+	if _, err := os.Stat(contractPath); err != nil {
+		return fmt.Errorf("contract does not exist: %x: %w", contractAddr, err)
+	}
+
+	tmpPath := contractPath + ".tmp"
+	if err := os.WriteFile(tmpPath, wasmCode, 0644); err != nil {
+		return fmt.Errorf("failed to store contract code: %w", err)
+	}
+
+	vm.contractsLock.Lock()
+	defer vm.contractsLock.Unlock()
+	if err := os.Rename(tmpPath, contractPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace contract code: %w", err)
+	}
+	vm.evictModule(contractAddr)
+	return nil
+}
+
+// Code returns the WASM code of a deployed contract
+func (vm *WazeroVM) Code(contractAddr types.Address) ([]byte, error) {
+	vm.contractsLock.RLock()
+	defer vm.contractsLock.RUnlock()
+	code, err := os.ReadFile(filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)+".wasm"))
+	if err != nil {
+		return nil, fmt.Errorf("contract does not exist: %x: %w", contractAddr, err)
+	}
+	return code, nil
+}
+
 // DeleteContract deletes a WebAssembly contract
 func (vm *WazeroVM) DeleteContract(ctx types.BlockchainContext, contractAddr types.Address) {
 	vm.contractsLock.Lock()
 	defer vm.contractsLock.Unlock()
 	// Delete from contract map
 	// delete(vm.contracts, contractAddr)
-	os.RemoveAll(filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)))
+	vm.evictModule(contractAddr)
+	if vm.contractDir != "" {
+		os.Remove(filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)+".wasm"))
+	}
 }
 
-func (vm *WazeroVM) initContract(ctx types.BlockchainContext, wasmCode []byte) (api.Module, error) {
-	ctx1 := context.Background()
-	runtime := wazero.NewRuntime(ctx1)
+// WithMetering enables or disables host-side gas metering.
+// Compiled modules are dropped so contracts are recompiled with or without instrumentation.
+func (vm *WazeroVM) WithMetering(enabled bool) *WazeroVM {
+	vm.contractsLock.Lock()
+	defer vm.contractsLock.Unlock()
+	vm.metering = enabled
+	for contractAddr := range vm.modules {
+		vm.evictModule(contractAddr)
+	}
+	return vm
+}
 
-	// Compile WASM module
-	compiled, err := runtime.CompileModule(ctx1, wasmCode)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compile WebAssembly module: %w", err)
+// cachedModule is the compiled module of a contract. Executions may still instantiate it after it was evicted,
+// so it is closed once the cache and every execution using it released it.
+type cachedModule struct {
+	compiled wazero.CompiledModule
+	refs     atomic.Int32 // one for the cache, one for each execution
+}
+
+// release drops one reference to the module, closing it with the last one
+func (m *cachedModule) release(ctx context.Context) {
+	if m.refs.Add(-1) == 0 {
+		m.compiled.Close(ctx)
+	}
+}
+
+// evictModule removes the cached compiled module of a contract, contractsLock must be held
+func (vm *WazeroVM) evictModule(contractAddr types.Address) {
+	if cached, ok := vm.modules[contractAddr]; ok {
+		delete(vm.modules, contractAddr)
+		cached.release(vm.ctx)
 	}
+}
 
+// initHostModules instantiates the env and WASI host modules shared by all contracts
+func (vm *WazeroVM) initHostModules() error {
 	// Create import object
-	builder := runtime.NewHostModuleBuilder("env")
+	builder := vm.runtime.NewHostModuleBuilder("env")
 
 	// Add memory
 	builder.NewFunctionBuilder().
@@ -120,7 +275,7 @@ func (vm *WazeroVM) initContract(ctx types.BlockchainContext, wasmCode []byte) (
 	builder.NewFunctionBuilder().
 		WithParameterNames("funcID", "argPtr", "argLen", "bufferPtr").
 		WithResultNames("result").
-		WithFunc(func(_ context.Context, m api.Module, funcID, argPtr, argLen, bufferPtr uint32) int32 {
+		WithFunc(func(ctx context.Context, m api.Module, funcID, argPtr, argLen, bufferPtr uint32) int32 {
 			// fmt.Printf("call_host_set: %d, %d, %d, %d\n", funcID, argPtr, argLen, bufferPtr)
 			// Read parameter data
 			mem := m.Memory()
@@ -131,15 +286,16 @@ func (vm *WazeroVM) initContract(ctx types.BlockchainContext, wasmCode []byte) (
 			if !ok || len(argData) != int(argLen) {
 				return 0
 			}
+			chargeGas(m, hostCallGas+int64(argLen))
 
-			return vm.handleHostSet(ctx, m, funcID, argData, bufferPtr)
+			return vm.handleHostSet(blockchainContext(ctx), m, funcID, argData, bufferPtr)
 		}).
 		Export("call_host_set")
 
 	builder.NewFunctionBuilder().
 		WithParameterNames("funcID", "argPtr", "argLen", "buffer").
 		WithResultNames("result").
-		WithFunc(func(_ context.Context, m api.Module, funcID, argPtr, argLen, buffer uint32) int32 {
+		WithFunc(func(ctx context.Context, m api.Module, funcID, argPtr, argLen, buffer uint32) int32 {
 			// fmt.Printf("call_host_get_buffer: %d, %d, %d, %d\n", funcID, argPtr, argLen, buffer)
 			// 读取参数数据
 			mem := m.Memory()
@@ -150,29 +306,32 @@ func (vm *WazeroVM) initContract(ctx types.BlockchainContext, wasmCode []byte) (
 			if !ok || len(argData) != int(argLen) {
 				return 0
 			}
+			chargeGas(m, hostCallGas+int64(argLen))
 
-			return vm.handleHostGetBuffer(ctx, m, funcID, argData, buffer)
+			return vm.handleHostGetBuffer(blockchainContext(ctx), m, funcID, argData, buffer)
 		}).
 		Export("call_host_get_buffer")
 
 	builder.NewFunctionBuilder().
 		WithResultNames("result").
-		WithFunc(func(_ context.Context, _ api.Module) uint32 {
-			return uint32(ctx.BlockHeight())
+		WithFunc(func(ctx context.Context, m api.Module) uint32 {
+			chargeGas(m, hostCallGas)
+			return uint32(blockchainContext(ctx).BlockHeight())
 		}).
 		Export("get_block_height")
 
 	builder.NewFunctionBuilder().
 		WithResultNames("result").
-		WithFunc(func(_ context.Context, _ api.Module) uint32 {
-			return uint32(ctx.BlockTime())
+		WithFunc(func(ctx context.Context, m api.Module) uint32 {
+			chargeGas(m, hostCallGas)
+			return uint32(blockchainContext(ctx).BlockTime())
 		}).
 		Export("get_block_time")
 
 	builder.NewFunctionBuilder().
 		WithParameterNames("addrPtr").
 		WithResultNames("result").
-		WithFunc(func(_ context.Context, m api.Module, addrPtr uint32) uint32 {
+		WithFunc(func(ctx context.Context, m api.Module, addrPtr uint32) uint32 {
 			// 读取地址
 			mem := m.Memory()
 			if mem == nil {
@@ -182,39 +341,193 @@ func (vm *WazeroVM) initContract(ctx types.BlockchainContext, wasmCode []byte) (
 			if !ok || len(addrData) != 20 {
 				return 0
 			}
+			chargeGas(m, hostCallGas)
 
 			var addr types.Address
 			copy(addr[:], addrData)
 
 			// 获取余额
-			return uint32(ctx.Balance(addr))
+			return uint32(blockchainContext(ctx).Balance(addr))
 		}).
 		Export("get_balance")
 
 	// Initialize WASI
 	envModule, err := builder.Instantiate(vm.ctx)
 	if err != nil {
-		return nil, fmt.Errorf("实例化导入对象失败: %w", err)
+		return fmt.Errorf("实例化导入对象失败: %w", err)
 	}
 	vm.envModule = envModule
 
-	wasi_snapshot_preview1.MustInstantiate(vm.ctx, runtime)
+	if _, err := wasi_snapshot_preview1.Instantiate(vm.ctx, vm.runtime); err != nil {
+		return fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+	return nil
+}
 
-	// Create module configuration
+// compiledModule returns the compiled module of a contract, compiling and caching it on first use.
+// The caller must release the module once it is done with it, it stays open until then even if it is evicted.
+func (vm *WazeroVM) compiledModule(contractAddr types.Address) (*cachedModule, error) {
+	// References are only taken while the module is cached and the lock is held, so eviction can't miss one
+	vm.contractsLock.RLock()
+	cached, ok := vm.modules[contractAddr]
+	if ok {
+		cached.refs.Add(1)
+	}
+	vm.contractsLock.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	vm.contractsLock.Lock()
+	defer vm.contractsLock.Unlock()
+	if cached, ok := vm.modules[contractAddr]; ok {
+		cached.refs.Add(1)
+		return cached, nil
+	}
+
+	wasmCode, err := os.ReadFile(filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)+".wasm"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contract code: %w", err)
+	}
+	// The code is validated as deployed, instrumentation appends globals that invalid references would reach
+	if vm.metering || vm.config.MaxStackDepth > 0 {
+		raw, err := vm.runtime.CompileModule(vm.ctx, wasmCode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile WebAssembly module: %w", err)
+		}
+		raw.Close(vm.ctx)
+	}
+	if vm.metering {
+		wasmCode, err = instrumentGas(wasmCode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instrument gas metering: %w", err)
+		}
+	}
+	if vm.config.MaxStackDepth > 0 {
+		wasmCode, err = instrumentCallDepth(wasmCode, vm.config.MaxStackDepth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instrument stack depth limit: %w", err)
+		}
+	}
+
+	// Compile WASM module
+	compiled, err := vm.runtime.CompileModule(vm.ctx, wasmCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile WebAssembly module: %w", err)
+	}
+	cached = &cachedModule{compiled: compiled}
+	cached.refs.Store(2)
+	vm.modules[contractAddr] = cached
+	return cached, nil
+}
+
+// WithDebug enables or disables core.Debug output of contracts
+func (vm *WazeroVM) WithDebug(enabled bool) *WazeroVM {
+	vm.debug = enabled
+	return vm
+}
+
+// initContract instantiates a fresh instance of a compiled contract for one execution.
+// The output of the instance is collected in output, and also echoed to the node's output unless in deterministic mode.
+func (vm *WazeroVM) initContract(ctx context.Context, compiled wazero.CompiledModule, output *bytes.Buffer) (api.Module, error) {
+	// Create module configuration, the instance is anonymous so executions can run concurrently
 	config := wazero.NewModuleConfig().
-		WithName("contract").WithStdout(os.Stdout).WithStderr(os.Stderr)
+		WithName("").WithStdout(io.MultiWriter(os.Stdout, output)).WithStderr(io.MultiWriter(os.Stderr, output))
+	if vm.deterministic {
+		config = deterministicConfig(config, blockchainContext(ctx), output)
+	}
+
+	// A metered module has no gas before its global is set, so _initialize is called afterwards
+	if vm.metering {
+		config = config.WithStartFunctions()
+	} else {
+		config = config.WithStartFunctions("_initialize")
+	}
 
 	// Instantiate module
-	module, err := runtime.InstantiateModule(ctx1, compiled, config.WithStartFunctions("_initialize"))
+	module, err := vm.runtime.InstantiateModule(ctx, compiled, config)
 	if err != nil {
 		fmt.Printf("failed to instantiate module: %v\n", err)
 		return nil, fmt.Errorf("failed to instantiate module: %w", err)
 	}
+	if !vm.metering {
+		return module, nil
+	}
+
+	gas := gasGlobal(module)
+	if gas == nil {
+		module.Close(ctx)
+		return nil, fmt.Errorf("gas global %s not found", gasGlobalName)
+	}
+	gas.Set(uint64(blockchainContext(ctx).GetGas()))
+	if initialize := module.ExportedFunction("_initialize"); initialize != nil {
+		if _, err := initialize.Call(ctx); err != nil {
+			module.Close(ctx)
+			return nil, fmt.Errorf("failed to initialize module: %w", outOfGas(module, err))
+		}
+	}
 	return module, nil
 }
 
-// ExecuteContract executes a deployed contract function
-func (vm *WazeroVM) ExecuteContract(ctx types.BlockchainContext, contractAddr types.Address, functionName string, params []byte) (interface{}, error) {
+// gasGlobal returns the injected gas global of a metered module instance, or nil
+func gasGlobal(m api.Module) api.MutableGlobal {
+	gas, _ := m.ExportedGlobal(gasGlobalName).(api.MutableGlobal)
+	return gas
+}
+
+// chargeGas charges a host function call to the gas global of a metered module.
+// Running out of gas aborts the execution.
+func chargeGas(m api.Module, amount int64) {
+	gas := gasGlobal(m)
+	if gas == nil {
+		return
+	}
+	remaining := int64(gas.Get()) - amount
+	gas.Set(uint64(remaining))
+	if remaining < 0 {
+		panic(ErrOutOfGas)
+	}
+}
+
+// outOfGas reports err as ErrOutOfGas when the metered module ran out of gas
+func outOfGas(m api.Module, err error) error {
+	if gas := gasGlobal(m); gas != nil && int64(gas.Get()) < 0 && !errors.Is(err, ErrOutOfGas) {
+		return fmt.Errorf("%w: %v", ErrOutOfGas, err)
+	}
+	return err
+}
+
+// interrupted reports err as ErrExecutionTimeout or context.Canceled when runCtx ended the execution
+func interrupted(runCtx context.Context, err error) error {
+	switch {
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded) && !errors.Is(err, ErrExecutionTimeout):
+		return fmt.Errorf("%w: %v", ErrExecutionTimeout, err)
+	case errors.Is(runCtx.Err(), context.Canceled) && !errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %v", context.Canceled, err)
+	}
+	return err
+}
+
+// ExecuteContract executes a deployed contract function.
+// The execution is aborted when runCtx is done, ErrExecutionTimeout is returned if its deadline passed.
+func (vm *WazeroVM) ExecuteContract(runCtx context.Context, ctx types.BlockchainContext, contractAddr types.Address, functionName string, params []byte) (interface{}, error) {
+	runResult, err := vm.Execute(runCtx, ctx, contractAddr, functionName, params)
+	if err != nil {
+		return nil, err
+	}
+	if runResult == nil {
+		return nil, nil
+	}
+	if !runResult.Success {
+		return nil, fmt.Errorf("contract execution failed: %s", runResult.Error)
+	}
+	return runResult.Data, nil
+}
+
+// Execute executes a deployed contract function and returns the full execution result.
+// A nil result means the function completed without producing any output.
+// The execution is aborted when runCtx is done, nested calls made through host functions share it.
+func (vm *WazeroVM) Execute(runCtx context.Context, ctx types.BlockchainContext, contractAddr types.Address, functionName string, params []byte) (*types.ExecutionResult, error) {
 	// Check if contract exists
 	// vm.contractsLock.RLock()
 	// wasmCode, exists := vm.contracts[contractAddr]
@@ -223,19 +536,42 @@ func (vm *WazeroVM) ExecuteContract(ctx types.BlockchainContext, contractAddr ty
 	// if !exists {
 	// 	return nil, fmt.Errorf("contract does not exist: %x", contractAddr)
 	// }
-	wasmCode, err := os.ReadFile(filepath.Join(vm.contractDir, fmt.Sprintf("%x", contractAddr)+".wasm"))
+	cached, err := vm.compiledModule(contractAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read contract code: %w", err)
+		return nil, err
 	}
+	defer cached.release(vm.ctx)
 
-	module, err := vm.initContract(ctx, wasmCode)
-	if err != nil {
-		return types.Address{}, fmt.Errorf("failed to instantiate WebAssembly module: %w", err)
+	if runCtx == nil {
+		runCtx = vm.ctx
 	}
+	callCtx := withBlockchainContext(runCtx, ctx)
 
-	result, err := vm.callWasmFunction(ctx, module, functionName, params, contractAddr)
+	// Output is added to the execution trace, also when the execution fails
+	var output bytes.Buffer
+	defer func() {
+		if recorder, ok := ctx.(types.OutputRecorder); ok && output.Len() > 0 {
+			recorder.RecordOutput(contractAddr, output.Bytes())
+		}
+	}()
+	module, err := vm.initContract(callCtx, cached.compiled, &output)
 	if err != nil {
-		return nil, err
+		return nil, interrupted(runCtx, fmt.Errorf("failed to instantiate WebAssembly module: %w", err))
+	}
+	defer module.Close(callCtx)
+
+	gasLimit := ctx.GetGas()
+	result, err := vm.callWasmFunction(callCtx, module, functionName, params, contractAddr)
+	var gasUsed int64
+	if gas := gasGlobal(module); gas != nil {
+		// The host meter is authoritative, the context keeps whatever is left
+		remaining := int64(gas.Get())
+		gasUsed = gasLimit - remaining
+		ctx.SetGasLimit(max(remaining, 0))
+		err = outOfGas(module, err)
+	}
+	if err != nil {
+		return nil, interrupted(runCtx, stackOverflow(module, vm.config.MaxStackDepth, err))
 	}
 	if len(result) == 0 {
 		return nil, nil
@@ -245,11 +581,16 @@ func (vm *WazeroVM) ExecuteContract(ctx types.BlockchainContext, contractAddr ty
 	if err != nil {
 		return nil, fmt.Errorf("failed to deserialize: %w", err)
 	}
-	return runResult.Data, nil
+	if vm.metering {
+		runResult.GasUsed = gasUsed
+	}
+	return &runResult, nil
 }
 
 // callWasmFunction calls a WASM function
-func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Module, functionName string, params []byte, contractAddr types.Address) ([]byte, error) {
+func (vm *WazeroVM) callWasmFunction(callCtx context.Context, module api.Module, functionName string, params []byte, contractAddr types.Address) ([]byte, error) {
+	ctx := blockchainContext(callCtx)
+
 	// fmt.Printf("calling contract function:%s, %v\n", functionName, string(params))
 
 	// Check if allocate and deallocate functions are exported
@@ -269,6 +610,7 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 	input.Function = functionName
 	input.Args = params
 	input.GasLimit = ctx.GetGas()
+	input.Debug = vm.debug
 	// fmt.Println("[host]handle_contract_call gasLimit", input.GasLimit)
 	inputBytes, err := json.Marshal(input)
 	if err != nil {
@@ -276,7 +618,7 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 	}
 
 	// Allocate memory and write parameters
-	result, err := allocate.Call(vm.ctx, uint64(len(inputBytes)))
+	result, err := allocate.Call(callCtx, uint64(len(inputBytes)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to allocate memory: %w", err)
 	}
@@ -288,13 +630,16 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 	}
 
 	// Call processing function
-	result, err = processDataFunc.Call(vm.ctx, uint64(inputAddr), uint64(len(inputBytes)))
+	result, err = processDataFunc.Call(callCtx, uint64(inputAddr), uint64(len(inputBytes)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute %s: %w", functionName, err)
 	}
 
 	var out []byte
 	resultLen := int32(result[0])
+	if resultLen < 0 {
+		return nil, fmt.Errorf("failed to execute %s: error code %d", functionName, resultLen)
+	}
 	// if resultLen > int32(types.HostBufferSize) {
 	// 	resultLen = resultLen - int32(types.HostBufferSize)
 	// }
@@ -304,7 +649,7 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 			return nil, fmt.Errorf("get_buffer_address function not found")
 		}
 
-		result, err = getBufferAddress.Call(vm.ctx)
+		result, err = getBufferAddress.Call(callCtx)
 		if err != nil {
 			return nil, fmt.Errorf("get_buffer_address failed: %w", err)
 		}
@@ -323,7 +668,7 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 	if deallocate == nil {
 		return nil, fmt.Errorf("deallocate function not found")
 	}
-	_, err = deallocate.Call(vm.ctx, uint64(inputAddr), uint64(len(inputBytes)))
+	_, err = deallocate.Call(callCtx, uint64(inputAddr), uint64(len(inputBytes)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to free memory: %w", err)
 	}
@@ -332,8 +677,30 @@ func (vm *WazeroVM) callWasmFunction(ctx types.BlockchainContext, module api.Mod
 	return out, nil
 }
 
+// checkWrite reports whether a host function that changes state may run in ctx
+func checkWrite(ctx types.BlockchainContext, funcID uint32) bool {
+	switch types.WasmFunctionID(funcID) {
+	case types.FuncTransfer, types.FuncCreateObject, types.FuncDeleteObject,
+		types.FuncSetObjectOwner, types.FuncSetObjectField, types.FuncLog, types.FuncSelfDestruct:
+	default:
+		return true
+	}
+	checker, ok := ctx.(types.WriteChecker)
+	if !ok {
+		return true
+	}
+	if err := checker.CheckWrite(); err != nil {
+		slog.Error("host function rejected", "funcID", funcID, "error", err)
+		return false
+	}
+	return true
+}
+
 // Host function handler
 func (vm *WazeroVM) handleHostSet(ctx types.BlockchainContext, m api.Module, funcID uint32, argData []byte, bufferPtr uint32) int32 {
+	if !checkWrite(ctx, funcID) {
+		return -1
+	}
 	// Process different operations based on function ID
 	switch types.WasmFunctionID(funcID) {
 	case types.FuncTransfer:
@@ -346,31 +713,6 @@ func (vm *WazeroVM) handleHostSet(ctx types.BlockchainContext, m api.Module, fun
 			return -1
 		}
 		return 0
-	case types.FuncCall:
-		var params types.CallParams
-		if err := json.Unmarshal(argData, &params); err != nil {
-			return -1
-		}
-		ctx.SetGasLimit(params.GasLimit)
-		result, err := ctx.Call(params.Caller, params.Contract, params.Function, params.Args...)
-		if err != nil {
-			return -1
-		}
-		currentGas := ctx.GetGas()
-		if currentGas > params.GasLimit {
-			return -1
-		}
-		var callResult types.CallResult
-		callResult.Data = result
-		callResult.GasUsed = params.GasLimit - currentGas
-		resultBytes, err := json.Marshal(callResult)
-		if err != nil {
-			return -1
-		}
-		if !m.Memory().Write(bufferPtr, resultBytes) {
-			return -1
-		}
-		return 0
 	case types.FuncDeleteObject:
 		var params types.DeleteObjectParams
 		if err := json.Unmarshal(argData, &params); err != nil {
@@ -446,6 +788,22 @@ func (vm *WazeroVM) handleHostSet(ctx types.BlockchainContext, m api.Module, fun
 		}
 		return 0
 
+	case types.FuncSelfDestruct:
+		var params types.SelfDestructParams
+		if err := json.Unmarshal(argData, &params); err != nil {
+			return -1
+		}
+		destructor, ok := ctx.(types.SelfDestructor)
+		if !ok {
+			slog.Error("context does not support self-destruct", "contract", params.Contract)
+			return -1
+		}
+		if err := destructor.SelfDestruct(params.Contract, params.Beneficiary); err != nil {
+			slog.Error("failed to self-destruct", "contract", params.Contract, "error", err)
+			return -1
+		}
+		return 0
+
 	default:
 		return -1
 	}
@@ -456,6 +814,9 @@ func (vm *WazeroVM) handleHostGetBuffer(ctx types.BlockchainContext, m api.Modul
 	if mem == nil {
 		return -1
 	}
+	if !checkWrite(ctx, funcID) {
+		return -1
+	}
 	// Process different operations based on function ID
 	switch types.WasmFunctionID(funcID) {
 	case types.FuncGetSender:
@@ -468,6 +829,63 @@ func (vm *WazeroVM) handleHostGetBuffer(ctx types.BlockchainContext, m api.Modul
 		mem.Write(offset, contractAddr[:])
 		return int32(len(contractAddr))
 
+	case types.FuncGetValue:
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], ctx.Value())
+		mem.Write(offset, value[:])
+		return int32(len(value))
+
+	case types.FuncCall:
+		// Numbers stay exact, the callee's ABI decides their type
+		var params types.CallParams
+		dec := json.NewDecoder(bytes.NewReader(argData))
+		dec.UseNumber()
+		if err := dec.Decode(&params); err != nil {
+			return -1
+		}
+		if params.GasLimit <= 0 {
+			return -1
+		}
+		// A metered callee can't use more gas than the caller has left
+		if gas := gasGlobal(m); gas != nil {
+			params.GasLimit = min(params.GasLimit, int64(gas.Get()))
+		}
+		// The caller is always the executing contract, never an address chosen by the contract
+		ctx.SetGasLimit(params.GasLimit)
+		var result []byte
+		var err error
+		if params.Value == 0 {
+			result, err = ctx.Call(ctx.ContractAddress(), params.Contract, params.Function, params.Args...)
+		} else if caller, ok := ctx.(types.ValueCaller); ok {
+			result, err = caller.CallWithValue(ctx.ContractAddress(), params.Contract, params.Function, params.Value, params.Args...)
+		} else {
+			err = errors.New("context does not support calls with value")
+		}
+		currentGas := ctx.GetGas()
+		if currentGas > params.GasLimit {
+			return -1
+		}
+		// Gas spent by the callee is charged even if the call failed
+		chargeGas(m, params.GasLimit-currentGas)
+		if err != nil {
+			slog.Error("cross-contract call failed", "contract", params.Contract, "function", params.Function, "error", err)
+			return -1
+		}
+		var callResult types.CallResult
+		callResult.Data = result
+		callResult.GasUsed = params.GasLimit - currentGas
+		resultBytes, err := json.Marshal(callResult)
+		if err != nil {
+			return -1
+		}
+		if len(resultBytes) > int(types.HostBufferSize) {
+			return -1
+		}
+		if !mem.Write(offset, resultBytes) {
+			return -1
+		}
+		return int32(len(resultBytes))
+
 	case types.FuncCreateObject:
 		obj, err := ctx.CreateObject(ctx.ContractAddress())
 		if err != nil {
@@ -558,5 +976,13 @@ func (vm *WazeroVM) Close() error {
 			return fmt.Errorf("failed to close env module: %w", err)
 		}
 	}
+	if err := vm.runtime.Close(vm.ctx); err != nil {
+		return fmt.Errorf("failed to close runtime: %w", err)
+	}
+	if vm.cache != nil {
+		if err := vm.cache.Close(vm.ctx); err != nil {
+			return fmt.Errorf("failed to close compilation cache: %w", err)
+		}
+	}
 	return nil
 }
@@ -2,13 +2,20 @@
 package wasi
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"testing"
+	"time"
 
+	api1 "github.com/govm-net/vm/api"
 	"github.com/govm-net/vm/context/memory"
 	"github.com/govm-net/vm/core"
+	"github.com/tetratelabs/wazero"
 )
 
 func TestNewWazeroVM(t *testing.T) {
@@ -45,7 +52,7 @@ func TestNewWazeroVM(t *testing.T) {
 	// ctx.SetExecutionContext(contractAddr, sender)
 
 	// 测试执行合约
-	result, err := svm.ExecuteContract(ctx, contractAddr, "Initialize", nil)
+	result, err := svm.ExecuteContract(context.Background(), ctx, contractAddr, "Initialize", nil)
 	if err != nil {
 		t.Fatalf("ExecuteContract() error = %v", err)
 	}
@@ -57,7 +64,7 @@ func TestNewWazeroVM(t *testing.T) {
 	}
 
 	// 测试执行合约
-	result, err = svm.ExecuteContract(ctx, contractAddr, "Increment", []byte(`{"amount": 2}`))
+	result, err = svm.ExecuteContract(context.Background(), ctx, contractAddr, "Increment", []byte(`{"amount": 2}`))
 	if err != nil {
 		t.Fatalf("ExecuteContract() error = %v", err)
 	}
@@ -70,7 +77,7 @@ func TestNewWazeroVM(t *testing.T) {
 	}
 
 	// 测试执行合约
-	result, err = svm.ExecuteContract(ctx, contractAddr, "Increment", []byte(`{"amount": 2}`))
+	result, err = svm.ExecuteContract(context.Background(), ctx, contractAddr, "Increment", []byte(`{"amount": 2}`))
 	if err != nil {
 		t.Fatalf("ExecuteContract() error = %v", err)
 	}
@@ -81,7 +88,7 @@ func TestNewWazeroVM(t *testing.T) {
 		t.Fatalf("Increment() error = %v", resultValue)
 	}
 
-	result, err = svm.ExecuteContract(ctx, contractAddr, "Panic", nil)
+	result, err = svm.ExecuteContract(context.Background(), ctx, contractAddr, "Panic", nil)
 	if err == nil {
 		t.Fatalf("ExecuteContract() error = %v", err)
 	}
@@ -90,3 +97,531 @@ func TestNewWazeroVM(t *testing.T) {
 	}
 	// t.Error(err)
 }
+
+func TestCompiledModuleCache(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "wazero_engine_test")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	svm, err := NewWazeroVM(tmpDir)
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+
+	// Smallest valid module: magic number and version
+	code := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	ctx := memory.NewBlockchainContext(nil)
+	contractAddr, err := svm.DeployContract(ctx, code, core.Address{})
+	if err != nil {
+		t.Fatalf("DeployContract() error = %v", err)
+	}
+
+	compiled, err := svm.compiledModule(contractAddr)
+	if err != nil {
+		t.Fatalf("compiledModule() error = %v", err)
+	}
+	cached, err := svm.compiledModule(contractAddr)
+	if err != nil {
+		t.Fatalf("compiledModule() error = %v", err)
+	}
+	if compiled != cached {
+		t.Fatalf("compiledModule() recompiled a cached contract")
+	}
+	cached.release(svm.ctx)
+
+	svm.DeleteContract(ctx, contractAddr)
+	if _, ok := svm.modules[contractAddr]; ok {
+		t.Fatalf("DeleteContract() did not invalidate the compiled module")
+	}
+
+	// An evicted module stays usable by the execution that still holds it
+	module, err := svm.runtime.InstantiateModule(svm.ctx, compiled.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		t.Fatalf("InstantiateModule() of an evicted module in use error = %v", err)
+	}
+	module.Close(svm.ctx)
+	compiled.release(svm.ctx)
+	if refs := compiled.refs.Load(); refs != 0 {
+		t.Fatalf("references after the last release = %d, want 0", refs)
+	}
+}
+
+// meteringTestModule exports "add", which runs five instructions, and "spin", which loops forever.
+// It also defines a global so the gas global is appended after existing ones.
+var meteringTestModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: func() -> ()
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+	// function section: two functions of type 0
+	0x03, 0x03, 0x02, 0x00, 0x00,
+	// global section: (global (mut i32) (i32.const 0))
+	0x06, 0x06, 0x01, 0x7f, 0x01, 0x41, 0x00, 0x0b,
+	// export section: "add" func 0, "spin" func 1
+	0x07, 0x0e, 0x02,
+	0x03, 'a', 'd', 'd', 0x00, 0x00,
+	0x04, 's', 'p', 'i', 'n', 0x00, 0x01,
+	// code section
+	0x0a, 0x12, 0x02,
+	// add: i32.const 1, i32.const 2, i32.add, drop, end
+	0x08, 0x00, 0x41, 0x01, 0x41, 0x02, 0x6a, 0x1a, 0x0b,
+	// spin: loop, br 0, end, end
+	0x07, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b,
+}
+
+func TestInstrumentGas(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	code, err := instrumentGas(meteringTestModule)
+	if err != nil {
+		t.Fatalf("instrumentGas() error = %v", err)
+	}
+	module, err := runtime.Instantiate(ctx, code)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+	gas := gasGlobal(module)
+	if gas == nil {
+		t.Fatalf("gas global %s not exported", gasGlobalName)
+	}
+
+	gas.Set(1000)
+	if _, err := module.ExportedFunction("add").Call(ctx); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if got := int64(gas.Get()); got != 995 {
+		t.Fatalf("gas after add() = %d, want 995", got)
+	}
+
+	// Endless loops trap once the gas is exhausted
+	gas.Set(1000)
+	_, err = module.ExportedFunction("spin").Call(ctx)
+	if !errors.Is(outOfGas(module, err), ErrOutOfGas) {
+		t.Fatalf("spin() error = %v, want %v", err, ErrOutOfGas)
+	}
+
+	// Modules without globals or exports get both sections
+	code, err = instrumentGas([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	if err != nil {
+		t.Fatalf("instrumentGas() error = %v", err)
+	}
+	module, err = runtime.Instantiate(ctx, code)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+	if gasGlobal(module) == nil {
+		t.Fatalf("gas global %s not exported", gasGlobalName)
+	}
+
+	// Instrumenting twice would clash with the existing gas export
+	if _, err := instrumentGas(code); err == nil {
+		t.Fatalf("instrumentGas() of an instrumented module succeeded")
+	}
+}
+
+func TestInstrumentGasBulkMemory(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	// fill(n) runs memory.fill of n bytes in five instructions, it has a local so the length local is appended
+	code, err := instrumentGas([]byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		// type section: func(i32) -> ()
+		0x01, 0x05, 0x01, 0x60, 0x01, 0x7f, 0x00,
+		// function section, memory section with one page
+		0x03, 0x02, 0x01, 0x00,
+		0x05, 0x03, 0x01, 0x00, 0x01,
+		// export section: "fill" func 0
+		0x07, 0x08, 0x01, 0x04, 'f', 'i', 'l', 'l', 0x00, 0x00,
+		// code section: (local i64) i32.const 0, i32.const 0, local.get 0, memory.fill, end
+		0x0a, 0x0f, 0x01, 0x0d, 0x01, 0x01, 0x7e,
+		0x41, 0x00, 0x41, 0x00, 0x20, 0x00, 0xfc, 0x0b, 0x00, 0x0b,
+	})
+	if err != nil {
+		t.Fatalf("instrumentGas() error = %v", err)
+	}
+	module, err := runtime.Instantiate(ctx, code)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+
+	// Every byte filled is charged
+	gas := gasGlobal(module)
+	gas.Set(1000)
+	if _, err := module.ExportedFunction("fill").Call(ctx, 100); err != nil {
+		t.Fatalf("fill() error = %v", err)
+	}
+	if got := int64(gas.Get()); got != 895 {
+		t.Fatalf("gas after fill(100) = %d, want 895", got)
+	}
+	gas.Set(1000)
+	_, err = module.ExportedFunction("fill").Call(ctx, 65536)
+	if !errors.Is(outOfGas(module, err), ErrOutOfGas) {
+		t.Fatalf("fill(65536) error = %v, want %v", err, ErrOutOfGas)
+	}
+}
+
+func TestInstrumentGasRejectsGasGlobal(t *testing.T) {
+	// refill sets global 1, which doesn't exist before instrumentation and would be the gas global after it
+	code := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+		0x03, 0x02, 0x01, 0x00,
+		// global section: (global (mut i32) (i32.const 0))
+		0x06, 0x06, 0x01, 0x7f, 0x01, 0x41, 0x00, 0x0b,
+		// code section: i64.const 1000000, global.set 1, end
+		0x0a, 0x0a, 0x01, 0x08, 0x00, 0x42, 0xc0, 0x84, 0x3d, 0x24, 0x01, 0x0b,
+	}
+	if _, err := instrumentGas(code); err == nil {
+		t.Fatalf("instrumentGas() of a module setting the gas global succeeded")
+	}
+	if _, err := instrumentCallDepth(code, 10); err == nil {
+		t.Fatalf("instrumentCallDepth() of a module setting the depth global succeeded")
+	}
+
+	// The deployed code is validated before it is instrumented
+	tmpDir, err := os.MkdirTemp("", "wazero_engine_test")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	svm, err := NewWazeroVM(tmpDir)
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+	svm.WithMetering(true)
+	contractAddr, err := svm.DeployContract(memory.NewBlockchainContext(nil), code, core.Address{})
+	if err != nil {
+		t.Fatalf("DeployContract() error = %v", err)
+	}
+	if _, err := svm.compiledModule(contractAddr); err == nil {
+		t.Fatalf("compiledModule() of an invalid module succeeded")
+	}
+}
+
+func TestExecutionTimeout(t *testing.T) {
+	svm, err := NewWazeroVM("")
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+
+	module, err := svm.runtime.Instantiate(context.Background(), meteringTestModule)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+
+	// An endless loop without gas metering is stopped by the deadline
+	runCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = module.ExportedFunction("spin").Call(runCtx)
+	if err == nil {
+		t.Fatalf("spin() returned without error")
+	}
+	if err := interrupted(runCtx, err); !errors.Is(err, ErrExecutionTimeout) {
+		t.Fatalf("spin() error = %v, want %v", err, ErrExecutionTimeout)
+	}
+}
+
+// recursionTestModule declares two pages of memory and exports "recurse", which calls itself forever
+var recursionTestModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: func() -> ()
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+	// function section: one function of type 0
+	0x03, 0x02, 0x01, 0x00,
+	// memory section: min 2 pages
+	0x05, 0x03, 0x01, 0x00, 0x02,
+	// export section: "recurse" func 0
+	0x07, 0x0b, 0x01, 0x07, 'r', 'e', 'c', 'u', 'r', 's', 'e', 0x00, 0x00,
+	// code section: recurse: call 0, end
+	0x0a, 0x06, 0x01, 0x04, 0x00, 0x10, 0x00, 0x0b,
+}
+
+// tableTestModule returns a module declaring a table of min entries, with a maximum of max unless it is negative
+func tableTestModule(min, max int) []byte {
+	table := []byte{0x01, 0x70, 0x00, byte(min)}
+	if max >= 0 {
+		table = []byte{0x01, 0x70, 0x01, byte(min), byte(max)}
+	}
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x04, byte(len(table))}
+	return append(module, table...)
+}
+
+// growTestModule declares one page of memory without a maximum and exports "grow", which runs memory.grow
+var growTestModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: func(i32) -> i32
+	0x01, 0x06, 0x01, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	// function section: one function of type 0
+	0x03, 0x02, 0x01, 0x00,
+	// memory section: min 1 page, no max
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export section: "grow" func 0
+	0x07, 0x08, 0x01, 0x04, 'g', 'r', 'o', 'w', 0x00, 0x00,
+	// code section: grow: local.get 0, memory.grow 0, end
+	0x0a, 0x08, 0x01, 0x06, 0x00, 0x20, 0x00, 0x40, 0x00, 0x0b,
+}
+
+func TestModuleLimits(t *testing.T) {
+	if err := checkModuleLimits(recursionTestModule, 1, 0); err == nil {
+		t.Fatalf("checkModuleLimits() accepted 2 pages of memory with a limit of 1")
+	}
+	if err := checkModuleLimits(recursionTestModule, 2, 0); err != nil {
+		t.Fatalf("checkModuleLimits() error = %v", err)
+	}
+
+	// Tables must declare a maximum within the limit, so table.grow can't exceed it
+	if err := checkModuleLimits(tableTestModule(1, -1), 0, 4); err == nil {
+		t.Fatalf("checkModuleLimits() accepted a table without a maximum")
+	}
+	if err := checkModuleLimits(tableTestModule(1, 5), 0, 4); err == nil {
+		t.Fatalf("checkModuleLimits() accepted a table maximum of 5 with a limit of 4")
+	}
+	if err := checkModuleLimits(tableTestModule(1, 4), 0, 4); err != nil {
+		t.Fatalf("checkModuleLimits() error = %v", err)
+	}
+	if err := checkModuleLimits(tableTestModule(1, -1), 0, 0); err != nil {
+		t.Fatalf("checkModuleLimits() without a table limit error = %v", err)
+	}
+
+	// Memory can't grow past the limit of the runtime
+	config := api1.DefaultContractConfig()
+	config.MaxMemoryPages = 2
+	limited, err := NewWazeroVMWithConfig("", config)
+	if err != nil {
+		t.Fatalf("NewWazeroVMWithConfig() error = %v", err)
+	}
+	defer limited.Close()
+	grower, err := limited.runtime.Instantiate(context.Background(), growTestModule)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+	grow := grower.ExportedFunction("grow")
+	if res, err := grow.Call(context.Background(), 1); err != nil || res[0] != 1 {
+		t.Fatalf("grow(1) = %v, %v, want 1", res, err)
+	}
+	if res, err := grow.Call(context.Background(), 1); err != nil || uint32(res[0]) != math.MaxUint32 {
+		t.Fatalf("grow(1) past the limit = %v, %v, want -1", res, err)
+	}
+
+	svm, err := NewWazeroVM(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+	if _, err := svm.DeployContract(memory.NewBlockchainContext(nil), make([]byte, 8), core.Address{0x01}); err == nil {
+		t.Fatalf("DeployContract() accepted an invalid module")
+	}
+
+	// Unbounded recursion traps at the stack depth limit
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+	code, err := instrumentCallDepth(recursionTestModule, 100)
+	if err != nil {
+		t.Fatalf("instrumentCallDepth() error = %v", err)
+	}
+	module, err := runtime.Instantiate(ctx, code)
+	if err != nil {
+		t.Fatalf("Instantiate() error = %v", err)
+	}
+	_, err = module.ExportedFunction("recurse").Call(ctx)
+	if !errors.Is(stackOverflow(module, 100, err), ErrStackOverflow) {
+		t.Fatalf("recurse() error = %v, want %v", err, ErrStackOverflow)
+	}
+	if depth := module.ExportedGlobal(depthGlobalName).Get(); depth != 101 {
+		t.Fatalf("depth = %d, want 101", depth)
+	}
+}
+
+func TestDeterministicRand(t *testing.T) {
+	ctx := memory.NewBlockchainContext(nil)
+	ctx.SetBlockInfo(10, 1000, core.Hash{0x01})
+	ctx.SetTransactionInfo(core.Hash{0x02}, core.Address{0x03}, core.Address{0x04}, 0)
+
+	// The stream only depends on the seed, not on how it is read
+	a := make([]byte, 100)
+	newSeededRand(randSeed(ctx)).Read(a)
+	b := make([]byte, 100)
+	r := newSeededRand(randSeed(ctx))
+	r.Read(b[:7])
+	r.Read(b[7:])
+	if string(a) != string(b) {
+		t.Fatalf("seeded random streams differ")
+	}
+
+	ctx.SetTransactionInfo(core.Hash{0x05}, core.Address{0x03}, core.Address{0x04}, 0)
+	c := make([]byte, 100)
+	newSeededRand(randSeed(ctx)).Read(c)
+	if string(a) == string(c) {
+		t.Fatalf("different transactions got the same random stream")
+	}
+}
+
+// wasiTestModule writes "hi\n" to stdout and stores the realtime clock at address 32 when initialized
+var wasiTestModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: fd_write, _initialize, clock_time_get
+	0x01, 0x13, 0x03,
+	0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f,
+	0x60, 0x00, 0x00,
+	0x60, 0x03, 0x7f, 0x7e, 0x7f, 0x01, 0x7f,
+	// import section: fd_write func 0, clock_time_get func 1
+	0x02, 0x4b, 0x02,
+	0x16, 'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_', 'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	0x08, 'f', 'd', '_', 'w', 'r', 'i', 't', 'e', 0x00, 0x00,
+	0x16, 'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_', 'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	0x0e, 'c', 'l', 'o', 'c', 'k', '_', 't', 'i', 'm', 'e', '_', 'g', 'e', 't', 0x00, 0x02,
+	// function section: _initialize
+	0x03, 0x02, 0x01, 0x01,
+	// memory section: one page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export section: "memory", "_initialize"
+	0x07, 0x18, 0x02,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x0b, '_', 'i', 'n', 'i', 't', 'i', 'a', 'l', 'i', 'z', 'e', 0x00, 0x02,
+	// code section: fd_write(1, 0, 1, 20), clock_time_get(0, 0, 32)
+	0x0a, 0x18, 0x01, 0x16, 0x00,
+	0x41, 0x01, 0x41, 0x00, 0x41, 0x01, 0x41, 0x14, 0x10, 0x00, 0x1a,
+	0x41, 0x00, 0x42, 0x00, 0x41, 0x20, 0x10, 0x01, 0x1a,
+	0x0b,
+	// data section: iovec {8, 3} at 0, "hi\n" at 8
+	0x0b, 0x11, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x0b,
+	0x08, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 'h', 'i', '\n',
+}
+
+func TestDeterministicEnvironment(t *testing.T) {
+	svm, err := NewWazeroVM("")
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+	svm.WithDeterministic(true)
+
+	ctx := memory.NewBlockchainContext(nil)
+	ctx.SetBlockInfo(10, 1000, core.Hash{0x01})
+	compiled, err := svm.runtime.CompileModule(context.Background(), wasiTestModule)
+	if err != nil {
+		t.Fatalf("CompileModule() error = %v", err)
+	}
+
+	var output bytes.Buffer
+	module, err := svm.initContract(withBlockchainContext(context.Background(), ctx), compiled, &output)
+	if err != nil {
+		t.Fatalf("initContract() error = %v", err)
+	}
+	defer module.Close(context.Background())
+
+	// Output is captured and the clock reads the block time
+	if output.String() != "hi\n" {
+		t.Fatalf("output = %q, want %q", output.String(), "hi\n")
+	}
+	now, ok := module.Memory().ReadUint64Le(32)
+	if !ok || now != 1000*1e9 {
+		t.Fatalf("clock = %d, want %d", now, int64(1000*1e9))
+	}
+}
+
+func TestWazeroModes(t *testing.T) {
+	if _, err := NewWazeroVMWithMode("", api1.DefaultContractConfig(), Mode(-1)); err == nil {
+		t.Fatalf("NewWazeroVMWithMode() with an unknown mode succeeded")
+	}
+
+	code, err := instrumentGas(meteringTestModule)
+	if err != nil {
+		t.Fatalf("instrumentGas() error = %v", err)
+	}
+	for _, mode := range []Mode{ModeAuto, ModeCompiler, ModeInterpreter} {
+		svm, err := NewWazeroVMWithMode("", api1.DefaultContractConfig(), mode)
+		if err != nil {
+			t.Fatalf("NewWazeroVMWithMode(%d) error = %v", mode, err)
+		}
+		module, err := svm.runtime.Instantiate(context.Background(), code)
+		if err != nil {
+			t.Fatalf("Instantiate() in mode %d error = %v", mode, err)
+		}
+
+		// Every mode charges the same gas
+		gasGlobal(module).Set(1000)
+		if _, err := module.ExportedFunction("add").Call(context.Background()); err != nil {
+			t.Fatalf("add() in mode %d error = %v", mode, err)
+		}
+		if got := int64(gasGlobal(module).Get()); got != 995 {
+			t.Fatalf("gas after add() in mode %d = %d, want 995", mode, got)
+		}
+		svm.Close()
+	}
+}
+
+// contractTestModule builds a module with the exports of a contract that imports env function name with type typeIdx,
+// types are 0: () -> i32, 1: (i32) -> i32, 2: (i32, i32) -> () and 3: (i32, i32) -> i32
+func contractTestModule(name string, typeIdx byte) []byte {
+	vec := func(items ...[]byte) []byte {
+		out := []byte{byte(len(items))}
+		for _, item := range items {
+			out = append(out, item...)
+		}
+		return out
+	}
+	str := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	section := func(id byte, content []byte) []byte { return append([]byte{id, byte(len(content))}, content...) }
+	export := func(name string, kind, idx byte) []byte { return append(str(name), kind, idx) }
+	body := func(code ...byte) []byte { return append([]byte{byte(len(code) + 1), 0x00}, code...) }
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, vec(
+		[]byte{0x60, 0x00, 0x01, 0x7f},
+		[]byte{0x60, 0x01, 0x7f, 0x01, 0x7f},
+		[]byte{0x60, 0x02, 0x7f, 0x7f, 0x00},
+		[]byte{0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f},
+	))...)
+	module = append(module, section(2, vec(append(append(str("env"), str(name)...), 0x00, typeIdx)))...)
+	module = append(module, section(3, vec([]byte{1}, []byte{2}, []byte{3}, []byte{0}))...)
+	module = append(module, section(5, vec([]byte{0x00, 0x01}))...)
+	module = append(module, section(7, vec(
+		export("memory", 0x02, 0),
+		export("allocate", 0x00, 1),
+		export("deallocate", 0x00, 2),
+		export("handle_contract_call", 0x00, 3),
+		export("get_buffer_address", 0x00, 4),
+	))...)
+	return append(module, section(10, vec(
+		body(0x41, 0x00, 0x0b),
+		body(0x0b),
+		body(0x41, 0x00, 0x0b),
+		body(0x41, 0x00, 0x0b),
+	))...)
+}
+
+func TestValidateModule(t *testing.T) {
+	svm, err := NewWazeroVM("")
+	if err != nil {
+		t.Fatalf("NewWazeroVM() error = %v", err)
+	}
+	defer svm.Close()
+
+	if err := svm.ValidateModule(contractTestModule("get_block_height", 0)); err != nil {
+		t.Fatalf("ValidateModule() error = %v", err)
+	}
+	if err := svm.ValidateModule(contractTestModule("get_balance", 1)); err != nil {
+		t.Fatalf("ValidateModule() error = %v", err)
+	}
+
+	invalid := map[string][]byte{
+		"unknown host function": contractTestModule("read_file", 0),
+		"wrong signature":       contractTestModule("get_balance", 0),
+		"missing exports":       meteringTestModule,
+		"not a module":          []byte("not wasm"),
+	}
+	for name, code := range invalid {
+		if err := svm.ValidateModule(code); !errors.Is(err, ErrInvalidModule) {
+			t.Errorf("ValidateModule() of %s error = %v, want %v", name, err, ErrInvalidModule)
+		}
+	}
+}